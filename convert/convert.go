@@ -60,14 +60,22 @@ func WriteBit32LE(bitMask int32, n uint, value bool) int32 {
 	return newBitMask
 }
 
-// ToInt converts an interface{} to an int. Will also convert float32 and float64
-// to integers via rounding. A default value can be provided if the conversion fails,
-// otherwise 0 will be returned. Any argument after the 2nd one will be ignored.
+// ToInt converts an interface{} to an int. Will also convert int32, int64, float32
+// and float64 to integers, rounding where needed. A default value can be provided if the
+// conversion fails, otherwise 0 will be returned. Any argument after the 2nd one will be ignored.
 func ToInt(in interface{}, def ...int) int {
 	n, ok := in.(int)
 	if ok {
 		return n
 	}
+	n32, ok := in.(int32)
+	if ok {
+		return int(n32)
+	}
+	n64, ok := in.(int64)
+	if ok {
+		return int(n64)
+	}
 	n2, ok := in.(float32)
 	if ok {
 		return int(n2)
@@ -217,10 +225,14 @@ func ToBSONMap(in interface{}) bson.M {
 
 }
 
-// ConvertToBSONMapSlice converts an []interface{}, []bson.D, or []bson.M slice to a []bson.M
-// slice (assuming that all contents are either bson.M or bson.D objects)
+// ConvertToBSONMapSlice converts an []interface{}, bson.A, []bson.D, or []bson.M slice to a
+// []bson.M slice (assuming that all contents are either bson.M or bson.D objects)
 func ConvertToBSONMapSlice(input interface{}) ([]bson.M, error) {
 
+	if a, ok := input.(bson.A); ok {
+		input = []interface{}(a)
+	}
+
 	inputBSONM, ok := input.([]bson.M)
 	if ok {
 		return inputBSONM, nil
@@ -268,9 +280,13 @@ func ConvertToBSONMapSlice(input interface{}) ([]bson.M, error) {
 	return nil, fmt.Errorf("Unsupported input for bson.M slice: %#v", input)
 }
 
-// ConvertToBSONDocSlice converts an []interface{} to a []bson.D slice
+// ConvertToBSONDocSlice converts an []interface{} or bson.A to a []bson.D slice
 // assuming contents are bson.D objects
 func ConvertToBSONDocSlice(input interface{}) ([]bson.D, error) {
+	if a, ok := input.(bson.A); ok {
+		input = []interface{}(a)
+	}
+
 	inputBSOND, ok := input.([]bson.D)
 	if ok {
 		return inputBSOND, nil
@@ -294,6 +310,10 @@ func ConvertToBSONDocSlice(input interface{}) ([]bson.D, error) {
 }
 
 func ConvertToStringSlice(input interface{}) ([]string, error) {
+	if a, ok := input.(bson.A); ok {
+		input = []interface{}(a)
+	}
+
 	inputStrings, ok := input.([]string)
 	if ok {
 		return inputStrings, nil
@@ -315,3 +335,36 @@ func ConvertToStringSlice(input interface{}) ([]string, error) {
 
 	return nil, fmt.Errorf("Unsupported input for a string slice: %#v", input)
 }
+
+// ConvertToInt64Slice converts an []interface{} or bson.A of integers to an
+// []int64 slice.
+func ConvertToInt64Slice(input interface{}) ([]int64, error) {
+	inputInt64s, ok := input.([]int64)
+	if ok {
+		return inputInt64s, nil
+	}
+
+	if a, ok := input.(bson.A); ok {
+		input = []interface{}(a)
+	}
+
+	inputInterface, ok := input.([]interface{})
+	if ok {
+		d := make([]int64, len(inputInterface))
+		for i := 0; i < len(inputInterface); i++ {
+			switch n := inputInterface[i].(type) {
+			case int64:
+				d[i] = n
+			case int32:
+				d[i] = int64(n)
+			case int:
+				d[i] = int64(n)
+			default:
+				return nil, fmt.Errorf("Slice contents aren't integers")
+			}
+		}
+		return d, nil
+	}
+
+	return nil, fmt.Errorf("Unsupported input for an int64 slice: %#v", input)
+}
@@ -5,8 +5,11 @@ go 1.13
 require (
 	github.com/gin-gonic/gin v1.7.2
 	github.com/globalsign/mgo v0.0.0-20181015135952-eeefdecb41b8
+	github.com/golang/snappy v0.0.1
 	github.com/pkg/errors v0.9.1
 	github.com/sirupsen/logrus v1.4.2
 	github.com/smartystreets/goconvey v1.6.4
+	github.com/xdg-go/pbkdf2 v1.0.0
+	github.com/xdg-go/scram v1.0.2
 	go.mongodb.org/mongo-driver v1.5.3
 )
@@ -0,0 +1,197 @@
+package messages
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+
+	"github.com/WyattNielsen/mongoproxy/buffer"
+	"github.com/WyattNielsen/mongoproxy/convert"
+	"github.com/golang/snappy"
+)
+
+// constants representing the compressor IDs used in OP_COMPRESSED messages.
+const (
+	CompressorNoop   uint8 = 0
+	CompressorSnappy       = 1
+	CompressorZlib         = 2
+)
+
+// SupportedCompressors are the names of the compressors the proxy can use, in
+// the order it prefers them.
+var SupportedCompressors = []string{"snappy", "zlib"}
+
+// CompressorID returns the OP_COMPRESSED compressor ID for the compressor with
+// the given name, and false if the compressor isn't supported.
+func CompressorID(name string) (uint8, bool) {
+	switch name {
+	case "noop":
+		return CompressorNoop, true
+	case "snappy":
+		return CompressorSnappy, true
+	case "zlib":
+		return CompressorZlib, true
+	default:
+		return 0, false
+	}
+}
+
+// NegotiateCompressors takes the compressors a client offered in its handshake
+// and returns the ones the proxy supports, in the client's order of preference.
+func NegotiateCompressors(offered []string) []string {
+	agreed := make([]string, 0)
+	for _, name := range offered {
+		for _, supported := range SupportedCompressors {
+			if name == supported {
+				agreed = append(agreed, name)
+				break
+			}
+		}
+	}
+	return agreed
+}
+
+// decompress decompresses data with the compressor with the given ID, expecting
+// exactly uncompressedSize bytes of output.
+func decompress(compressor uint8, data []byte, uncompressedSize int32) ([]byte, error) {
+	if uncompressedSize < 0 || uncompressedSize > MaxMessageSizeBytes-16 {
+		return nil, fmt.Errorf("invalid uncompressed size: %v", uncompressedSize)
+	}
+
+	var out []byte
+	switch compressor {
+	case CompressorNoop:
+		out = data
+	case CompressorSnappy:
+		n, err := snappy.DecodedLen(data)
+		if err != nil {
+			return nil, fmt.Errorf("error reading snappy length: %v", err)
+		}
+		if n != int(uncompressedSize) {
+			return nil, fmt.Errorf("snappy length %v does not match uncompressed size %v",
+				n, uncompressedSize)
+		}
+		out, err = snappy.Decode(nil, data)
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing snappy message: %v", err)
+		}
+	case CompressorZlib:
+		r, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing zlib message: %v", err)
+		}
+		defer r.Close()
+		out = make([]byte, uncompressedSize)
+		_, err = io.ReadFull(r, out)
+		if err != nil {
+			return nil, fmt.Errorf("error decompressing zlib message: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported compressor: %v", compressor)
+	}
+
+	if len(out) != int(uncompressedSize) {
+		return nil, fmt.Errorf("decompressed %v bytes instead of %v", len(out), uncompressedSize)
+	}
+	return out, nil
+}
+
+// compress compresses data with the compressor with the given ID.
+func compress(compressor uint8, data []byte) ([]byte, error) {
+	switch compressor {
+	case CompressorNoop:
+		return data, nil
+	case CompressorSnappy:
+		return snappy.Encode(nil, data), nil
+	case CompressorZlib:
+		buf := bytes.NewBuffer([]byte{})
+		w := zlib.NewWriter(buf)
+		_, err := w.Write(data)
+		if err != nil {
+			return nil, fmt.Errorf("error compressing zlib message: %v", err)
+		}
+		err = w.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error compressing zlib message: %v", err)
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("unsupported compressor: %v", compressor)
+	}
+}
+
+// OpCode 2012. Reads the compressed message, and returns the header and
+// the body of the original message it wraps.
+func processOpCompressed(reader io.Reader, header MsgHeader) (MsgHeader, []byte, uint8, error) {
+	// originalOpcode, uncompressedSize and compressorId
+	if header.MessageLength < 16+4+4+1 {
+		return MsgHeader{}, nil, 0, fmt.Errorf("Message length not long enough for OP_COMPRESSED")
+	}
+	if header.MessageLength > MaxMessageSizeBytes {
+		return MsgHeader{}, nil, 0, fmt.Errorf("Message length %v exceeds the maximum of %v",
+			header.MessageLength, MaxMessageSizeBytes)
+	}
+
+	body := make([]byte, header.MessageLength-16)
+	_, err := io.ReadFull(reader, body)
+	if err != nil {
+		return MsgHeader{}, nil, 0, fmt.Errorf("error reading message body: %v", err)
+	}
+
+	originalOpCode := convert.ConvertToInt32LE(body[0:4])
+	uncompressedSize := convert.ConvertToInt32LE(body[4:8])
+	compressor := body[8]
+
+	if originalOpCode == OP_COMPRESSED {
+		return MsgHeader{}, nil, 0, fmt.Errorf("OP_COMPRESSED cannot wrap another OP_COMPRESSED")
+	}
+
+	data, err := decompress(compressor, body[9:], uncompressedSize)
+	if err != nil {
+		return MsgHeader{}, nil, 0, err
+	}
+
+	originalHeader := MsgHeader{
+		MessageLength: uncompressedSize + 16,
+		RequestID:     header.RequestID,
+		ResponseTo:    header.ResponseTo,
+		OpCode:        originalOpCode,
+	}
+
+	return originalHeader, data, compressor, nil
+}
+
+// CompressMessage wraps an encoded wire protocol message in an OP_COMPRESSED
+// message, compressing it with the compressor with the given ID.
+func CompressMessage(message []byte, compressor uint8) ([]byte, error) {
+	if len(message) < 16 {
+		return nil, fmt.Errorf("Message length not long enough for header")
+	}
+
+	compressed, err := compress(compressor, message[16:])
+	if err != nil {
+		return nil, err
+	}
+
+	resHeader := MsgHeader{
+		RequestID:  convert.ConvertToInt32LE(message[4:8]),
+		ResponseTo: convert.ConvertToInt32LE(message[8:12]),
+		OpCode:     OP_COMPRESSED,
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+	err = buffer.WriteToBuf(buf, resHeader,
+		convert.ConvertToInt32LE(message[12:16]), // originalOpcode
+		int32(len(message)-16),                   // uncompressedSize
+		compressor)
+	if err != nil {
+		return nil, fmt.Errorf("error writing prepared response %v", err)
+	}
+
+	resp := append(buf.Bytes(), compressed...)
+
+	resp = setMessageSize(resp)
+
+	return resp, nil
+}
@@ -0,0 +1,68 @@
+package messages
+
+import (
+	"testing"
+
+	"github.com/WyattNielsen/mongoproxy/convert"
+	"github.com/WyattNielsen/mongoproxy/mock"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestNegotiateCompressors(t *testing.T) {
+	Convey("Negotiate compressors with a client", t, func() {
+		So(NegotiateCompressors([]string{"zstd", "zlib", "snappy"}), ShouldResemble,
+			[]string{"zlib", "snappy"})
+		So(NegotiateCompressors([]string{"zstd"}), ShouldResemble, []string{})
+	})
+}
+
+func TestDecodeOpCompressed(t *testing.T) {
+	Convey("Decode a wire protocol OP_COMPRESSED message", t, func() {
+		body := bson.D{{Key: "find", Value: "foo"}, {Key: "filter", Value: bson.D{}}, {Key: "$db", Value: "db"}}
+		original := createMockMsg(int32(7), int32(0), body, nil)
+
+		for _, name := range []string{"noop", "snappy", "zlib"} {
+			compressor, ok := CompressorID(name)
+			So(ok, ShouldEqual, true)
+
+			Convey("that was compressed with "+name, func() {
+				input, err := CompressMessage(original, compressor)
+				So(err, ShouldBeNil)
+				So(convert.ConvertToInt32LE(input[12:16]), ShouldEqual, OP_COMPRESSED)
+
+				m := mock.MockIO{
+					Input:  input,
+					Output: make([]byte, 0)}
+				m.Reset()
+
+				request, header, info, err := DecodeWithInfo(&m)
+				So(err, ShouldBeNil)
+				So(header.OpCode, ShouldEqual, OP_MSG)
+				So(header.RequestID, ShouldEqual, 7)
+				So(header.MessageLength, ShouldEqual, len(original))
+				So(info.Compressed, ShouldEqual, true)
+				So(info.Compressor, ShouldEqual, compressor)
+
+				f, err := ToFindRequest(request)
+				So(err, ShouldBeNil)
+				So(f.Collection, ShouldEqual, "foo")
+			})
+		}
+
+		Convey("that uses an unknown compressor", func() {
+			input, err := CompressMessage(original, CompressorNoop)
+			So(err, ShouldBeNil)
+			input[24] = 9
+
+			m := mock.MockIO{
+				Input:  input,
+				Output: make([]byte, 0)}
+			m.Reset()
+
+			request, _, err := Decode(&m)
+			So(err, ShouldNotBeNil)
+			So(request, ShouldBeNil)
+		})
+	})
+}
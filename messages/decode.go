@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"strings"
 
@@ -50,7 +51,7 @@ func ParseNamespace(namespace string) (string, string, error) {
 	return database, collection, nil
 }
 
-func createCommand(header MsgHeader, commandName string, database string, args bson.M) Command {
+func createCommand(header MsgHeader, commandName string, database string, args bson.D) Command {
 	c := Command{
 		RequestID:   header.RequestID,
 		CommandName: commandName,
@@ -60,7 +61,35 @@ func createCommand(header MsgHeader, commandName string, database string, args b
 	return c
 }
 
-func createFind(header MsgHeader, database string, args bson.M) (Find, error) {
+// createCommandRequester creates the Requester for a command document sent to a
+// database, using one of the specialized structs if there is one for the command.
+func createCommandRequester(header MsgHeader, database string, body bson.D) (Requester, error) {
+	commandName, args := splitCommandOpQuery(body)
+	switch commandName {
+	case "insert":
+		return createInsert(header, database, args, body)
+	case "update":
+		return createUpdate(header, database, args, body)
+	case "delete":
+		return createDelete(header, database, args, body)
+	case "killCursors":
+		return createKillCursors(header, database, args)
+	case "aggregate":
+		return createAggregate(header, database, args, body)
+	case "count":
+		return createCount(header, database, args, body)
+	case "distinct":
+		return createDistinct(header, database, args, body)
+	case "findAndModify", "findandmodify":
+		return createFindAndModify(header, commandName, database, args, body)
+	case "createIndexes":
+		return createCreateIndexes(header, database, args, body)
+	default:
+		return createCommand(header, commandName, database, body), nil
+	}
+}
+
+func createFind(header MsgHeader, database string, args bson.M, body bson.D) (Find, error) {
 
 	c := args["find"]
 	collection, ok := c.(string)
@@ -74,20 +103,42 @@ func createFind(header MsgHeader, database string, args bson.M) (Find, error) {
 		Database:        database,
 		Collection:      collection,
 		Filter:          convert.ToBSONDoc(args["filter"]),
+		Sort:            convert.ToBSONDoc(args["sort"]),
 		Projection:      convert.ToBSONDoc(args["projection"]),
 		Skip:            convert.ToInt32(args["skip"]),
 		Limit:           convert.ToInt32(args["limit"]),
+		BatchSize:       convert.ToInt32(args["batchSize"]),
+		SingleBatch:     convert.ToBool(args["singleBatch"]),
 		Tailable:        convert.ToBool(args["tailable"]),
 		OplogReplay:     convert.ToBool(args["oplogReplay"]),
 		NoCursorTimeout: convert.ToBool(args["noCursorTimeout"]),
 		AwaitData:       convert.ToBool(args["awaitData"]),
-		Partial:         convert.ToBool(args["partial"]),
+		Partial:         convert.ToBool(args["allowPartialResults"]),
+		Hint:            args["hint"],
+		MaxTimeMS:       convert.ToInt64(args["maxTimeMS"]),
+		Comment:         args["comment"],
+		Min:             convert.ToBSONDoc(args["min"]),
+		Max:             convert.ToBSONDoc(args["max"]),
+		ReturnKey:       convert.ToBool(args["returnKey"]),
+		ShowRecordID:    convert.ToBool(args["showRecordId"]),
+		AllowDiskUse:    convert.ToBool(args["allowDiskUse"]),
+		Collation:       convert.ToBSONDoc(args["collation"]),
+		ReadConcern:     optionalBSONMap(args["readConcern"]),
+		Explain:         convert.ToBool(args["explain"]),
+		Exhaust:         convert.ToBool(args["exhaust"]),
+		Extra: extraArgs(body, "find", "filter", "sort", "projection", "skip", "limit",
+			"batchSize", "singleBatch", "tailable", "oplogReplay", "noCursorTimeout",
+			"awaitData", "allowPartialResults", "hint", "maxTimeMS", "comment", "min",
+			"max", "returnKey", "showRecordId", "allowDiskUse", "collation", "readConcern"),
 	}
 
 	return f, nil
 }
 
-func createInsert(header MsgHeader, database string, args bson.M) (Insert, error) {
+// createInsert creates an Insert from the arguments of an insert command. body
+// is the whole command, whose unmodeled arguments are kept in Extra; it is nil
+// for a legacy OP_INSERT.
+func createInsert(header MsgHeader, database string, args bson.M, body bson.D) (Insert, error) {
 	c := args["insert"]
 	collection, ok := c.(string)
 	if !ok {
@@ -100,11 +151,15 @@ func createInsert(header MsgHeader, database string, args bson.M) (Insert, error
 		return Insert{}, fmt.Errorf("Insert command has no documents.")
 	}
 	insert := Insert{
-		RequestID:  header.RequestID,
-		Database:   database,
-		Collection: collection,
-		Documents:  documents,
-		Ordered:    convert.ToBool(args["ordered"], true),
+		RequestID:                header.RequestID,
+		Database:                 database,
+		Collection:               collection,
+		Documents:                documents,
+		Ordered:                  convert.ToBool(args["ordered"], true),
+		BypassDocumentValidation: convert.ToBool(args["bypassDocumentValidation"]),
+		Comment:                  args["comment"],
+		Extra: extraArgs(body, "insert", "documents", "ordered",
+			"bypassDocumentValidation", "comment", "writeConcern"),
 	}
 
 	writeConcern := convert.ToBSONMap(args["writeConcern"])
@@ -115,7 +170,10 @@ func createInsert(header MsgHeader, database string, args bson.M) (Insert, error
 	return insert, nil
 }
 
-func createDelete(header MsgHeader, database string, args bson.M) (Delete, error) {
+// createDelete creates a Delete from the arguments of a delete command. body
+// is the whole command, whose unmodeled arguments are kept in Extra; it is nil
+// for a legacy OP_DELETE.
+func createDelete(header MsgHeader, database string, args bson.M, body bson.D) (Delete, error) {
 	c := args["delete"]
 	collection, ok := c.(string)
 	if !ok {
@@ -123,21 +181,21 @@ func createDelete(header MsgHeader, database string, args bson.M) (Delete, error
 		return Delete{}, fmt.Errorf("Delete command has no collection.")
 	}
 
-	argsDeletesRaw := args["deletes"]
-	argsDeletes, ok := argsDeletesRaw.([]bson.M)
-	if !ok {
+	statements, err := convert.ConvertToBSONDocSlice(args["deletes"])
+	if err != nil {
 		return Delete{}, fmt.Errorf("Delete command has no deletes.")
 	}
 
-	deletes := make([]SingleDelete, len(argsDeletes))
-	for i := 0; i < len(argsDeletes); i++ {
-		d := argsDeletes[i]
-		singleDelete := SingleDelete{
-			Selector: convert.ToBSONDoc(d["q"]),
-			Limit:    convert.ToInt32(d["limit"]),
+	deletes := make([]SingleDelete, len(statements))
+	for i, statement := range statements {
+		d := statement.Map()
+		deletes[i] = SingleDelete{
+			Selector:  convert.ToBSONDoc(d["q"]),
+			Limit:     convert.ToInt32(d["limit"]),
+			Collation: convert.ToBSONDoc(d["collation"]),
+			Hint:      d["hint"],
+			Extra:     extraArgs(statement, "q", "limit", "collation", "hint"),
 		}
-
-		deletes[i] = singleDelete
 	}
 
 	delObj := Delete{
@@ -146,6 +204,8 @@ func createDelete(header MsgHeader, database string, args bson.M) (Delete, error
 		Collection: collection,
 		Deletes:    deletes,
 		Ordered:    convert.ToBool(args["ordered"], true),
+		Comment:    args["comment"],
+		Extra:      extraArgs(body, "delete", "deletes", "ordered", "comment", "writeConcern"),
 	}
 
 	writeConcern := convert.ToBSONMap(args["writeConcern"])
@@ -156,7 +216,10 @@ func createDelete(header MsgHeader, database string, args bson.M) (Delete, error
 	return delObj, nil
 }
 
-func createUpdate(header MsgHeader, database string, args bson.M) (Update, error) {
+// createUpdate creates an Update from the arguments of an update command. body
+// is the whole command, whose unmodeled arguments are kept in Extra; it is nil
+// for a legacy OP_UPDATE.
+func createUpdate(header MsgHeader, database string, args bson.M, body bson.D) (Update, error) {
 
 	c := args["update"]
 	collection, ok := c.(string)
@@ -165,31 +228,53 @@ func createUpdate(header MsgHeader, database string, args bson.M) (Update, error
 		return Update{}, fmt.Errorf("Update command has no collection.")
 	}
 
-	argsUpdatesRaw := args["updates"]
-	argsUpdates, ok := argsUpdatesRaw.([]bson.M)
-	if !ok {
+	statements, err := convert.ConvertToBSONDocSlice(args["updates"])
+	if err != nil {
 		return Update{}, fmt.Errorf("Update command has no updates.")
 	}
 
-	updates := make([]SingleUpdate, len(argsUpdates))
-	for i := 0; i < len(argsUpdates); i++ {
-		u := argsUpdates[i]
+	updates := make([]SingleUpdate, len(statements))
+	for i, statement := range statements {
+		u := statement.Map()
 		singleUpdate := SingleUpdate{
-			Selector: convert.ToBSONDoc(u["q"]),
-			Update:   convert.ToBSONDoc(u["u"]),
-			Upsert:   convert.ToBool(u["upsert"]),
-			Multi:    convert.ToBool(u["multi"]),
+			Selector:  convert.ToBSONDoc(u["q"]),
+			Upsert:    convert.ToBool(u["upsert"]),
+			Multi:     convert.ToBool(u["multi"]),
+			Collation: convert.ToBSONDoc(u["collation"]),
+			Hint:      u["hint"],
+			Extra: extraArgs(statement, "q", "u", "upsert", "multi", "arrayFilters",
+				"collation", "hint"),
+		}
+
+		// an update is either a document or an aggregation pipeline
+		if pipeline, err := convert.ConvertToBSONDocSlice(u["u"]); err == nil {
+			singleUpdate.Update = pipeline
+		} else if doc := convert.ToBSONDoc(u["u"]); doc != nil {
+			singleUpdate.Update = doc
+		} else {
+			return Update{}, fmt.Errorf("Update command has an invalid update.")
+		}
+
+		if arrayFilters, ok := u["arrayFilters"]; ok {
+			singleUpdate.ArrayFilters, err = convert.ConvertToBSONDocSlice(arrayFilters)
+			if err != nil {
+				return Update{}, fmt.Errorf("Update command has invalid arrayFilters.")
+			}
 		}
 
 		updates[i] = singleUpdate
 	}
 
 	update := Update{
-		RequestID:  header.RequestID,
-		Database:   database,
-		Collection: collection,
-		Updates:    updates,
-		Ordered:    convert.ToBool(args["ordered"]),
+		RequestID:                header.RequestID,
+		Database:                 database,
+		Collection:               collection,
+		Updates:                  updates,
+		Ordered:                  convert.ToBool(args["ordered"], true),
+		BypassDocumentValidation: convert.ToBool(args["bypassDocumentValidation"]),
+		Comment:                  args["comment"],
+		Extra: extraArgs(body, "update", "updates", "ordered",
+			"bypassDocumentValidation", "comment", "writeConcern"),
 	}
 
 	writeConcern := convert.ToBSONMap(args["writeConcern"])
@@ -214,12 +299,257 @@ func createGetMore(header MsgHeader, database string, args bson.M) (GetMore, err
 		Collection: collection,
 		BatchSize:  convert.ToInt32(args["batchSize"]),
 		CursorID:   convert.ToInt64(args["getMore"]),
+		MaxTimeMS:  convert.ToInt64(args["maxTimeMS"]),
 	}
 
 	return g, nil
 
 }
 
+func createKillCursors(header MsgHeader, database string, args bson.M) (KillCursors, error) {
+
+	c := args["killCursors"]
+	collection, ok := c.(string)
+	if !ok {
+		return KillCursors{}, fmt.Errorf("KillCursors command has no collection.")
+	}
+
+	cursors, err := convert.ConvertToInt64Slice(args["cursors"])
+	if err != nil {
+		return KillCursors{}, fmt.Errorf("KillCursors command has no cursors.")
+	}
+
+	k := KillCursors{
+		RequestID:  header.RequestID,
+		Database:   database,
+		Collection: collection,
+		CursorID:   cursors,
+	}
+
+	return k, nil
+}
+
+// extraArgs returns the arguments of a command body that its struct doesn't
+// model, in the order they were sent, so that converting the struct back to a
+// command keeps them.
+func extraArgs(body bson.D, modeled ...string) bson.D {
+	var extra bson.D
+	for _, e := range body {
+		known := false
+		for _, key := range modeled {
+			if e.Key == key {
+				known = true
+				break
+			}
+		}
+		if !known {
+			extra = append(extra, e)
+		}
+	}
+	return extra
+}
+
+// optionalBSONMap returns a pointer to the document v, or nil if v isn't a document,
+// for optional arguments such as a readConcern or writeConcern.
+func optionalBSONMap(v interface{}) *bson.M {
+	m := convert.ToBSONMap(v)
+	if m == nil {
+		return nil
+	}
+	return &m
+}
+
+func createAggregate(header MsgHeader, database string, args bson.M, body bson.D) (Aggregate, error) {
+
+	// the collection is 1 for an aggregate on the whole database
+	collection, ok := args["aggregate"].(string)
+	if !ok && convert.ToInt(args["aggregate"]) != 1 {
+		return Aggregate{}, fmt.Errorf("Aggregate command has no collection.")
+	}
+
+	pipeline, err := convert.ConvertToBSONDocSlice(args["pipeline"])
+	if err != nil {
+		return Aggregate{}, fmt.Errorf("Aggregate command has no pipeline.")
+	}
+
+	a := Aggregate{
+		RequestID:                header.RequestID,
+		Database:                 database,
+		Collection:               collection,
+		Pipeline:                 pipeline,
+		BatchSize:                convert.ToInt32(convert.ToBSONMap(args["cursor"])["batchSize"]),
+		AllowDiskUse:             convert.ToBool(args["allowDiskUse"]),
+		Explain:                  convert.ToBool(args["explain"]),
+		BypassDocumentValidation: convert.ToBool(args["bypassDocumentValidation"]),
+		Collation:                convert.ToBSONDoc(args["collation"]),
+		Hint:                     args["hint"],
+		MaxTimeMS:                convert.ToInt64(args["maxTimeMS"]),
+		Comment:                  args["comment"],
+		ReadConcern:              optionalBSONMap(args["readConcern"]),
+		WriteConcern:             optionalBSONMap(args["writeConcern"]),
+		Extra: extraArgs(body, "aggregate", "pipeline", "cursor", "allowDiskUse", "explain",
+			"bypassDocumentValidation", "collation", "hint", "maxTimeMS", "comment",
+			"readConcern", "writeConcern"),
+	}
+
+	return a, nil
+}
+
+func createCount(header MsgHeader, database string, args bson.M, body bson.D) (Count, error) {
+
+	collection, ok := args["count"].(string)
+	if !ok {
+		return Count{}, fmt.Errorf("Count command has no collection.")
+	}
+
+	c := Count{
+		RequestID:   header.RequestID,
+		Database:    database,
+		Collection:  collection,
+		Query:       convert.ToBSONDoc(args["query"]),
+		Limit:       convert.ToInt64(args["limit"]),
+		Skip:        convert.ToInt64(args["skip"]),
+		Collation:   convert.ToBSONDoc(args["collation"]),
+		Hint:        args["hint"],
+		MaxTimeMS:   convert.ToInt64(args["maxTimeMS"]),
+		Comment:     args["comment"],
+		ReadConcern: optionalBSONMap(args["readConcern"]),
+		Extra: extraArgs(body, "count", "query", "limit", "skip", "collation", "hint",
+			"maxTimeMS", "comment", "readConcern"),
+	}
+
+	return c, nil
+}
+
+func createDistinct(header MsgHeader, database string, args bson.M, body bson.D) (Distinct, error) {
+
+	collection, ok := args["distinct"].(string)
+	if !ok {
+		return Distinct{}, fmt.Errorf("Distinct command has no collection.")
+	}
+	key, ok := args["key"].(string)
+	if !ok {
+		return Distinct{}, fmt.Errorf("Distinct command has no key.")
+	}
+
+	d := Distinct{
+		RequestID:   header.RequestID,
+		Database:    database,
+		Collection:  collection,
+		Key:         key,
+		Query:       convert.ToBSONDoc(args["query"]),
+		Collation:   convert.ToBSONDoc(args["collation"]),
+		MaxTimeMS:   convert.ToInt64(args["maxTimeMS"]),
+		Comment:     args["comment"],
+		ReadConcern: optionalBSONMap(args["readConcern"]),
+		Extra: extraArgs(body, "distinct", "key", "query", "collation", "maxTimeMS",
+			"comment", "readConcern"),
+	}
+
+	return d, nil
+}
+
+func createFindAndModify(header MsgHeader, commandName string, database string,
+	args bson.M, body bson.D) (FindAndModify, error) {
+
+	collection, ok := args[commandName].(string)
+	if !ok {
+		return FindAndModify{}, fmt.Errorf("FindAndModify command has no collection.")
+	}
+
+	f := FindAndModify{
+		RequestID:                header.RequestID,
+		Database:                 database,
+		Collection:               collection,
+		Query:                    convert.ToBSONDoc(args["query"]),
+		Sort:                     convert.ToBSONDoc(args["sort"]),
+		Remove:                   convert.ToBool(args["remove"]),
+		New:                      convert.ToBool(args["new"]),
+		Fields:                   convert.ToBSONDoc(args["fields"]),
+		Upsert:                   convert.ToBool(args["upsert"]),
+		BypassDocumentValidation: convert.ToBool(args["bypassDocumentValidation"]),
+		Collation:                convert.ToBSONDoc(args["collation"]),
+		Hint:                     args["hint"],
+		MaxTimeMS:                convert.ToInt64(args["maxTimeMS"]),
+		Comment:                  args["comment"],
+		WriteConcern:             optionalBSONMap(args["writeConcern"]),
+		Extra: extraArgs(body, commandName, "query", "sort", "remove", "update", "new",
+			"fields", "upsert", "bypassDocumentValidation", "arrayFilters", "collation",
+			"hint", "maxTimeMS", "comment", "writeConcern"),
+	}
+
+	// an update is either a document or an aggregation pipeline
+	if update, ok := args["update"]; ok {
+		if pipeline, err := convert.ConvertToBSONDocSlice(update); err == nil {
+			f.Update = pipeline
+		} else if doc := convert.ToBSONDoc(update); doc != nil {
+			f.Update = doc
+		} else {
+			return FindAndModify{}, fmt.Errorf("FindAndModify command has an invalid update.")
+		}
+	}
+	if f.Remove == (f.Update != nil) {
+		return FindAndModify{}, fmt.Errorf("FindAndModify command needs either remove or update.")
+	}
+
+	if arrayFilters, ok := args["arrayFilters"]; ok {
+		filters, err := convert.ConvertToBSONDocSlice(arrayFilters)
+		if err != nil {
+			return FindAndModify{}, fmt.Errorf("FindAndModify command has invalid arrayFilters.")
+		}
+		f.ArrayFilters = filters
+	}
+
+	return f, nil
+}
+
+func createCreateIndexes(header MsgHeader, database string, args bson.M, body bson.D) (CreateIndexes, error) {
+
+	collection, ok := args["createIndexes"].(string)
+	if !ok {
+		return CreateIndexes{}, fmt.Errorf("CreateIndexes command has no collection.")
+	}
+
+	specs, err := convert.ConvertToBSONDocSlice(args["indexes"])
+	if err != nil || len(specs) == 0 {
+		return CreateIndexes{}, fmt.Errorf("CreateIndexes command has no indexes.")
+	}
+
+	indexes := make([]Index, len(specs))
+	for i, spec := range specs {
+		index := Index{Options: bson.D{}}
+		for _, e := range spec {
+			switch e.Key {
+			case "key":
+				index.Key = convert.ToBSONDoc(e.Value)
+			case "name":
+				index.Name = convert.ToString(e.Value)
+			default:
+				index.Options = append(index.Options, e)
+			}
+		}
+		if index.Key == nil || index.Name == "" {
+			return CreateIndexes{}, fmt.Errorf("CreateIndexes index %v needs a key and a name.", i)
+		}
+		indexes[i] = index
+	}
+
+	c := CreateIndexes{
+		RequestID:    header.RequestID,
+		Database:     database,
+		Collection:   collection,
+		Indexes:      indexes,
+		CommitQuorum: args["commitQuorum"],
+		MaxTimeMS:    convert.ToInt64(args["maxTimeMS"]),
+		Comment:      args["comment"],
+		WriteConcern: optionalBSONMap(args["writeConcern"]),
+		Extra: extraArgs(body, "createIndexes", "indexes", "commitQuorum", "maxTimeMS",
+			"comment", "writeConcern"),
+	}
+
+	return c, nil
+}
+
 // reads a header from the reader (16 bytes), consistent with wire protocol
 func processHeader(reader io.Reader) (MsgHeader, error) {
 	// read the message header
@@ -248,6 +578,59 @@ func processHeader(reader io.Reader) (MsgHeader, error) {
 	return mHeader, nil
 }
 
+// queryModifiers maps the modifiers of a legacy OP_QUERY to the arguments
+// of the find command they correspond to.
+var queryModifiers = map[string]string{
+	"$orderby":     "sort",
+	"orderby":      "sort",
+	"$hint":        "hint",
+	"$maxTimeMS":   "maxTimeMS",
+	"$comment":     "comment",
+	"$min":         "min",
+	"$max":         "max",
+	"$returnKey":   "returnKey",
+	"$showDiskLoc": "showRecordId",
+	"$explain":     "explain",
+
+	"$readPreference": "readPreference",
+}
+
+// unwrapQueryModifiers takes the query document of a legacy OP_QUERY and returns
+// its filter. If the query has modifiers, such as {$query: {...}, $orderby: {...}},
+// the filter is the $query document, and the modifiers are set as find arguments
+// in args. Modifiers without a find equivalent, like $snapshot, are dropped.
+func unwrapQueryModifiers(q bson.D, args bson.M) bson.D {
+	wrapper := ""
+	for i, e := range q {
+		// a plain "query" key only wraps the filter if it comes first, since
+		// it can also be the name of a field
+		if e.Key == "$query" || (e.Key == "query" && i == 0 && convert.ToBSONDoc(e.Value) != nil) {
+			wrapper = e.Key
+			break
+		}
+	}
+	if wrapper == "" {
+		return q
+	}
+
+	filter := bson.D{}
+	for _, e := range q {
+		switch e.Key {
+		case wrapper:
+			filter = convert.ToBSONDoc(e.Value)
+			if filter == nil {
+				filter = bson.D{}
+			}
+		default:
+			arg, ok := queryModifiers[e.Key]
+			if ok {
+				args[arg] = e.Value
+			}
+		}
+	}
+	return filter
+}
+
 // anything with OpCode 2004 goes here
 func processOpQuery(reader io.Reader, header MsgHeader) (Requester, error) {
 	// flags
@@ -312,57 +695,21 @@ func processOpQuery(reader io.Reader, header MsgHeader) (Requester, error) {
 	// figure out what kind of struct to actually produce
 	switch collection {
 	case "$cmd":
-		cName, args := splitCommandOpQuery(q)
-		var c Requester
-		switch cName {
-		case "insert":
-			// convert documents to an array of bson.D so that the struct
-			// knows what to do with them.
-			i, err := convert.ConvertToBSONDocSlice(args["documents"])
-
-			if err != nil {
-				i = make([]bson.D, 0)
-			}
-
-			args["documents"] = i
-
-			c, err = createInsert(header, database, args)
-			if err != nil {
-				return nil, err
-			}
-		case "update":
-			// convert updates to an array of bson.M so that the struct
-			// knows what to do with them.
-			u, err := convert.ConvertToBSONMapSlice(args["updates"])
-
-			if err != nil {
-				u = make([]bson.M, 0)
-			}
-
-			args["updates"] = u
-
-			c, err = createUpdate(header, database, args)
-			if err != nil {
-				return nil, err
-			}
-		case "delete":
-
-			d, err := convert.ConvertToBSONMapSlice(args["deletes"])
-			if err != nil {
-				d = make([]bson.M, 0)
-			}
-
-			args["deletes"] = d
-
-			c, err = createDelete(header, database, args)
-			if err != nil {
-				return nil, err
-			}
-		default:
-			c = createCommand(header, cName, database, args)
+		// a command sent with a read preference is wrapped like a query with
+		// modifiers, as {$query: {...}, $readPreference: {...}}
+		modifiers := bson.M{}
+		if len(q) > 0 && q[0].Key == "$query" {
+			q = unwrapQueryModifiers(q, modifiers)
 		}
-
-		return c, nil
+		if len(q) == 0 {
+			return nil, fmt.Errorf("OP_QUERY command has no command name")
+		}
+		r, err := createCommandRequester(header, database, q)
+		if err != nil {
+			return nil, err
+		}
+		return withReadPreference(r,
+			legacyReadPreference(flags, modifiers["readPreference"])), nil
 	default:
 		// find command
 		args := bson.M{}
@@ -375,19 +722,32 @@ func processOpQuery(reader io.Reader, header MsgHeader) (Requester, error) {
 		args["oplogReplay"] = convert.ReadBit32LE(flags, 3)
 		args["noCursorTimeout"] = convert.ReadBit32LE(flags, 4)
 		args["awaitData"] = convert.ReadBit32LE(flags, 5)
-		args["partial"] = convert.ReadBit32LE(flags, 7)
+		args["exhaust"] = convert.ReadBit32LE(flags, 6)
+		args["allowPartialResults"] = convert.ReadBit32LE(flags, 7)
 
 		args["skip"] = skip
-		args["limit"] = limit
 
-		// the actual query
-		args["filter"] = q
+		// numberToReturn is a batch size, unless it is negative (or 1), in which
+		// case it is a limit on a single batch.
+		if limit < 0 || limit == 1 {
+			if limit < 0 {
+				limit = -limit
+			}
+			args["limit"] = limit
+			args["singleBatch"] = true
+		} else {
+			args["batchSize"] = limit
+		}
+
+		// the actual query, which may be wrapped with query modifiers
+		args["filter"] = unwrapQueryModifiers(q, args)
 		args["projection"] = projection
 
-		f, err := createFind(header, database, args)
+		f, err := createFind(header, database, args, nil)
 		if err != nil {
 			return nil, err
 		}
+		f.ReadPreference = legacyReadPreference(flags, args["readPreference"])
 		return f, nil
 	}
 
@@ -434,17 +794,16 @@ func processOpUpdate(reader io.Reader, header MsgHeader) (Requester, error) {
 
 	// create a proper update command
 	args := bson.M{}
-	updateObj := bson.M{}
-	updateObj["q"] = selector
-	updateObj["u"] = updator
-	updateObj["upsert"] = convert.ReadBit32LE(flags, 0)
-	updateObj["multi"] = convert.ReadBit32LE(flags, 1)
+	updateObj := bson.D{
+		{Key: "q", Value: selector},
+		{Key: "u", Value: updator},
+		{Key: "upsert", Value: convert.ReadBit32LE(flags, 0)},
+		{Key: "multi", Value: convert.ReadBit32LE(flags, 1)},
+	}
 	args["update"] = collection
-	updates := make([]bson.M, 0)
-	updates = append(updates, updateObj)
-	args["updates"] = updates
+	args["updates"] = []bson.D{updateObj}
 
-	return createUpdate(header, database, args)
+	return createUpdate(header, database, args, nil)
 }
 
 // OpCode 2002
@@ -490,7 +849,7 @@ func processOpInsert(reader io.Reader, header MsgHeader) (Requester, error) {
 	args["ordered"] = !convert.ReadBit32LE(flags, 0)
 	args["documents"] = docs
 
-	return createInsert(header, database, args)
+	return createInsert(header, database, args, nil)
 
 }
 
@@ -570,20 +929,382 @@ func processOpDelete(reader io.Reader, header MsgHeader) (Requester, error) {
 
 	args := bson.M{}
 	args["delete"] = collection
-	deletes := make([]bson.M, 1)
-	delObj := bson.M{}
-	delObj["q"] = selector
+	delObj := bson.D{{Key: "q", Value: selector}}
 
 	if convert.ReadBit32LE(flags, 0) {
-		delObj["limit"] = 1
+		delObj = append(delObj, bson.E{Key: "limit", Value: 1})
 	} else {
-		delObj["limit"] = 0
+		delObj = append(delObj, bson.E{Key: "limit", Value: 0})
+	}
+
+	args["deletes"] = []bson.D{delObj}
+
+	return createDelete(header, database, args, nil)
+}
+
+// OpCode 2007
+func processOpKillCursors(reader io.Reader, header MsgHeader) (Requester, error) {
+	buffer.ReadInt32LE(reader) // the zero (not used in wire protocol)
+
+	numCursors, err := buffer.ReadInt32LE(reader)
+	if err != nil {
+		return nil, fmt.Errorf("error reading number of cursor IDs: %v", err)
+	}
+
+	// sanity check against the message length, so that a bad count can't
+	// make us read past the message.
+	if numCursors < 0 || 16+4+4+8*int64(numCursors) != int64(header.MessageLength) {
+		return nil, fmt.Errorf("invalid number of cursor IDs: %v", numCursors)
+	}
+
+	cursors := make([]int64, numCursors)
+	for i := 0; i < int(numCursors); i++ {
+		cursors[i], err = buffer.ReadInt64LE(reader)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing cursor ID: %v", err)
+		}
+	}
+
+	k := KillCursors{
+		RequestID: header.RequestID,
+		CursorID:  cursors,
+	}
+
+	return k, nil
+}
+
+// fields of an OP_MSG command body that describe the request rather than
+// the command itself. They are moved from the arguments of a generic Command
+// into its Metadata.
+var msgMetadataFields = []string{"$db", "$clusterTime", "$readPreference", "lsid",
+	"txnNumber", "autocommit", "startTransaction"}
+
+func isMsgMetadataField(key string) bool {
+	for _, field := range msgMetadataFields {
+		if key == field {
+			return true
+		}
+	}
+	return false
+}
+
+// sessionFromMetadata returns the logical session described by the metadata of
+// an OP_MSG, or nil if it has no lsid.
+func sessionFromMetadata(metadata bson.M) *Session {
+	lsid := convert.ToBSONDoc(metadata["lsid"])
+	if lsid == nil {
+		return nil
+	}
+	autocommit, ok := metadata["autocommit"].(bool)
+	return &Session{
+		LSID:             lsid,
+		TxnNumber:        convert.ToInt64(metadata["txnNumber"]),
+		Transaction:      ok && !autocommit,
+		StartTransaction: convert.ToBool(metadata["startTransaction"]),
+		ReadConcern:      optionalBSONMap(metadata["readConcern"]),
+	}
+}
+
+// withSession sets the logical session of a request.
+func withSession(r Requester, s *Session) Requester {
+	switch t := r.(type) {
+	case Command:
+		t.Session = s
+		return t
+	case Find:
+		t.Session = s
+		return t
+	case GetMore:
+		t.Session = s
+		return t
+	case Insert:
+		t.Session = s
+		return t
+	case Update:
+		t.Session = s
+		return t
+	case Delete:
+		t.Session = s
+		return t
+	case KillCursors:
+		t.Session = s
+		return t
+	case Aggregate:
+		t.Session = s
+		return t
+	case Count:
+		t.Session = s
+		return t
+	case Distinct:
+		t.Session = s
+		return t
+	case FindAndModify:
+		t.Session = s
+		return t
+	case CreateIndexes:
+		t.Session = s
+		return t
+	}
+	return r
+}
+
+// parseReadPreference reads a $readPreference document, returning nil if there
+// is none.
+func parseReadPreference(v interface{}) *ReadPreference {
+	doc := convert.ToBSONMap(v)
+	if doc == nil {
+		return nil
+	}
+	tagSets, err := convert.ConvertToBSONMapSlice(doc["tags"])
+	if err != nil {
+		tagSets = nil
+	}
+	return &ReadPreference{
+		Mode:                convert.ToString(doc["mode"]),
+		TagSets:             tagSets,
+		MaxStalenessSeconds: convert.ToInt64(doc["maxStalenessSeconds"]),
+	}
+}
+
+// legacyReadPreference returns the read preference of an OP_QUERY with the given
+// flags and $readPreference modifier. Without a $readPreference, the slaveOk
+// bit allows any member, preferring secondaries, as it does with mongos.
+func legacyReadPreference(flags int32, modifier interface{}) *ReadPreference {
+	if p := parseReadPreference(modifier); p != nil {
+		return p
+	}
+	if convert.ReadBit32LE(flags, 2) {
+		return &ReadPreference{Mode: "secondaryPreferred"}
+	}
+	return nil
+}
+
+// withReadPreference sets the read preference of a read. Other requests are
+// returned as they are.
+func withReadPreference(r Requester, p *ReadPreference) Requester {
+	switch t := r.(type) {
+	case Command:
+		t.ReadPreference = p
+		return t
+	case Find:
+		t.ReadPreference = p
+		return t
+	case Aggregate:
+		t.ReadPreference = p
+		return t
+	case Count:
+		t.ReadPreference = p
+		return t
+	case Distinct:
+		t.ReadPreference = p
+		return t
+	}
+	return r
+}
+
+// OpCode 2013
+func processOpMsg(reader io.Reader, header MsgHeader) (Msg, error) {
+	// flagBits and the kind byte of at least one section
+	if header.MessageLength < 16+4+1 {
+		return Msg{}, fmt.Errorf("Message length not long enough for OP_MSG")
+	}
+	if header.MessageLength > MaxMessageSizeBytes {
+		return Msg{}, fmt.Errorf("Message length %v exceeds the maximum of %v",
+			header.MessageLength, MaxMessageSizeBytes)
+	}
+
+	// read the rest of the message up front, since the checksum (if any) has
+	// to be verified against the whole of it.
+	body := make([]byte, header.MessageLength-16)
+	_, err := io.ReadFull(reader, body)
+	if err != nil {
+		return Msg{}, fmt.Errorf("error reading message body: %v", err)
+	}
+
+	flags := convert.ConvertToInt32LE(body)
+	sectionsEnd := len(body)
+	if flags&MsgChecksumPresent != 0 {
+		sectionsEnd -= 4
+		if sectionsEnd < 4+1 {
+			return Msg{}, fmt.Errorf("Message length not long enough for checksum")
+		}
+
+		headerBuf := bytes.NewBuffer([]byte{})
+		err = buffer.WriteToBuf(headerBuf, header)
+		if err != nil {
+			return Msg{}, fmt.Errorf("error writing header for checksum: %v", err)
+		}
+		table := crc32.MakeTable(crc32.Castagnoli)
+		checksum := crc32.Update(crc32.Checksum(headerBuf.Bytes(), table), table,
+			body[:sectionsEnd])
+		if checksum != binary.LittleEndian.Uint32(body[sectionsEnd:]) {
+			return Msg{}, fmt.Errorf("OP_MSG checksum mismatch")
+		}
+	}
+
+	msg := Msg{
+		Flag:     flags,
+		Sections: make([]Section, 0),
+	}
+
+	sectionReader := bytes.NewReader(body[4:sectionsEnd])
+	for sectionReader.Len() > 0 {
+		kind, err := sectionReader.ReadByte()
+		if err != nil {
+			return Msg{}, fmt.Errorf("error reading section kind: %v", err)
+		}
+
+		switch kind {
+		case 0:
+			_, doc, err := buffer.ReadDocument(sectionReader)
+			if err != nil {
+				return Msg{}, fmt.Errorf("error reading body section: %v", err)
+			}
+			msg.Sections = append(msg.Sections, Section{
+				Kind:    0,
+				Content: []bson.D{doc},
+			})
+		case 1:
+			size, err := buffer.ReadInt32LE(sectionReader)
+			if err != nil {
+				return Msg{}, fmt.Errorf("error reading section size: %v", err)
+			}
+			if size < 4 || int(size-4) > sectionReader.Len() {
+				return Msg{}, fmt.Errorf("invalid document sequence size: %v", size)
+			}
+			n, identifier, err := buffer.ReadNullTerminatedString(sectionReader, size-4)
+			if err != nil {
+				return Msg{}, fmt.Errorf("error reading sequence identifier: %v", err)
+			}
+
+			docs := make([]bson.D, 0)
+			remaining := size - 4 - n
+			for remaining > 0 {
+				docSize, doc, err := buffer.ReadDocument(sectionReader)
+				if err != nil {
+					return Msg{}, fmt.Errorf("error reading document sequence: %v", err)
+				}
+				docs = append(docs, doc)
+				remaining -= docSize
+			}
+			if remaining != 0 {
+				return Msg{}, fmt.Errorf("document sequence overran its section")
+			}
+
+			msg.Sections = append(msg.Sections, Section{
+				Kind:       1,
+				Content:    docs,
+				Identifier: identifier,
+			})
+		default:
+			return Msg{}, fmt.Errorf("unknown OP_MSG section kind: %v", kind)
+		}
+	}
+
+	return msg, nil
+}
+
+// createMsgRequester converts a decoded OP_MSG into the Requester for the command
+// in its body, folding any document sequences into the command arguments.
+func createMsgRequester(header MsgHeader, msg Msg) (Requester, error) {
+	var body bson.D
+	bodyCount := 0
+	for _, section := range msg.Sections {
+		if section.Kind == 0 {
+			body = section.Content[0]
+			bodyCount++
+		}
+	}
+	if bodyCount != 1 {
+		return nil, fmt.Errorf("OP_MSG must have exactly one body section, had %v", bodyCount)
+	}
+	if len(body) == 0 {
+		return nil, fmt.Errorf("OP_MSG body has no command")
+	}
+
+	// document sequences become arguments after the ones in the body, and
+	// metadata is taken out of the command, keeping the order of the rest.
+	command := make(bson.D, 0, len(body))
+	metadata := bson.M{}
+	for _, e := range body {
+		if isMsgMetadataField(e.Key) {
+			metadata[e.Key] = e.Value
+		} else {
+			command = append(command, e)
+		}
+	}
+	for _, section := range msg.Sections {
+		if section.Kind == 1 {
+			command = append(command, bson.E{Key: section.Identifier, Value: section.Content})
+		}
+	}
+
+	// the read concern of a transaction comes with its first command, and
+	// applies to the whole transaction
+	if convert.ToBool(metadata["startTransaction"]) {
+		for i, e := range command {
+			if e.Key == "readConcern" {
+				metadata["readConcern"] = e.Value
+				command = append(command[:i], command[i+1:]...)
+				break
+			}
+		}
+	}
+
+	database := convert.ToString(metadata["$db"])
+	if len(database) == 0 {
+		return nil, fmt.Errorf("OP_MSG body has no $db")
+	}
+	if len(command) == 0 {
+		return nil, fmt.Errorf("OP_MSG body has no command")
+	}
+
+	var r Requester
+	var err error
+	cName, args := splitCommandOpQuery(command)
+	switch cName {
+	case "find":
+		r, err = createFind(header, database, args, command)
+	case "getMore":
+		r, err = createGetMore(header, database, args)
+	default:
+		r, err = createCommandRequester(header, database, command)
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	deletes[0] = delObj
-	args["deletes"] = deletes
+	r = withSession(r, sessionFromMetadata(metadata))
+	r = withReadPreference(r, parseReadPreference(metadata["$readPreference"]))
+	if c, ok := r.(Command); ok {
+		c.Metadata = metadata
+		return c, nil
+	}
+	return r, nil
+}
+
+// DecodeMsgReply reads a server's OP_MSG reply to a request, and returns its
+// header and its body.
+func DecodeMsgReply(reader io.Reader) (MsgHeader, bson.D, error) {
+	header, err := processHeader(reader)
+	if err != nil {
+		return MsgHeader{}, nil, err
+	}
+	if header.OpCode != OP_MSG {
+		return MsgHeader{}, nil, fmt.Errorf("expected an OP_MSG reply, got opcode %v",
+			header.OpCode)
+	}
 
-	return createDelete(header, database, args)
+	msg, err := processOpMsg(reader, header)
+	if err != nil {
+		return MsgHeader{}, nil, err
+	}
+	for _, section := range msg.Sections {
+		if section.Kind == 0 {
+			return header, section.Content[0], nil
+		}
+	}
+	return MsgHeader{}, nil, fmt.Errorf("OP_MSG reply has no body section")
 }
 
 // Decodes a wire protocol message from a connection into a Requester to pass
@@ -591,44 +1312,72 @@ func processOpDelete(reader io.Reader, header MsgHeader) (Requester, error) {
 // It returns a non-nil error if reading from the connection
 // fails in any way
 func Decode(reader io.Reader) (Requester, MsgHeader, error) {
+	r, mHeader, _, err := DecodeWithInfo(reader)
+	return r, mHeader, err
+}
+
+// DecodeWithInfo decodes a wire protocol message like Decode, and also returns
+// a MsgInfo describing how the message was framed, such as its OP_MSG flags.
+func DecodeWithInfo(reader io.Reader) (Requester, MsgHeader, MsgInfo, error) {
 	mHeader, err := processHeader(reader)
 
 	if err != nil {
-		return nil, MsgHeader{}, err
+		return nil, MsgHeader{}, MsgInfo{}, err
+	}
+
+	if mHeader.OpCode == OP_COMPRESSED {
+		// decode the original message, and reply to it as if it was sent
+		// uncompressed.
+		originalHeader, data, compressor, err := processOpCompressed(reader, mHeader)
+		if err != nil {
+			return nil, MsgHeader{}, MsgInfo{}, err
+		}
+		r, info, err := decodeBody(bytes.NewReader(data), originalHeader)
+		if err != nil {
+			return nil, MsgHeader{}, MsgInfo{}, err
+		}
+		info.Compressed = true
+		info.Compressor = compressor
+		return r, originalHeader, info, nil
+	}
+
+	r, info, err := decodeBody(reader, mHeader)
+	if err != nil {
+		return nil, MsgHeader{}, MsgInfo{}, err
 	}
+	return r, mHeader, info, nil
+}
+
+// decodeBody decodes the remainder of a message with header mHeader into a Requester.
+func decodeBody(reader io.Reader, mHeader MsgHeader) (Requester, MsgInfo, error) {
 
 	switch mHeader.OpCode {
 	case OP_UPDATE:
 		opu, err := processOpUpdate(reader, mHeader)
-		if err != nil {
-			return nil, MsgHeader{}, err
-		}
-		return opu, mHeader, nil
+		return opu, MsgInfo{}, err
 	case OP_INSERT:
 		opi, err := processOpInsert(reader, mHeader)
-		if err != nil {
-			return nil, MsgHeader{}, err
-		}
-		return opi, mHeader, nil
+		return opi, MsgInfo{}, err
 	case OP_QUERY:
 		opq, err := processOpQuery(reader, mHeader)
-		if err != nil {
-			return nil, MsgHeader{}, err
-		}
-		return opq, mHeader, nil
+		return opq, MsgInfo{}, err
 	case OP_GET_MORE:
 		opg, err := processOpGetMore(reader, mHeader)
-		if err != nil {
-			return nil, MsgHeader{}, err
-		}
-		return opg, mHeader, nil
+		return opg, MsgInfo{}, err
 	case OP_DELETE:
 		opd, err := processOpDelete(reader, mHeader)
+		return opd, MsgInfo{}, err
+	case OP_KILL_CURSORS:
+		opk, err := processOpKillCursors(reader, mHeader)
+		return opk, MsgInfo{}, err
+	case OP_MSG:
+		msg, err := processOpMsg(reader, mHeader)
 		if err != nil {
-			return nil, MsgHeader{}, err
+			return nil, MsgInfo{}, err
 		}
-		return opd, mHeader, nil
+		opm, err := createMsgRequester(mHeader, msg)
+		return opm, MsgInfo{Flags: msg.Flag}, err
 	default:
-		return nil, MsgHeader{}, fmt.Errorf("unimplemented operation: %#v", mHeader)
+		return nil, MsgInfo{}, fmt.Errorf("unimplemented operation: %#v", mHeader)
 	}
 }
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 
 	log "github.com/sirupsen/logrus"
 
@@ -14,6 +15,7 @@ import (
 	"github.com/WyattNielsen/mongoproxy/mock"
 	. "github.com/smartystreets/goconvey/convey"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 var mockQuery = bson.D{{"hello", 1}}
@@ -208,6 +210,74 @@ func createMockGetMore(id int32, namespace string, numToReturn int32, cursorID i
 	return input
 }
 
+func createMockKillCursors(id int32, cursorIDs []int64) []byte {
+	responseTo := int32(0)
+	opCode := int32(2007)
+
+	buf := new(bytes.Buffer)
+
+	buffer.WriteToBuf(buf, int32(0), id, responseTo, opCode, int32(0),
+		int32(len(cursorIDs)), cursorIDs)
+
+	input := buf.Bytes()
+	respSize := make([]byte, 4)
+	binary.LittleEndian.PutUint32(respSize, uint32(len(input)))
+	input[0] = respSize[0]
+	input[1] = respSize[1]
+	input[2] = respSize[2]
+	input[3] = respSize[3]
+
+	return input
+}
+
+// creates an OP_MSG with the given body and document sequences, keyed by their
+// identifiers. A checksum is appended if the flags call for one.
+func createMockMsg(id int32, flags int32, body interface{}, sequences map[string][]interface{}) []byte {
+	responseTo := int32(0)
+	opCode := int32(2013)
+
+	bodyBytes, err := bson.Marshal(body)
+	if err != nil {
+		fmt.Println("Error encoding BSON")
+	}
+
+	buf := new(bytes.Buffer)
+
+	buffer.WriteToBuf(buf, int32(0), id, responseTo, opCode, flags, uint8(0), bodyBytes)
+
+	for identifier, docs := range sequences {
+		docBytes := make([]byte, 0)
+		for i := 0; i < len(docs); i++ {
+			d, err := bson.Marshal(docs[i])
+			if err != nil {
+				fmt.Println("Error encoding BSON")
+			}
+			docBytes = append(docBytes, d...)
+		}
+		size := int32(4 + len(identifier) + 1 + len(docBytes))
+		buffer.WriteToBuf(buf, uint8(1), size, append([]byte(identifier), byte('\x00')), docBytes)
+	}
+
+	if flags&MsgChecksumPresent != 0 {
+		buffer.WriteToBuf(buf, uint32(0))
+	}
+
+	input := buf.Bytes()
+	respSize := make([]byte, 4)
+	binary.LittleEndian.PutUint32(respSize, uint32(len(input)))
+	input[0] = respSize[0]
+	input[1] = respSize[1]
+	input[2] = respSize[2]
+	input[3] = respSize[3]
+
+	if flags&MsgChecksumPresent != 0 {
+		checksum := crc32.Checksum(input[:len(input)-4], crc32.MakeTable(crc32.Castagnoli))
+		binary.LittleEndian.PutUint32(input[len(input)-4:], checksum)
+	}
+
+	return input
+}
+
 func TestProcessHeader(t *testing.T) {
 	Convey("Decode a header", t, func() {
 		Convey("which reads 0 bytes", func() {
@@ -240,7 +310,7 @@ func TestProcessHeader(t *testing.T) {
 
 func TestCreateFind(t *testing.T) {
 	Convey("Process invalid find", t, func() {
-		_, err := createFind(MsgHeader{}, "test", bson.M{})
+		_, err := createFind(MsgHeader{}, "test", bson.M{}, nil)
 		So(err, ShouldNotBeNil)
 	})
 }
@@ -291,7 +361,104 @@ func TestDecodeOpQuery(t *testing.T) {
 				So(opq.NoCursorTimeout, ShouldEqual, true)
 
 			})
+
+			Convey("that sets numberToReturn", func() {
+				input := createMockQuery(int32(0), int32(0), "db.foo", int32(0), int32(20), mockQuery)
+				m := mock.MockIO{
+					Input:  input,
+					Output: make([]byte, 0)}
+				m.Reset()
+
+				request, _, err := Decode(&m)
+				So(err, ShouldBeNil)
+
+				opq, err := ToFindRequest(request)
+				So(err, ShouldBeNil)
+				So(opq.BatchSize, ShouldEqual, 20)
+				So(opq.Limit, ShouldEqual, 0)
+				So(opq.SingleBatch, ShouldEqual, false)
+
+				input = createMockQuery(int32(0), int32(0), "db.foo", int32(0), int32(-5), mockQuery)
+				m = mock.MockIO{
+					Input:  input,
+					Output: make([]byte, 0)}
+				m.Reset()
+
+				request, _, err = Decode(&m)
+				So(err, ShouldBeNil)
+
+				opq, err = ToFindRequest(request)
+				So(err, ShouldBeNil)
+				So(opq.BatchSize, ShouldEqual, 0)
+				So(opq.Limit, ShouldEqual, 5)
+				So(opq.SingleBatch, ShouldEqual, true)
+			})
 		})
+		Convey("that is a find wrapped in query modifiers", func() {
+			query := bson.D{{Key: "$query", Value: bson.D{{Key: "a", Value: int32(1)}}},
+				{Key: "$orderby", Value: bson.D{{Key: "b", Value: int32(-1)}, {Key: "a", Value: int32(1)}}},
+				{Key: "$hint", Value: "a_1"}, {Key: "$maxTimeMS", Value: int32(500)}, {Key: "$comment", Value: "legacy"},
+				{Key: "$min", Value: bson.D{{Key: "a", Value: int32(0)}}}, {Key: "$max", Value: bson.D{{Key: "a", Value: int32(9)}}},
+				{Key: "$returnKey", Value: true}, {Key: "$showDiskLoc", Value: true}, {Key: "$snapshot", Value: true}}
+			input := createMockQuery(int32(0), int32(0), "db.foo", int32(0), int32(0), query)
+			m := mock.MockIO{
+				Input:  input,
+				Output: make([]byte, 0)}
+			m.Reset()
+
+			request, _, err := Decode(&m)
+			So(err, ShouldBeNil)
+
+			opq, err := ToFindRequest(request)
+			So(err, ShouldBeNil)
+			So(opq.Filter, ShouldResemble, bson.D{{Key: "a", Value: int32(1)}})
+			So(opq.Sort, ShouldResemble, bson.D{{Key: "b", Value: int32(-1)}, {Key: "a", Value: int32(1)}})
+			So(opq.Hint, ShouldEqual, "a_1")
+			So(opq.MaxTimeMS, ShouldEqual, 500)
+			So(opq.Comment, ShouldEqual, "legacy")
+			So(opq.Min, ShouldResemble, bson.D{{Key: "a", Value: int32(0)}})
+			So(opq.Max, ShouldResemble, bson.D{{Key: "a", Value: int32(9)}})
+			So(opq.ReturnKey, ShouldEqual, true)
+			So(opq.ShowRecordID, ShouldEqual, true)
+			So(opq.Explain, ShouldEqual, false)
+
+			Convey("with $explain and a plain query key", func() {
+				query := bson.D{{Key: "query", Value: bson.D{{Key: "a", Value: int32(1)}}}, {Key: "orderby", Value: bson.D{{Key: "b", Value: int32(1)}}},
+					{Key: "$explain", Value: true}}
+				input := createMockQuery(int32(0), int32(0), "db.foo", int32(0), int32(0), query)
+				m := mock.MockIO{
+					Input:  input,
+					Output: make([]byte, 0)}
+				m.Reset()
+
+				request, _, err := Decode(&m)
+				So(err, ShouldBeNil)
+
+				opq, err := ToFindRequest(request)
+				So(err, ShouldBeNil)
+				So(opq.Filter, ShouldResemble, bson.D{{Key: "a", Value: int32(1)}})
+				So(opq.Sort, ShouldResemble, bson.D{{Key: "b", Value: int32(1)}})
+				So(opq.Explain, ShouldEqual, true)
+			})
+
+			Convey("unless query is just a field", func() {
+				query := bson.D{{Key: "a", Value: int32(1)}, {Key: "query", Value: bson.D{{Key: "b", Value: int32(1)}}}}
+				input := createMockQuery(int32(0), int32(0), "db.foo", int32(0), int32(0), query)
+				m := mock.MockIO{
+					Input:  input,
+					Output: make([]byte, 0)}
+				m.Reset()
+
+				request, _, err := Decode(&m)
+				So(err, ShouldBeNil)
+
+				opq, err := ToFindRequest(request)
+				So(err, ShouldBeNil)
+				So(opq.Filter, ShouldResemble, query)
+				So(opq.Sort, ShouldBeNil)
+			})
+		})
+
 		Convey("that is an invalid find command", func() {
 			Convey("because it has no length", func() {
 				input := createMockQuery(int32(0), int32(0), "db.foo", int32(0), int32(0), mockQuery)
@@ -581,3 +748,680 @@ func TestDecodeOpGetMore(t *testing.T) {
 		})
 	})
 }
+
+func TestDecodeOpMsg(t *testing.T) {
+	Convey("Decode a wire protocol OP_MSG message", t, func() {
+		Convey("that is a valid find command", func() {
+			body := bson.D{{Key: "find", Value: "foo"}, {Key: "filter", Value: mockQuery},
+				{Key: "sort", Value: bson.D{{Key: "bar", Value: -1}}}, {Key: "limit", Value: int64(5)}, {Key: "$db", Value: "db"}}
+			input := createMockMsg(int32(0), int32(0), body, nil)
+			m := mock.MockIO{
+				Input:  input,
+				Output: make([]byte, 0)}
+			m.Reset()
+
+			request, header, info, err := DecodeWithInfo(&m)
+			So(err, ShouldBeNil)
+			So(header.OpCode, ShouldEqual, OP_MSG)
+			So(info.MoreToCome(), ShouldEqual, false)
+
+			opm, err := ToFindRequest(request)
+			So(err, ShouldBeNil)
+			So(opm.Database, ShouldEqual, "db")
+			So(opm.Collection, ShouldEqual, "foo")
+			So(opm.Sort, ShouldResemble, bson.D{{Key: "bar", Value: int32(-1)}})
+			So(opm.Limit, ShouldEqual, 5)
+		})
+
+		Convey("that is a find with cursor and query options", func() {
+			body := bson.D{{Key: "find", Value: "foo"}, {Key: "filter", Value: bson.D{{Key: "a", Value: int32(1)}}},
+				{Key: "tailable", Value: true}, {Key: "awaitData", Value: true}, {Key: "noCursorTimeout", Value: true},
+				{Key: "allowPartialResults", Value: true}, {Key: "allowDiskUse", Value: true},
+				{Key: "collation", Value: bson.D{{Key: "locale", Value: "fr"}, {Key: "strength", Value: int32(2)}}},
+				{Key: "hint", Value: bson.D{{Key: "a", Value: int32(1)}}}, {Key: "maxTimeMS", Value: int64(100)},
+				{Key: "readConcern", Value: bson.D{{Key: "level", Value: "majority"}}}, {Key: "comment", Value: "export"},
+				{Key: "$db", Value: "db"}}
+
+			request, err := decodeMockMsg(body)
+			So(err, ShouldBeNil)
+
+			opm, err := ToFindRequest(request)
+			So(err, ShouldBeNil)
+			So(opm.Tailable, ShouldEqual, true)
+			So(opm.AwaitData, ShouldEqual, true)
+			So(opm.NoCursorTimeout, ShouldEqual, true)
+			So(opm.Partial, ShouldEqual, true)
+			So(opm.AllowDiskUse, ShouldEqual, true)
+			So(opm.Collation, ShouldResemble, bson.D{{Key: "locale", Value: "fr"}, {Key: "strength", Value: int32(2)}})
+			So(opm.Hint, ShouldResemble, bson.D{{Key: "a", Value: int32(1)}})
+			So(opm.MaxTimeMS, ShouldEqual, 100)
+			So(*opm.ReadConcern, ShouldResemble, bson.M{"level": "majority"})
+			So(opm.Comment, ShouldEqual, "export")
+
+			So(opm.ToBSON(), ShouldResemble, bson.D{{Key: "find", Value: "foo"},
+				{Key: "filter", Value: bson.D{{Key: "a", Value: int32(1)}}}, {Key: "tailable", Value: true},
+				{Key: "noCursorTimeout", Value: true}, {Key: "awaitData", Value: true},
+				{Key: "allowPartialResults", Value: true}, {Key: "allowDiskUse", Value: true},
+				{Key: "collation", Value: opm.Collation}, {Key: "hint", Value: opm.Hint}, {Key: "maxTimeMS", Value: int64(100)},
+				{Key: "comment", Value: "export"}, {Key: "readConcern", Value: bson.M{"level": "majority"}}})
+		})
+
+		Convey("that is a find reading after a cluster time", func() {
+			clusterTime := primitive.Timestamp{T: 1700000000, I: 3}
+			body := bson.D{{Key: "find", Value: "foo"}, {Key: "readConcern", Value: bson.D{
+				{Key: "level", Value: "majority"}, {Key: "afterClusterTime", Value: clusterTime}}},
+				{Key: "$db", Value: "db"}}
+
+			request, err := decodeMockMsg(body)
+			So(err, ShouldBeNil)
+
+			opm, err := ToFindRequest(request)
+			So(err, ShouldBeNil)
+			So(opm.ToBSON(), ShouldResemble, bson.D{{Key: "find", Value: "foo"},
+				{Key: "readConcern", Value: bson.M{"level": "majority", "afterClusterTime": clusterTime}}})
+		})
+
+		Convey("that starts a transaction", func() {
+			lsid := bson.D{{Key: "id", Value: "session"}}
+			body := bson.D{{Key: "find", Value: "foo"}, {Key: "filter", Value: bson.D{}},
+				{Key: "readConcern", Value: bson.D{{Key: "level", Value: "snapshot"}}}, {Key: "lsid", Value: lsid},
+				{Key: "txnNumber", Value: int64(3)}, {Key: "startTransaction", Value: true},
+				{Key: "autocommit", Value: false}, {Key: "$db", Value: "db"}}
+
+			request, err := decodeMockMsg(body)
+			So(err, ShouldBeNil)
+
+			opm, err := ToFindRequest(request)
+			So(err, ShouldBeNil)
+			So(opm.ReadConcern, ShouldBeNil)
+			So(SessionOf(request), ShouldResemble, &Session{
+				LSID:             lsid,
+				TxnNumber:        3,
+				Transaction:      true,
+				StartTransaction: true,
+				ReadConcern:      &bson.M{"level": "snapshot"},
+			})
+		})
+
+		Convey("that commits a transaction", func() {
+			lsid := bson.D{{Key: "id", Value: "session"}}
+			body := bson.D{{Key: "commitTransaction", Value: int32(1)}, {Key: "lsid", Value: lsid},
+				{Key: "txnNumber", Value: int64(3)}, {Key: "autocommit", Value: false}, {Key: "$db", Value: "admin"}}
+
+			request, err := decodeMockMsg(body)
+			So(err, ShouldBeNil)
+
+			opm, err := ToCommandRequest(request)
+			So(err, ShouldBeNil)
+			So(opm.ToBSON(), ShouldResemble, bson.D{{Key: "commitTransaction", Value: int32(1)}})
+			So(opm.Session.TxnNumber, ShouldEqual, 3)
+			So(opm.Session.Transaction, ShouldEqual, true)
+			So(opm.Session.StartTransaction, ShouldEqual, false)
+		})
+
+		Convey("that isn't in a session", func() {
+			request, err := decodeMockMsg(bson.D{{Key: "ping", Value: int32(1)}, {Key: "$db", Value: "admin"}})
+			So(err, ShouldBeNil)
+			So(SessionOf(request), ShouldBeNil)
+		})
+
+		Convey("that is a getMore on an awaitData cursor", func() {
+			body := bson.D{{Key: "getMore", Value: int64(125)}, {Key: "collection", Value: "foo"},
+				{Key: "batchSize", Value: int32(10)}, {Key: "maxTimeMS", Value: int64(2000)}, {Key: "$db", Value: "db"}}
+
+			request, err := decodeMockMsg(body)
+			So(err, ShouldBeNil)
+
+			opm, err := ToGetMoreRequest(request)
+			So(err, ShouldBeNil)
+			So(opm.Database, ShouldEqual, "db")
+			So(opm.Collection, ShouldEqual, "foo")
+			So(opm.CursorID, ShouldEqual, int64(125))
+			So(opm.BatchSize, ShouldEqual, 10)
+			So(opm.MaxTimeMS, ShouldEqual, 2000)
+		})
+
+		Convey("that is an insert with a document sequence", func() {
+			body := bson.D{{Key: "insert", Value: "foo"}, {Key: "ordered", Value: false}, {Key: "$db", Value: "db"}}
+			docs := []interface{}{bson.D{{Key: "a", Value: int32(1)}}, bson.D{{Key: "a", Value: int32(2)}}}
+			input := createMockMsg(int32(0), int32(0), body,
+				map[string][]interface{}{"documents": docs})
+			m := mock.MockIO{
+				Input:  input,
+				Output: make([]byte, 0)}
+			m.Reset()
+
+			request, _, err := Decode(&m)
+			So(err, ShouldBeNil)
+
+			opm, err := ToInsertRequest(request)
+			So(err, ShouldBeNil)
+			So(opm.Database, ShouldEqual, "db")
+			So(opm.Collection, ShouldEqual, "foo")
+			So(opm.Ordered, ShouldEqual, false)
+			So(opm.Documents, ShouldResemble,
+				[]bson.D{{{Key: "a", Value: int32(1)}}, {{Key: "a", Value: int32(2)}}})
+		})
+
+		Convey("that is an update with the updates in the body", func() {
+			body := bson.D{{Key: "update", Value: "foo"},
+				{Key: "updates", Value: bson.A{bson.D{{Key: "q", Value: bson.D{}}, {Key: "u", Value: bson.D{{Key: "a", Value: int32(1)}}}, {Key: "multi", Value: true}}}},
+				{Key: "$db", Value: "db"}}
+			input := createMockMsg(int32(0), int32(0), body, nil)
+			m := mock.MockIO{
+				Input:  input,
+				Output: make([]byte, 0)}
+			m.Reset()
+
+			request, _, err := Decode(&m)
+			So(err, ShouldBeNil)
+
+			opm, err := ToUpdateRequest(request)
+			So(err, ShouldBeNil)
+			So(len(opm.Updates), ShouldEqual, 1)
+			So(opm.Updates[0].Multi, ShouldEqual, true)
+		})
+
+		Convey("that is an update with a pipeline and array filters", func() {
+			pipeline := bson.A{bson.D{{Key: "$set", Value: bson.D{{Key: "b", Value: int32(1)}}}}}
+			filtered := bson.D{{Key: "$inc", Value: bson.D{{Key: "c.$[big]", Value: int32(1)}}}}
+			arrayFilters := bson.A{bson.D{{Key: "big.size", Value: bson.D{{Key: "$gt", Value: int32(10)}}}}}
+			collation := bson.D{{Key: "locale", Value: "fr"}}
+			let := bson.D{{Key: "x", Value: int32(1)}}
+			body := bson.D{{Key: "update", Value: "foo"},
+				{Key: "updates", Value: bson.A{
+					bson.D{{Key: "q", Value: bson.D{}}, {Key: "u", Value: pipeline}},
+					bson.D{{Key: "q", Value: bson.D{{Key: "a", Value: int32(1)}}}, {Key: "u", Value: filtered},
+						{Key: "multi", Value: true}, {Key: "arrayFilters", Value: arrayFilters},
+						{Key: "collation", Value: collation}, {Key: "hint", Value: "a_1"},
+						{Key: "sort", Value: bson.D{{Key: "a", Value: int32(1)}}}},
+				}},
+				{Key: "bypassDocumentValidation", Value: true}, {Key: "comment", Value: "nightly"},
+				{Key: "let", Value: let}, {Key: "$db", Value: "db"}}
+			m := mock.MockIO{
+				Input:  createMockMsg(int32(0), int32(0), body, nil),
+				Output: make([]byte, 0)}
+			m.Reset()
+
+			request, _, err := Decode(&m)
+			So(err, ShouldBeNil)
+
+			opu, err := ToUpdateRequest(request)
+			So(err, ShouldBeNil)
+			So(opu.Ordered, ShouldEqual, true)
+			So(opu.BypassDocumentValidation, ShouldEqual, true)
+			So(opu.Comment, ShouldEqual, "nightly")
+			So(opu.Updates[0].Update, ShouldResemble,
+				[]bson.D{{{Key: "$set", Value: bson.D{{Key: "b", Value: int32(1)}}}}})
+			So(opu.Updates[1].Update, ShouldResemble, filtered)
+			So(opu.Updates[1].ArrayFilters, ShouldResemble,
+				[]bson.D{{{Key: "big.size", Value: bson.D{{Key: "$gt", Value: int32(10)}}}}})
+			So(opu.Updates[1].Collation, ShouldResemble, collation)
+			So(opu.Updates[1].Hint, ShouldEqual, "a_1")
+
+			So(opu.ToBSON(), ShouldResemble, bson.D{{Key: "update", Value: "foo"},
+				{Key: "updates", Value: []bson.D{
+					{{Key: "q", Value: bson.D{}}, {Key: "u", Value: opu.Updates[0].Update},
+						{Key: "upsert", Value: false}, {Key: "multi", Value: false}},
+					{{Key: "q", Value: bson.D{{Key: "a", Value: int32(1)}}}, {Key: "u", Value: filtered},
+						{Key: "upsert", Value: false}, {Key: "multi", Value: true},
+						{Key: "arrayFilters", Value: opu.Updates[1].ArrayFilters},
+						{Key: "collation", Value: collation}, {Key: "hint", Value: "a_1"},
+						{Key: "sort", Value: bson.D{{Key: "a", Value: int32(1)}}}},
+				}},
+				{Key: "ordered", Value: true}, {Key: "bypassDocumentValidation", Value: true},
+				{Key: "comment", Value: "nightly"}, {Key: "let", Value: let}})
+		})
+
+		Convey("that is an update that is neither a document nor a pipeline", func() {
+			body := bson.D{{Key: "update", Value: "foo"},
+				{Key: "updates", Value: bson.A{bson.D{{Key: "q", Value: bson.D{}}, {Key: "u", Value: "b"}}}},
+				{Key: "$db", Value: "db"}}
+			m := mock.MockIO{
+				Input:  createMockMsg(int32(0), int32(0), body, nil),
+				Output: make([]byte, 0)}
+			m.Reset()
+
+			_, _, err := Decode(&m)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("that is a delete with a collation and a hint", func() {
+			collation := bson.D{{Key: "locale", Value: "fr"}}
+			let := bson.D{{Key: "x", Value: int32(1)}}
+			body := bson.D{{Key: "delete", Value: "foo"},
+				{Key: "deletes", Value: bson.A{bson.D{{Key: "q", Value: bson.D{{Key: "a", Value: int32(1)}}},
+					{Key: "limit", Value: int32(1)}, {Key: "collation", Value: collation},
+					{Key: "hint", Value: bson.D{{Key: "a", Value: int32(1)}}}}}},
+				{Key: "comment", Value: "nightly"}, {Key: "let", Value: let}, {Key: "$db", Value: "db"}}
+			m := mock.MockIO{
+				Input:  createMockMsg(int32(0), int32(0), body, nil),
+				Output: make([]byte, 0)}
+			m.Reset()
+
+			request, _, err := Decode(&m)
+			So(err, ShouldBeNil)
+
+			opd, err := ToDeleteRequest(request)
+			So(err, ShouldBeNil)
+			So(opd.Ordered, ShouldEqual, true)
+			So(opd.ToBSON(), ShouldResemble, bson.D{{Key: "delete", Value: "foo"},
+				{Key: "deletes", Value: []bson.D{{{Key: "q", Value: bson.D{{Key: "a", Value: int32(1)}}},
+					{Key: "limit", Value: int32(1)}, {Key: "collation", Value: collation},
+					{Key: "hint", Value: bson.D{{Key: "a", Value: int32(1)}}}}}},
+				{Key: "ordered", Value: true}, {Key: "comment", Value: "nightly"}, {Key: "let", Value: let}})
+		})
+
+		Convey("that is an insert with arguments it doesn't model", func() {
+			let := bson.D{{Key: "x", Value: int32(1)}}
+			body := bson.D{{Key: "insert", Value: "foo"}, {Key: "documents", Value: bson.A{bson.D{}}},
+				{Key: "bypassDocumentValidation", Value: true}, {Key: "let", Value: let},
+				{Key: "$db", Value: "db"}}
+			m := mock.MockIO{
+				Input:  createMockMsg(int32(0), int32(0), body, nil),
+				Output: make([]byte, 0)}
+			m.Reset()
+
+			request, _, err := Decode(&m)
+			So(err, ShouldBeNil)
+
+			opi, err := ToInsertRequest(request)
+			So(err, ShouldBeNil)
+			So(opi.ToBSON(), ShouldResemble, bson.D{{Key: "insert", Value: "foo"},
+				{Key: "documents", Value: []bson.D{{}}}, {Key: "ordered", Value: true},
+				{Key: "bypassDocumentValidation", Value: true}, {Key: "let", Value: let}})
+		})
+
+		Convey("that is a generic command", func() {
+			body := bson.D{{Key: "ping", Value: int32(1)}, {Key: "$db", Value: "admin"}, {Key: "lsid", Value: bson.D{{Key: "id", Value: "abc"}}}}
+			input := createMockMsg(int32(0), MsgChecksumPresent|MsgMoreToCome, body, nil)
+			m := mock.MockIO{
+				Input:  input,
+				Output: make([]byte, 0)}
+			m.Reset()
+
+			request, _, info, err := DecodeWithInfo(&m)
+			So(err, ShouldBeNil)
+			So(info.MoreToCome(), ShouldEqual, true)
+
+			command, err := ToCommandRequest(request)
+			So(err, ShouldBeNil)
+			So(command.CommandName, ShouldEqual, "ping")
+			So(command.Database, ShouldEqual, "admin")
+			So(command.GetArg("$db"), ShouldBeNil)
+			So(command.Metadata["lsid"], ShouldNotBeNil)
+		})
+
+		Convey("that is a generic command, which keeps its arguments in order", func() {
+			body := bson.D{{Key: "collMod", Value: "foo"}, {Key: "validator", Value: bson.D{{Key: "b", Value: int32(1)}}},
+				{Key: "$db", Value: "db"}, {Key: "validationLevel", Value: "strict"}, {Key: "validationAction", Value: "warn"},
+				{Key: "comment", Value: "first"}}
+
+			for i := 0; i < 10; i++ {
+				request, err := decodeMockMsg(body)
+				So(err, ShouldBeNil)
+
+				command, err := ToCommandRequest(request)
+				So(err, ShouldBeNil)
+				So(command.ToBSON(), ShouldResemble, bson.D{{Key: "collMod", Value: "foo"},
+					{Key: "validator", Value: bson.D{{Key: "b", Value: int32(1)}}}, {Key: "validationLevel", Value: "strict"},
+					{Key: "validationAction", Value: "warn"}, {Key: "comment", Value: "first"}})
+				So(command.GetArg("validationLevel"), ShouldEqual, "strict")
+			}
+		})
+
+		Convey("that has a bad checksum", func() {
+			body := bson.D{{Key: "ping", Value: int32(1)}, {Key: "$db", Value: "admin"}}
+			input := createMockMsg(int32(0), MsgChecksumPresent, body, nil)
+			input[len(input)-1] ^= 0xff
+			m := mock.MockIO{
+				Input:  input,
+				Output: make([]byte, 0)}
+			m.Reset()
+
+			request, _, err := Decode(&m)
+			So(err, ShouldNotBeNil)
+			So(request, ShouldBeNil)
+		})
+
+		Convey("that has no $db", func() {
+			input := createMockMsg(int32(0), int32(0), mockCommand, nil)
+			m := mock.MockIO{
+				Input:  input,
+				Output: make([]byte, 0)}
+			m.Reset()
+
+			_, _, err := Decode(&m)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestDecodeKillCursors(t *testing.T) {
+	Convey("Decode a request to kill cursors", t, func() {
+		Convey("that is a valid OP_KILL_CURSORS message", func() {
+			input := createMockKillCursors(int32(0), []int64{125, 300})
+			m := mock.MockIO{
+				Input:  input,
+				Output: make([]byte, 0)}
+			m.Reset()
+
+			request, _, err := Decode(&m)
+			So(err, ShouldBeNil)
+
+			t := request.Type()
+			So(t, ShouldEqual, "killCursors")
+
+			opk, err := ToKillCursorsRequest(request)
+			So(err, ShouldBeNil)
+			So(opk.Database, ShouldEqual, "")
+			So(opk.CursorID, ShouldResemble, []int64{125, 300})
+		})
+
+		Convey("that is an OP_KILL_CURSORS message with a bad count", func() {
+			input := createMockKillCursors(int32(0), []int64{125, 300})
+			binary.LittleEndian.PutUint32(input[20:24], uint32(3))
+			m := mock.MockIO{
+				Input:  input,
+				Output: make([]byte, 0)}
+			m.Reset()
+
+			_, _, err := Decode(&m)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("that is a killCursors command", func() {
+			body := bson.D{{Key: "killCursors", Value: "foo"}, {Key: "cursors", Value: bson.A{int64(125)}}, {Key: "$db", Value: "db"}}
+			input := createMockMsg(int32(0), int32(0), body, nil)
+			m := mock.MockIO{
+				Input:  input,
+				Output: make([]byte, 0)}
+			m.Reset()
+
+			request, _, err := Decode(&m)
+			So(err, ShouldBeNil)
+
+			opk, err := ToKillCursorsRequest(request)
+			So(err, ShouldBeNil)
+			So(opk.Database, ShouldEqual, "db")
+			So(opk.Collection, ShouldEqual, "foo")
+			So(opk.CursorID, ShouldResemble, []int64{125})
+		})
+	})
+}
+
+// decodeMockMsg decodes an OP_MSG with the given body.
+func decodeMockMsg(body bson.D) (Requester, error) {
+	m := mock.MockIO{
+		Input:  createMockMsg(int32(0), int32(0), body, nil),
+		Output: make([]byte, 0)}
+	m.Reset()
+
+	request, _, err := Decode(&m)
+	return request, err
+}
+
+func TestDecodeTypedCommands(t *testing.T) {
+	Convey("Decode commands with their own request structs", t, func() {
+		Convey("that is an aggregate", func() {
+			pipeline := bson.A{bson.D{{Key: "$match", Value: bson.D{{Key: "a", Value: int32(1)}}}},
+				bson.D{{Key: "$sort", Value: bson.D{{Key: "b", Value: int32(1)}, {Key: "a", Value: int32(-1)}}}}}
+			body := bson.D{{Key: "aggregate", Value: "foo"}, {Key: "pipeline", Value: pipeline},
+				{Key: "cursor", Value: bson.D{{Key: "batchSize", Value: int32(10)}}}, {Key: "allowDiskUse", Value: true},
+				{Key: "readConcern", Value: bson.D{{Key: "level", Value: "majority"}}}, {Key: "$db", Value: "db"}}
+
+			request, err := decodeMockMsg(body)
+			So(err, ShouldBeNil)
+
+			opa, err := ToAggregateRequest(request)
+			So(err, ShouldBeNil)
+			So(opa.Database, ShouldEqual, "db")
+			So(opa.Collection, ShouldEqual, "foo")
+			So(opa.Pipeline, ShouldResemble, []bson.D{
+				{{Key: "$match", Value: bson.D{{Key: "a", Value: int32(1)}}}},
+				{{Key: "$sort", Value: bson.D{{Key: "b", Value: int32(1)}, {Key: "a", Value: int32(-1)}}}}})
+			So(opa.BatchSize, ShouldEqual, 10)
+			So(opa.AllowDiskUse, ShouldEqual, true)
+			So(*opa.ReadConcern, ShouldResemble, bson.M{"level": "majority"})
+
+			So(opa.ToBSON(), ShouldResemble, bson.D{{Key: "aggregate", Value: "foo"},
+				{Key: "pipeline", Value: opa.Pipeline}, {Key: "cursor", Value: bson.D{{Key: "batchSize", Value: int32(10)}}},
+				{Key: "allowDiskUse", Value: true}, {Key: "readConcern", Value: bson.M{"level": "majority"}}})
+		})
+
+		Convey("that is an aggregate on a database", func() {
+			body := bson.D{{Key: "aggregate", Value: int32(1)},
+				{Key: "pipeline", Value: bson.A{bson.D{{Key: "$currentOp", Value: bson.D{}}}}}, {Key: "cursor", Value: bson.D{}},
+				{Key: "$db", Value: "admin"}}
+
+			request, err := decodeMockMsg(body)
+			So(err, ShouldBeNil)
+
+			opa, err := ToAggregateRequest(request)
+			So(err, ShouldBeNil)
+			So(opa.Collection, ShouldEqual, "")
+			So(opa.Namespace(), ShouldEqual, "$cmd.aggregate")
+			So(opa.ToBSON()[0], ShouldResemble, bson.E{Key: "aggregate", Value: 1})
+		})
+
+		Convey("that is a change stream resuming from a token", func() {
+			token := bson.D{{Key: "_data", Value: "8263A1B2C3000000012B"}}
+			stage := bson.D{{Key: "$changeStream", Value: bson.D{{Key: "fullDocument", Value: "updateLookup"},
+				{Key: "startAfter", Value: token}}}}
+			body := bson.D{{Key: "aggregate", Value: "foo"}, {Key: "pipeline", Value: bson.A{stage}},
+				{Key: "cursor", Value: bson.D{}}, {Key: "$db", Value: "db"}}
+
+			request, err := decodeMockMsg(body)
+			So(err, ShouldBeNil)
+
+			opa, err := ToAggregateRequest(request)
+			So(err, ShouldBeNil)
+			So(opa.IsChangeStream(), ShouldEqual, true)
+			So(opa.ToBSON(), ShouldResemble, bson.D{{Key: "aggregate", Value: "foo"},
+				{Key: "pipeline", Value: []bson.D{stage}}, {Key: "cursor", Value: bson.D{}}})
+		})
+
+		Convey("that is a count", func() {
+			body := bson.D{{Key: "count", Value: "foo"}, {Key: "query", Value: bson.D{{Key: "a", Value: int32(1)}}},
+				{Key: "limit", Value: int32(5)}, {Key: "$db", Value: "db"}}
+
+			request, err := decodeMockMsg(body)
+			So(err, ShouldBeNil)
+
+			opc, err := ToCountRequest(request)
+			So(err, ShouldBeNil)
+			So(opc.Collection, ShouldEqual, "foo")
+			So(opc.Query, ShouldResemble, bson.D{{Key: "a", Value: int32(1)}})
+			So(opc.Limit, ShouldEqual, 5)
+			So(opc.ToBSON(), ShouldResemble, bson.D{{Key: "count", Value: "foo"},
+				{Key: "query", Value: bson.D{{Key: "a", Value: int32(1)}}}, {Key: "limit", Value: int64(5)}})
+		})
+
+		Convey("that is a distinct", func() {
+			body := bson.D{{Key: "distinct", Value: "foo"}, {Key: "key", Value: "a"}, {Key: "$db", Value: "db"}}
+
+			request, err := decodeMockMsg(body)
+			So(err, ShouldBeNil)
+
+			opd, err := ToDistinctRequest(request)
+			So(err, ShouldBeNil)
+			So(opd.Key, ShouldEqual, "a")
+			So(opd.ToBSON(), ShouldResemble, bson.D{{Key: "distinct", Value: "foo"}, {Key: "key", Value: "a"}})
+
+			_, err = decodeMockMsg(bson.D{{Key: "distinct", Value: "foo"}, {Key: "$db", Value: "db"}})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("that is a findAndModify", func() {
+			body := bson.D{{Key: "findandmodify", Value: "foo"}, {Key: "query", Value: bson.D{{Key: "a", Value: int32(1)}}},
+				{Key: "update", Value: bson.D{{Key: "$inc", Value: bson.D{{Key: "b", Value: int32(1)}}}}}, {Key: "new", Value: true},
+				{Key: "upsert", Value: true}, {Key: "$db", Value: "db"}}
+
+			request, err := decodeMockMsg(body)
+			So(err, ShouldBeNil)
+
+			opf, err := ToFindAndModifyRequest(request)
+			So(err, ShouldBeNil)
+			So(opf.Collection, ShouldEqual, "foo")
+			So(opf.Query, ShouldResemble, bson.D{{Key: "a", Value: int32(1)}})
+			So(opf.Update, ShouldResemble, bson.D{{Key: "$inc", Value: bson.D{{Key: "b", Value: int32(1)}}}})
+			So(opf.New, ShouldEqual, true)
+			So(opf.Upsert, ShouldEqual, true)
+			So(opf.ToBSON(), ShouldResemble, bson.D{{Key: "findAndModify", Value: "foo"},
+				{Key: "query", Value: opf.Query}, {Key: "update", Value: opf.Update}, {Key: "new", Value: true}, {Key: "upsert", Value: true}})
+
+			Convey("with an update pipeline", func() {
+				body := bson.D{{Key: "findAndModify", Value: "foo"},
+					{Key: "update", Value: bson.A{bson.D{{Key: "$set", Value: bson.D{{Key: "b", Value: int32(1)}}}}}}, {Key: "$db", Value: "db"}}
+
+				request, err := decodeMockMsg(body)
+				So(err, ShouldBeNil)
+
+				opf, err := ToFindAndModifyRequest(request)
+				So(err, ShouldBeNil)
+				So(opf.Update, ShouldResemble, []bson.D{{{Key: "$set", Value: bson.D{{Key: "b", Value: int32(1)}}}}})
+			})
+
+			Convey("without an update or remove", func() {
+				_, err := decodeMockMsg(bson.D{{Key: "findAndModify", Value: "foo"}, {Key: "$db", Value: "db"}})
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("that is a createIndexes", func() {
+			index := bson.D{{Key: "key", Value: bson.D{{Key: "b", Value: int32(1)}, {Key: "a", Value: int32(-1)}}}, {Key: "name", Value: "b_1_a_-1"},
+				{Key: "unique", Value: true}}
+			body := bson.D{{Key: "createIndexes", Value: "foo"}, {Key: "indexes", Value: bson.A{index}}, {Key: "$db", Value: "db"}}
+
+			request, err := decodeMockMsg(body)
+			So(err, ShouldBeNil)
+
+			opc, err := ToCreateIndexesRequest(request)
+			So(err, ShouldBeNil)
+			So(opc.Collection, ShouldEqual, "foo")
+			So(opc.Indexes, ShouldResemble, []Index{{
+				Key:     bson.D{{Key: "b", Value: int32(1)}, {Key: "a", Value: int32(-1)}},
+				Name:    "b_1_a_-1",
+				Options: bson.D{{Key: "unique", Value: true}}}})
+			So(opc.ToBSON(), ShouldResemble, bson.D{{Key: "createIndexes", Value: "foo"},
+				{Key: "indexes", Value: []bson.D{index}}})
+
+			_, err = decodeMockMsg(bson.D{{Key: "createIndexes", Value: "foo"},
+				{Key: "indexes", Value: bson.A{bson.D{{Key: "key", Value: bson.D{{Key: "a", Value: int32(1)}}}}}}, {Key: "$db", Value: "db"}})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("keeping the arguments they don't model", func() {
+			let := bson.E{Key: "let", Value: bson.D{{Key: "x", Value: int32(1)}}}
+			other := bson.E{Key: "futureOption", Value: "on"}
+			commands := []bson.D{
+				{{Key: "aggregate", Value: "foo"}, {Key: "pipeline", Value: bson.A{}}, let, {Key: "cursor", Value: bson.D{}}, other},
+				{{Key: "count", Value: "foo"}, let, other},
+				{{Key: "distinct", Value: "foo"}, {Key: "key", Value: "a"}, let, other},
+				{{Key: "findAndModify", Value: "foo"}, {Key: "remove", Value: true}, let, other},
+				{{Key: "createIndexes", Value: "foo"},
+					{Key: "indexes", Value: bson.A{bson.D{{Key: "key", Value: bson.D{{Key: "a", Value: int32(1)}}}, {Key: "name", Value: "a_1"}}}},
+					let, other},
+				{{Key: "find", Value: "foo"}, let, {Key: "filter", Value: bson.D{}}, other},
+			}
+			for _, command := range commands {
+				request, err := decodeMockMsg(append(command, bson.E{Key: "$db", Value: "db"}))
+				So(err, ShouldBeNil)
+
+				b := request.(interface{ ToBSON() bson.D }).ToBSON()
+				So(b[0].Key, ShouldEqual, command[0].Key)
+				So(b[len(b)-2:], ShouldResemble, bson.D{let, other})
+			}
+		})
+	})
+}
+
+func decodeMockQuery(flags int32, namespace string, query bson.D) (Requester, error) {
+	m := mock.MockIO{
+		Input:  createMockQuery(int32(0), flags, namespace, int32(0), int32(0), query),
+		Output: make([]byte, 0)}
+	m.Reset()
+
+	request, _, err := Decode(&m)
+	return request, err
+}
+
+func TestDecodeReadPreference(t *testing.T) {
+	Convey("Decode the read preference of a read", t, func() {
+		Convey("that is an OP_MSG with a $readPreference", func() {
+			readPreference := bson.D{{Key: "mode", Value: "secondary"}, {Key: "maxStalenessSeconds", Value: int32(120)},
+				{Key: "tags", Value: bson.A{bson.D{{Key: "dc", Value: "east"}}, bson.D{}}}}
+			request, err := decodeMockMsg(bson.D{{Key: "find", Value: "foo"}, {Key: "$db", Value: "db"},
+				{Key: "$readPreference", Value: readPreference}})
+			So(err, ShouldBeNil)
+			So(ReadPreferenceOf(request), ShouldResemble, &ReadPreference{
+				Mode:                "secondary",
+				TagSets:             []bson.M{{"dc": "east"}, {}},
+				MaxStalenessSeconds: 120,
+			})
+
+			request, err = decodeMockMsg(bson.D{{Key: "count", Value: "foo"}, {Key: "$db", Value: "db"},
+				{Key: "$readPreference", Value: bson.D{{Key: "mode", Value: "nearest"}}}})
+			So(err, ShouldBeNil)
+			So(ReadPreferenceOf(request).Mode, ShouldEqual, "nearest")
+		})
+
+		Convey("that is an OP_MSG without one", func() {
+			request, err := decodeMockMsg(bson.D{{Key: "find", Value: "foo"}, {Key: "$db", Value: "db"}})
+			So(err, ShouldBeNil)
+			So(ReadPreferenceOf(request), ShouldBeNil)
+		})
+
+		Convey("that is an OP_QUERY with the slaveOk bit", func() {
+			request, err := decodeMockQuery(int32(4), "db.foo", bson.D{{Key: "a", Value: int32(1)}})
+			So(err, ShouldBeNil)
+			So(ReadPreferenceOf(request), ShouldResemble, &ReadPreference{Mode: "secondaryPreferred"})
+
+			request, err = decodeMockQuery(int32(0), "db.foo", bson.D{{Key: "a", Value: int32(1)}})
+			So(err, ShouldBeNil)
+			So(ReadPreferenceOf(request), ShouldBeNil)
+		})
+
+		Convey("that is an OP_QUERY with a $readPreference modifier", func() {
+			query := bson.D{{Key: "$query", Value: bson.D{{Key: "a", Value: int32(1)}}},
+				{Key: "$readPreference", Value: bson.D{{Key: "mode", Value: "primaryPreferred"}}}}
+			request, err := decodeMockQuery(int32(4), "db.foo", query)
+			So(err, ShouldBeNil)
+			f, err := ToFindRequest(request)
+			So(err, ShouldBeNil)
+			So(f.Filter, ShouldResemble, bson.D{{Key: "a", Value: int32(1)}})
+			So(f.ReadPreference.Mode, ShouldEqual, "primaryPreferred")
+		})
+
+		Convey("that is a wrapped OP_QUERY command", func() {
+			query := bson.D{{Key: "$query", Value: bson.D{{Key: "count", Value: "foo"}}},
+				{Key: "$readPreference", Value: bson.D{{Key: "mode", Value: "secondary"}}}}
+			request, err := decodeMockQuery(int32(4), "db.$cmd", query)
+			So(err, ShouldBeNil)
+			c, err := ToCountRequest(request)
+			So(err, ShouldBeNil)
+			So(c.Collection, ShouldEqual, "foo")
+			So(c.ReadPreference.Mode, ShouldEqual, "secondary")
+		})
+	})
+}
+
+func TestSessionFields(t *testing.T) {
+	Convey("Send the session of a command with it", t, func() {
+		lsid := bson.D{{Key: "id", Value: "x"}}
+
+		Convey("outside of a transaction", func() {
+			So((&Session{LSID: lsid}).Fields(), ShouldResemble, bson.D{{Key: "lsid", Value: lsid}})
+			So((&Session{LSID: lsid, TxnNumber: 4}).Fields(), ShouldResemble,
+				bson.D{{Key: "lsid", Value: lsid}, {Key: "txnNumber", Value: int64(4)}})
+		})
+
+		Convey("that starts a transaction", func() {
+			readConcern := bson.M{"level": "snapshot"}
+			s := &Session{LSID: lsid, TxnNumber: 2, Transaction: true, StartTransaction: true,
+				ReadConcern: &readConcern}
+			So(s.Fields(), ShouldResemble, bson.D{{Key: "lsid", Value: lsid}, {Key: "txnNumber", Value: int64(2)},
+				{Key: "autocommit", Value: false}, {Key: "startTransaction", Value: true}, {Key: "readConcern", Value: readConcern}})
+		})
+	})
+}
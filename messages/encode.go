@@ -56,12 +56,70 @@ func setMessageSize(resp []byte) []byte {
 	return resp
 }
 
+// EncodeMsg encodes a BSON object as the body section of an OP_MSG wire protocol
+// message, as a response to the request with header reqHeader.
+// https://docs.mongodb.com/manual/reference/mongodb-wire-protocol/#op_msg
+func EncodeMsg(reqHeader MsgHeader, b interface{}) ([]byte, error) {
+	resHeader := MsgHeader{
+		ResponseTo: reqHeader.RequestID, // requestID from the original request
+		OpCode:     OP_MSG,
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+	err := buffer.WriteToBuf(buf, resHeader,
+		int32(0), // flagBits. None are set on a single reply
+		uint8(0)) // section kind 0, the body
+	if err != nil {
+		return nil, fmt.Errorf("error writing prepared response %v", err)
+	}
+
+	docBytes, err := marshalReplyDocs(b, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling documents")
+	}
+	resp := append(buf.Bytes(), docBytes...)
+
+	resp = setMessageSize(resp)
+
+	return resp, nil
+}
+
+// EncodeMsgRequest encodes a command as the body section of an OP_MSG request
+// with the given request ID, for sending to a server.
+func EncodeMsgRequest(requestID int32, command bson.D) ([]byte, error) {
+	header := MsgHeader{
+		RequestID: requestID,
+		OpCode:    OP_MSG,
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+	err := buffer.WriteToBuf(buf, header,
+		int32(0), // flagBits. The server replies to the request
+		uint8(0)) // section kind 0, the body
+	if err != nil {
+		return nil, fmt.Errorf("error writing request: %v", err)
+	}
+
+	docBytes, err := bson.Marshal(command)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling command: %v", err)
+	}
+	req := append(buf.Bytes(), docBytes...)
+
+	return setMessageSize(req), nil
+}
+
 // EncodeBSON encodes a BSON object in an OP_REPLY wire protocol message
-// as a response to the request with header reqHeader. Not to be used with
+// as a response to the request with header reqHeader. If the request was an
+// OP_MSG, the object is encoded in an OP_MSG instead. Not to be used with
 // find or getMore command responses, as it disregards some flags that are important
 // to those two commands.
 // http://docs.mongodb.org/meta-driver/latest/legacy/mongodb-wire-protocol/
 func EncodeBSON(reqHeader MsgHeader, b bson.M) ([]byte, error) {
+	if reqHeader.OpCode == OP_MSG {
+		return EncodeMsg(reqHeader, b)
+	}
+
 	resHeader := createResponseHeader(reqHeader)
 
 	// we just return 1 object, which is b.
@@ -93,7 +151,8 @@ func EncodeBSON(reqHeader MsgHeader, b bson.M) ([]byte, error) {
 	return resp, nil
 }
 
-// Encodes a response into a byte slice that represents an OP_REPLY wire protocol message.
+// Encodes a response into a byte slice that represents an OP_REPLY wire protocol message,
+// or an OP_MSG if the request was an OP_MSG.
 func Encode(reqHeader MsgHeader, res ModuleResponse) ([]byte, error) {
 
 	log.Debugf("Response: %#v", res)
@@ -104,12 +163,7 @@ func Encode(reqHeader MsgHeader, res ModuleResponse) ([]byte, error) {
 	// error checking
 	if hasError {
 		// reply with an error instead of the actual documents
-		r := bson.M{}
-		r["ok"] = 0
-		r["errmsg"] = res.CommandError.Message
-		r["code"] = res.CommandError.ErrorCode
-
-		return EncodeBSON(reqHeader, r)
+		return EncodeBSON(reqHeader, res.CommandError.toBSON())
 	}
 
 	if res.Writer == nil {
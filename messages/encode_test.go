@@ -7,6 +7,7 @@ import (
 	"testing"
 
 	"github.com/WyattNielsen/mongoproxy/buffer"
+	"github.com/WyattNielsen/mongoproxy/convert"
 	. "github.com/smartystreets/goconvey/convey"
 	"go.mongodb.org/mongo-driver/bson"
 )
@@ -240,3 +241,372 @@ func TestEncodeInsertResponse(t *testing.T) {
 		So(actual, shouldHaveSameContents, expected)
 	})
 }
+
+func TestEncodeMsg(t *testing.T) {
+	Convey("Encode a response to an OP_MSG request", t, func() {
+		reqHeader := MsgHeader{
+			RequestID: int32(5),
+			OpCode:    OP_MSG,
+		}
+
+		decodeReply := func(actual []byte) bson.D {
+			So(convert.ConvertToInt32LE(actual[0:4]), ShouldEqual, len(actual))
+			So(convert.ConvertToInt32LE(actual[8:12]), ShouldEqual, reqHeader.RequestID)
+			So(convert.ConvertToInt32LE(actual[12:16]), ShouldEqual, OP_MSG)
+			So(convert.ConvertToInt32LE(actual[16:20]), ShouldEqual, 0)
+			So(actual[20], ShouldEqual, 0)
+
+			reply := bson.D{}
+			err := bson.Unmarshal(actual[21:], &reply)
+			So(err, ShouldBeNil)
+			return reply
+		}
+
+		Convey("that is a command reply", func() {
+			encode := func(r CommandResponse) bson.M {
+				res := ModuleResponse{}
+				res.Write(r)
+				actual, err := Encode(reqHeader, res)
+				So(err, ShouldBeNil)
+				return decodeReply(actual).Map()
+			}
+
+			Convey("without a document", func() {
+				So(encode(CommandResponse{}), ShouldResemble, bson.M{"ok": int32(1)})
+			})
+
+			Convey("leaving the caller's document as it is", func() {
+				r := bson.M{"foo": "bar"}
+				So(encode(CommandResponse{Reply: r}), ShouldResemble,
+					bson.M{"foo": "bar", "ok": int32(1)})
+				So(r, ShouldResemble, bson.M{"foo": "bar"})
+			})
+
+			Convey("keeping a backend's failure", func() {
+				r := bson.M{"ok": 0.0, "errmsg": "not authorized", "code": int32(13)}
+				So(encode(CommandResponse{Reply: r})["ok"], ShouldEqual, 0.0)
+			})
+		})
+
+		Convey("that is a find response", func() {
+			r := FindResponse{
+				CursorID:   int64(12),
+				Database:   "db",
+				Collection: "foo",
+			}
+			res := ModuleResponse{}
+			res.Write(r)
+
+			actual, err := Encode(reqHeader, res)
+			So(err, ShouldBeNil)
+
+			reply := decodeReply(actual).Map()
+			So(reply["ok"], ShouldEqual, 1)
+			cursor := convert.ToBSONMap(reply["cursor"])
+			So(cursor["id"], ShouldEqual, int64(12))
+			So(cursor["ns"], ShouldEqual, "db.foo")
+			So(cursor["firstBatch"], ShouldResemble, bson.A{})
+		})
+
+		Convey("that is a batch of change events", func() {
+			token := bson.D{{Key: "_data", Value: "8263A1B2C3000000012B"}}
+			r := GetMoreResponse{
+				CursorID:             int64(12),
+				Database:             "db",
+				Collection:           "foo",
+				Documents:            []bson.D{{{Key: "operationType", Value: "insert"}}},
+				ChangeStream:         true,
+				PostBatchResumeToken: token,
+			}
+			res := ModuleResponse{}
+			res.Write(r)
+
+			actual, err := Encode(reqHeader, res)
+			So(err, ShouldBeNil)
+
+			reply := decodeReply(actual).Map()
+			So(reply["ok"], ShouldEqual, 1)
+			cursor := convert.ToBSONMap(reply["cursor"])
+			So(cursor["id"], ShouldEqual, int64(12))
+			So(cursor["nextBatch"], ShouldResemble, bson.A{bson.D{{Key: "operationType", Value: "insert"}}})
+			So(cursor["postBatchResumeToken"], ShouldResemble, token)
+		})
+
+		Convey("that is a command error", func() {
+			res := ModuleResponse{}
+			res.Error(13, "unauthorized")
+
+			actual, err := Encode(reqHeader, res)
+			So(err, ShouldBeNil)
+
+			reply := decodeReply(actual).Map()
+			So(reply["ok"], ShouldEqual, 0)
+			So(reply["code"], ShouldEqual, 13)
+			So(reply["errmsg"], ShouldEqual, "unauthorized")
+		})
+
+		Convey("that is a command error without a code name", func() {
+			res := ModuleResponse{}
+			res.Error(10107, "not primary")
+
+			actual, err := Encode(reqHeader, res)
+			So(err, ShouldBeNil)
+
+			reply := decodeReply(actual).Map()
+			So(reply["ok"], ShouldEqual, 0)
+			So(reply["codeName"], ShouldEqual, "NotWritablePrimary")
+			So(reply["errorLabels"], ShouldBeNil)
+		})
+
+		Convey("that is an insert with write errors", func() {
+			r := InsertResponse{
+				N: 1,
+				WriteErrors: []WriteError{{Index: 1, Code: 121, Message: "failed validation",
+					ErrInfo: bson.M{"failingDocumentId": int32(2)}}},
+				WriteConcernError: &WriteConcernError{Code: 64, CodeName: "WriteConcernFailed",
+					Message: "waiting for replication timed out"},
+			}
+			res := ModuleResponse{}
+			res.Write(r)
+
+			actual, err := Encode(reqHeader, res)
+			So(err, ShouldBeNil)
+
+			reply := decodeReply(actual).Map()
+			So(reply["ok"], ShouldEqual, 1)
+			So(reply["n"], ShouldEqual, 1)
+			writeErrors, err := convert.ConvertToBSONMapSlice(reply["writeErrors"])
+			So(err, ShouldBeNil)
+			So(len(writeErrors), ShouldEqual, 1)
+			So(writeErrors[0]["index"], ShouldEqual, 1)
+			So(writeErrors[0]["code"], ShouldEqual, 121)
+			So(writeErrors[0]["errmsg"], ShouldEqual, "failed validation")
+			So(writeErrors[0]["errInfo"], ShouldResemble, bson.D{{Key: "failingDocumentId", Value: int32(2)}})
+			So(convert.ToBSONMap(reply["writeConcernError"]), ShouldResemble, bson.M{
+				"code": int32(64), "codeName": "WriteConcernFailed",
+				"errmsg": "waiting for replication timed out"})
+		})
+
+		Convey("that is a command error with labels", func() {
+			res := ModuleResponse{}
+			res.Fail(&ResponderError{
+				ErrorCode: 112,
+				Message:   "WriteConflict",
+				Labels:    []string{"TransientTransactionError"},
+			})
+
+			actual, err := Encode(reqHeader, res)
+			So(err, ShouldBeNil)
+
+			reply := decodeReply(actual).Map()
+			So(reply["ok"], ShouldEqual, 0)
+			So(reply["code"], ShouldEqual, 112)
+			So(reply["errorLabels"], ShouldResemble, bson.A{"TransientTransactionError"})
+		})
+	})
+}
+
+func TestCommandArgs(t *testing.T) {
+	Convey("Read and set the arguments of a command", t, func() {
+		command := Command{
+			CommandName: "collMod",
+			Args:        bson.D{{Key: "collMod", Value: "foo"}, {Key: "validationLevel", Value: "strict"}},
+		}
+
+		So(command.GetArg("collMod"), ShouldEqual, "foo")
+		So(command.GetArg("missing"), ShouldBeNil)
+
+		command.SetArg("validationLevel", "moderate")
+		command.SetArg("comment", "hi")
+		So(command.ToBSON(), ShouldResemble, bson.D{{Key: "collMod", Value: "foo"},
+			{Key: "validationLevel", Value: "moderate"}, {Key: "comment", Value: "hi"}})
+
+		Convey("that doesn't start with the command name", func() {
+			command := Command{
+				CommandName: "ping",
+				Args:        bson.D{{Key: "comment", Value: "hi"}},
+			}
+			So(command.ToBSON(), ShouldResemble, bson.D{{Key: "ping", Value: 1}, {Key: "comment", Value: "hi"}})
+		})
+	})
+}
+
+func TestRetryableWrites(t *testing.T) {
+	Convey("Tell whether a write can be retried", t, func() {
+		Convey("that is an acknowledged insert", func() {
+			So(Insert{}.Retryable(), ShouldEqual, true)
+			So(Insert{WriteConcern: &bson.M{"w": "majority"}}.Retryable(), ShouldEqual, true)
+		})
+
+		Convey("that is unacknowledged", func() {
+			So(Insert{WriteConcern: &bson.M{"w": int32(0)}}.Retryable(), ShouldEqual, false)
+			So(FindAndModify{WriteConcern: &bson.M{"w": 0}}.Retryable(), ShouldEqual, false)
+		})
+
+		Convey("that updates or deletes many documents", func() {
+			So(Update{Updates: []SingleUpdate{{}, {}}}.Retryable(), ShouldEqual, true)
+			So(Update{Updates: []SingleUpdate{{}, {Multi: true}}}.Retryable(), ShouldEqual, false)
+			So(Delete{Deletes: []SingleDelete{{Limit: 1}}}.Retryable(), ShouldEqual, true)
+			So(Delete{Deletes: []SingleDelete{{Limit: 0}}}.Retryable(), ShouldEqual, false)
+		})
+	})
+}
+
+func TestIsWrite(t *testing.T) {
+	Convey("Tell whether a request changes anything at the backend", t, func() {
+		Convey("that is a typed write", func() {
+			So(IsWrite(Insert{}), ShouldBeTrue)
+			So(IsWrite(FindAndModify{}), ShouldBeTrue)
+			So(IsWrite(CreateIndexes{}), ShouldBeTrue)
+			So(IsWrite(Find{}), ShouldBeFalse)
+			So(IsWrite(Count{}), ShouldBeFalse)
+		})
+
+		Convey("that is a generic command", func() {
+			drop := Command{CommandName: "drop", Database: "test", Args: bson.D{{Key: "drop", Value: "foo"}}}
+			So(IsWrite(drop), ShouldBeTrue)
+			So(IsWrite(Command{CommandName: "dropDatabase"}), ShouldBeTrue)
+			So(IsWrite(Command{CommandName: "renameCollection"}), ShouldBeTrue)
+			So(IsWrite(Command{CommandName: "findandmodify"}), ShouldBeTrue)
+			So(IsWrite(Command{CommandName: "listCollections"}), ShouldBeFalse)
+			So(IsWrite(Command{CommandName: "isMaster"}), ShouldBeFalse)
+			So(IsWrite(Command{CommandName: "saslStart"}), ShouldBeFalse)
+			So(IsWrite(Command{CommandName: "endSessions"}), ShouldBeFalse)
+			So(IsWrite(Command{CommandName: "explain"}), ShouldBeFalse)
+
+			database, collection := NamespaceOf(drop)
+			So(database, ShouldEqual, "test")
+			So(collection, ShouldEqual, "foo")
+		})
+
+		Convey("that is a command not known to be read-only", func() {
+			for _, name := range []string{"shutdown", "setParameter", "fsync", "replSetStepDown",
+				"killOp", "createSearchIndexes", "setFeatureCompatibilityVersion",
+				"refineCollectionShardKey", "someFutureCommand"} {
+				So(IsWrite(Command{CommandName: name}), ShouldBeTrue)
+			}
+		})
+
+		Convey("that is an aggregate", func() {
+			match := bson.D{{Key: "$match", Value: bson.D{}}}
+			So(IsWrite(Aggregate{Pipeline: []bson.D{match}}), ShouldBeFalse)
+			So(IsWrite(Aggregate{Pipeline: []bson.D{match, {{Key: "$out", Value: "bar"}}}}), ShouldBeTrue)
+			So(IsWrite(Aggregate{Pipeline: []bson.D{{{Key: "$merge", Value: bson.D{{Key: "into", Value: "bar"}}}}}}),
+				ShouldBeTrue)
+			So(IsWrite(Command{CommandName: "aggregate", Args: bson.D{{Key: "aggregate", Value: 1},
+				{Key: "pipeline", Value: bson.A{bson.D{{Key: "$currentOp", Value: bson.D{}}}}}}}),
+				ShouldBeFalse)
+		})
+
+		Convey("that is a mapReduce", func() {
+			inline := Command{CommandName: "mapReduce", Args: bson.D{{Key: "mapReduce", Value: "foo"},
+				{Key: "out", Value: bson.D{{Key: "inline", Value: 1}}}}}
+			So(IsWrite(inline), ShouldBeFalse)
+			out := Command{CommandName: "mapReduce", Args: bson.D{{Key: "mapReduce", Value: "foo"},
+				{Key: "out", Value: "bar"}}}
+			So(IsWrite(out), ShouldBeTrue)
+		})
+	})
+}
+
+func TestParseWriteErrors(t *testing.T) {
+	Convey("Read the errors of a write's reply", t, func() {
+		Convey("that has write errors", func() {
+			writeErrors := bson.A{
+				bson.D{{Key: "index", Value: int32(0)}, {Key: "code", Value: int32(11000)}, {Key: "errmsg", Value: "duplicate key"}},
+				bson.D{{Key: "index", Value: int32(3)}, {Key: "code", Value: int32(121)}, {Key: "errmsg", Value: "failed validation"},
+					{Key: "errInfo", Value: bson.D{{Key: "details", Value: "x"}}}},
+			}
+			So(ParseWriteErrors(writeErrors), ShouldResemble, []WriteError{
+				{Index: 0, Code: 11000, Message: "duplicate key"},
+				{Index: 3, Code: 121, Message: "failed validation", ErrInfo: bson.M{"details": "x"}},
+			})
+		})
+
+		Convey("that has none", func() {
+			So(ParseWriteErrors(nil), ShouldBeNil)
+			So(ParseWriteConcernError(nil), ShouldBeNil)
+		})
+
+		Convey("that has a write concern error", func() {
+			wcErr := bson.D{{Key: "code", Value: int32(64)}, {Key: "codeName", Value: "WriteConcernFailed"},
+				{Key: "errmsg", Value: "timed out"}}
+			So(ParseWriteConcernError(wcErr), ShouldResemble, &WriteConcernError{
+				Code: 64, CodeName: "WriteConcernFailed", Message: "timed out"})
+		})
+	})
+}
+
+func TestWriteResults(t *testing.T) {
+	Convey("Tell which documents of a write succeeded", t, func() {
+		insert := Insert{Documents: make([]bson.D, 4)}
+		response := InsertResponse{N: 2, WriteErrors: []WriteError{
+			{Index: 1, Code: 11000, Message: "duplicate key"},
+		}}
+
+		Convey("in an unordered insert", func() {
+			results := response.Results(insert)
+			So(len(results), ShouldEqual, 4)
+			So(results[0].Succeeded(), ShouldBeTrue)
+			So(results[1].Succeeded(), ShouldBeFalse)
+			So(results[1].Error.Code, ShouldEqual, 11000)
+			So(results[2].Succeeded(), ShouldBeTrue)
+			So(results[3].Succeeded(), ShouldBeTrue)
+		})
+
+		Convey("in an ordered insert", func() {
+			insert.Ordered = true
+			results := response.Results(insert)
+			So(results[0].Succeeded(), ShouldBeTrue)
+			So(results[1].Error, ShouldNotBeNil)
+			So(results[2].Skipped, ShouldBeTrue)
+			So(results[3].Skipped, ShouldBeTrue)
+		})
+
+		Convey("that has no write errors", func() {
+			for _, result := range (InsertResponse{N: 4}).Results(insert) {
+				So(result.Succeeded(), ShouldBeTrue)
+			}
+		})
+	})
+}
+
+func TestEncodeMsgRequest(t *testing.T) {
+	Convey("Send a command to a server and read its reply", t, func() {
+		command := bson.D{{Key: "saslStart", Value: int32(1)}, {Key: "mechanism", Value: "SCRAM-SHA-256"},
+			{Key: "$db", Value: "admin"}}
+		b, err := EncodeMsgRequest(7, command)
+		So(err, ShouldBeNil)
+
+		Convey("the request decodes as the command", func() {
+			req, header, err := Decode(bytes.NewReader(b))
+			So(err, ShouldBeNil)
+			So(header.RequestID, ShouldEqual, 7)
+			So(header.OpCode, ShouldEqual, OP_MSG)
+			c, err := ToCommandRequest(req)
+			So(err, ShouldBeNil)
+			So(c.CommandName, ShouldEqual, "saslStart")
+			So(c.Database, ShouldEqual, "admin")
+		})
+
+		Convey("the reply is read with the ID of the request", func() {
+			reqHeader := MsgHeader{RequestID: 7, OpCode: OP_MSG}
+			reply, err := EncodeMsg(reqHeader, bson.D{{Key: "conversationId", Value: int32(1)},
+				{Key: "done", Value: false}, {Key: "ok", Value: 1.0}})
+			So(err, ShouldBeNil)
+
+			header, doc, err := DecodeMsgReply(bytes.NewReader(reply))
+			So(err, ShouldBeNil)
+			So(header.ResponseTo, ShouldEqual, 7)
+			So(doc, ShouldResemble, bson.D{{Key: "conversationId", Value: int32(1)}, {Key: "done", Value: false},
+				{Key: "ok", Value: 1.0}})
+		})
+
+		Convey("a reply that isn't an OP_MSG is rejected", func() {
+			reply, err := EncodeBSON(MsgHeader{RequestID: 7, OpCode: OP_QUERY}, bson.M{"ok": 1})
+			So(err, ShouldBeNil)
+			_, _, err = DecodeMsgReply(bytes.NewReader(reply))
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
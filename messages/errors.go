@@ -0,0 +1,190 @@
+package messages
+
+import (
+	"github.com/WyattNielsen/mongoproxy/convert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// codeNames are the names of the error codes the proxy reports itself, which
+// are sent as the codeName of errors that don't have one.
+var codeNames = map[int32]string{
+	1:     "InternalError",
+	2:     "BadValue",
+	6:     "HostUnreachable",
+	13:    "Unauthorized",
+	17:    "ProtocolError",
+	18:    "AuthenticationFailed",
+	43:    "CursorNotFound",
+	50:    "MaxTimeMSExpired",
+	59:    "CommandNotFound",
+	89:    "NetworkTimeout",
+	91:    "ShutdownInProgress",
+	112:   "WriteConflict",
+	189:   "PrimarySteppedDown",
+	225:   "TransactionTooOld",
+	251:   "NoSuchTransaction",
+	256:   "TransactionCommitted",
+	292:   "CursorInUse",
+	334:   "MechanismUnavailable",
+	10107: "NotWritablePrimary",
+	11600: "InterruptedAtShutdown",
+	11602: "InterruptedDueToReplStateChange",
+	13435: "NotPrimaryNoSecondaryOk",
+	13436: "NotPrimaryOrSecondary",
+}
+
+// CodeName returns the name of an error code, or an empty string if the proxy
+// doesn't know it.
+func CodeName(code int32) string {
+	return codeNames[code]
+}
+
+// toBSON returns the reply for a failed command.
+func (e *ResponderError) toBSON() bson.M {
+	r := bson.M{
+		"ok":     0,
+		"errmsg": e.Message,
+		"code":   e.ErrorCode,
+	}
+	codeName := e.CodeName
+	if codeName == "" {
+		codeName = CodeName(e.ErrorCode)
+	}
+	if codeName != "" {
+		r["codeName"] = codeName
+	}
+	if len(e.Labels) > 0 {
+		r["errorLabels"] = e.Labels
+	}
+	return r
+}
+
+// A WriteError is the failure of a single statement of a write, such as one
+// of the documents of an insert.
+type WriteError struct {
+	// Index is the position of the failed statement in the write.
+	Index   int32
+	Code    int32
+	Message string
+	ErrInfo bson.M
+}
+
+func (w WriteError) ToBSON() bson.M {
+	r := bson.M{
+		"index":  w.Index,
+		"code":   w.Code,
+		"errmsg": w.Message,
+	}
+	if w.ErrInfo != nil {
+		r["errInfo"] = w.ErrInfo
+	}
+	return r
+}
+
+// A WriteResult is the outcome of a single statement of a write, such as one of
+// the documents of an insert.
+type WriteResult struct {
+	// Index is the position of the statement in the write.
+	Index int32
+
+	// Error is set if the statement failed.
+	Error *WriteError
+
+	// Skipped is true if the statement wasn't run, because an earlier statement
+	// of an ordered write failed.
+	Skipped bool
+}
+
+// Succeeded returns true if the statement was run without an error.
+func (r WriteResult) Succeeded() bool {
+	return r.Error == nil && !r.Skipped
+}
+
+// WriteResults returns the result of each of the count statements of a write,
+// given the write errors in its reply. An ordered write stops at its first error,
+// so the statements after it are skipped.
+func WriteResults(count int, ordered bool, writeErrors []WriteError) []WriteResult {
+	results := make([]WriteResult, count)
+	for i := range results {
+		results[i].Index = int32(i)
+	}
+	for i := range writeErrors {
+		index := int(writeErrors[i].Index)
+		if index < 0 || index >= count {
+			continue
+		}
+		results[index].Error = &writeErrors[i]
+		if ordered {
+			for j := index + 1; j < count; j++ {
+				results[j].Skipped = true
+			}
+		}
+	}
+	return results
+}
+
+// A WriteConcernError is a failure to satisfy the write concern of a write.
+// The write itself may still have been applied.
+type WriteConcernError struct {
+	Code     int32
+	CodeName string
+	Message  string
+	ErrInfo  bson.M
+}
+
+func (w *WriteConcernError) ToBSON() bson.M {
+	r := bson.M{
+		"code":   w.Code,
+		"errmsg": w.Message,
+	}
+	if w.CodeName != "" {
+		r["codeName"] = w.CodeName
+	}
+	if w.ErrInfo != nil {
+		r["errInfo"] = w.ErrInfo
+	}
+	return r
+}
+
+// ParseWriteErrors reads the writeErrors of a write's reply. It returns nil if
+// there are none.
+func ParseWriteErrors(v interface{}) []WriteError {
+	docs, err := convert.ConvertToBSONMapSlice(v)
+	if err != nil || len(docs) == 0 {
+		return nil
+	}
+	writeErrors := make([]WriteError, len(docs))
+	for i, doc := range docs {
+		writeErrors[i] = WriteError{
+			Index:   convert.ToInt32(doc["index"]),
+			Code:    convert.ToInt32(doc["code"]),
+			Message: convert.ToString(doc["errmsg"]),
+			ErrInfo: convert.ToBSONMap(doc["errInfo"]),
+		}
+	}
+	return writeErrors
+}
+
+// ParseWriteConcernError reads the writeConcernError of a write's reply. It
+// returns nil if there is none.
+func ParseWriteConcernError(v interface{}) *WriteConcernError {
+	doc := convert.ToBSONMap(v)
+	if doc == nil {
+		return nil
+	}
+	return &WriteConcernError{
+		Code:     convert.ToInt32(doc["code"]),
+		CodeName: convert.ToString(doc["codeName"]),
+		Message:  convert.ToString(doc["errmsg"]),
+		ErrInfo:  convert.ToBSONMap(doc["errInfo"]),
+	}
+}
+
+// writeErrorsToBSON returns the writeErrors of a reply.
+func writeErrorsToBSON(writeErrors []WriteError) []bson.M {
+	docs := make([]bson.M, len(writeErrors))
+	for i, w := range writeErrors {
+		docs[i] = w.ToBSON()
+	}
+	return docs
+}
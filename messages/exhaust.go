@@ -0,0 +1,78 @@
+package messages
+
+import (
+	"encoding/binary"
+)
+
+// IsExhaust returns true if a request asks for every batch of its cursor in a
+// stream of replies, rather than one reply per getMore: a legacy query with the
+// Exhaust flag, or a getMore in an OP_MSG that allows exhaust.
+func IsExhaust(req Requester, info MsgInfo) bool {
+	switch t := req.(type) {
+	case Find:
+		return t.Exhaust
+	case GetMore:
+		return info.ExhaustAllowed()
+	}
+	return false
+}
+
+// NextGetMore returns the getMore for the next batch of an exhaust stream,
+// given the request of the last batch and the response to it. It returns false
+// once the cursor is exhausted, or if the request failed.
+func NextGetMore(req Requester, res ModuleResponse) (GetMore, bool) {
+	if res.CommandError != nil {
+		return GetMore{}, false
+	}
+
+	var cursorID int64
+	switch t := res.Writer.(type) {
+	case FindResponse:
+		cursorID = t.CursorID
+	case GetMoreResponse:
+		if t.InvalidCursor {
+			return GetMore{}, false
+		}
+		cursorID = t.CursorID
+	}
+	if cursorID == 0 {
+		return GetMore{}, false
+	}
+
+	switch t := req.(type) {
+	case Find:
+		return GetMore{
+			RequestID:  t.RequestID,
+			Session:    t.Session,
+			Database:   t.Database,
+			CursorID:   cursorID,
+			Collection: t.Collection,
+			BatchSize:  t.BatchSize,
+		}, true
+	case GetMore:
+		t.CursorID = cursorID
+		return t, true
+	}
+	return GetMore{}, false
+}
+
+// SetRequestID sets the request ID in the header of an encoded message. The
+// replies of an exhaust stream each respond to the one before them, so they need
+// IDs of their own.
+func SetRequestID(msg []byte, requestID int32) {
+	if len(msg) < 8 {
+		return
+	}
+	binary.LittleEndian.PutUint32(msg[4:8], uint32(requestID))
+}
+
+// SetMoreToCome sets the moreToCome flag of an encoded OP_MSG reply, which tells
+// the client that another reply follows it without a request. Replies of other
+// opcodes are left as they are.
+func SetMoreToCome(msg []byte) {
+	if len(msg) < 20 || int32(binary.LittleEndian.Uint32(msg[12:16])) != OP_MSG {
+		return
+	}
+	flags := int32(binary.LittleEndian.Uint32(msg[16:20])) | MsgMoreToCome
+	binary.LittleEndian.PutUint32(msg[16:20], uint32(flags))
+}
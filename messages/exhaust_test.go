@@ -0,0 +1,73 @@
+package messages
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/WyattNielsen/mongoproxy/convert"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestExhaust(t *testing.T) {
+	Convey("Stream every batch of a cursor to a client that asks for it", t, func() {
+		Convey("to a legacy query with the Exhaust flag", func() {
+			input := createMockQuery(int32(3), int32(64), "db.foo", int32(0), int32(10),
+				bson.D{{Key: "a", Value: 1}})
+			req, _, info, err := DecodeWithInfo(bytes.NewReader(input))
+			So(err, ShouldBeNil)
+			So(IsExhaust(req, info), ShouldBeTrue)
+
+			res := ModuleResponse{}
+			res.Write(FindResponse{CursorID: 12, Database: "db", Collection: "foo"})
+			g, ok := NextGetMore(req, res)
+			So(ok, ShouldBeTrue)
+			So(g.CursorID, ShouldEqual, 12)
+			So(g.Database, ShouldEqual, "db")
+			So(g.Collection, ShouldEqual, "foo")
+			So(g.BatchSize, ShouldEqual, 10)
+
+			Convey("until the cursor is exhausted", func() {
+				res.Write(GetMoreResponse{CursorID: 0, Database: "db", Collection: "foo"})
+				_, ok := NextGetMore(g, res)
+				So(ok, ShouldBeFalse)
+			})
+
+			Convey("or the getMore fails", func() {
+				res.Error(43, "cursor id 12 not found")
+				_, ok := NextGetMore(g, res)
+				So(ok, ShouldBeFalse)
+			})
+		})
+
+		Convey("to a getMore in an OP_MSG that allows exhaust", func() {
+			g := GetMore{Database: "db", Collection: "foo", CursorID: 12, BatchSize: 2}
+			So(IsExhaust(g, MsgInfo{Flags: MsgExhaustAllowed}), ShouldBeTrue)
+			So(IsExhaust(g, MsgInfo{}), ShouldBeFalse)
+			So(IsExhaust(Find{}, MsgInfo{Flags: MsgExhaustAllowed}), ShouldBeFalse)
+
+			res := ModuleResponse{}
+			res.Write(GetMoreResponse{CursorID: 12, Database: "db", Collection: "foo"})
+			next, ok := NextGetMore(g, res)
+			So(ok, ShouldBeTrue)
+			So(next, ShouldResemble, g)
+		})
+
+		Convey("in replies that each respond to the one before", func() {
+			reply, err := EncodeMsg(MsgHeader{RequestID: 5, OpCode: OP_MSG}, bson.M{"ok": 1})
+			So(err, ShouldBeNil)
+			SetRequestID(reply, 9)
+			SetMoreToCome(reply)
+			So(convert.ConvertToInt32LE(reply[4:8]), ShouldEqual, 9)
+			So(convert.ConvertToInt32LE(reply[8:12]), ShouldEqual, 5)
+			So(convert.ConvertToInt32LE(reply[16:20]), ShouldEqual, MsgMoreToCome)
+
+			legacy, err := EncodeBSON(MsgHeader{RequestID: 5, OpCode: OP_GET_MORE},
+				bson.M{"ok": 1})
+			So(err, ShouldBeNil)
+			flags := convert.ConvertToInt32LE(legacy[16:20])
+			SetMoreToCome(legacy)
+			So(convert.ConvertToInt32LE(legacy[16:20]), ShouldEqual, flags)
+		})
+	})
+}
@@ -0,0 +1,97 @@
+package messages
+
+import (
+	"github.com/WyattNielsen/mongoproxy/convert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// the range of wire versions the proxy speaks with clients. The newest is the
+// newest its driver speaks with backends.
+const (
+	MinWireVersion = 0
+	MaxWireVersion = 9
+)
+
+// the limits the proxy advertises when the backend doesn't give its own.
+const (
+	DefaultMaxBsonObjectSize = 16 * 1024 * 1024
+	DefaultMaxWriteBatchSize = 100000
+)
+
+// handshakeFields are the fields of the backend's reply to a handshake that are
+// passed on to clients as they are. The fields that describe the backend's
+// topology, such as its hosts, are replaced with the proxy's own.
+var handshakeFields = []string{"localTime", "logicalSessionTimeoutMinutes", "readOnly",
+	"saslSupportedMechs", "$clusterTime", "operationTime"}
+
+// A Topology is how the proxy presents itself to clients in handshakes, so that
+// they connect to the proxy rather than to the backend's servers.
+type Topology struct {
+	// Address is the host:port of the proxy, as clients reach it.
+	Address string
+
+	// ReplicaSet, if set, is the name of a replica set the proxy presents itself
+	// as the only member of. Otherwise it presents itself as a standalone.
+	ReplicaSet string
+}
+
+// HandshakeReply returns the proxy's reply to the handshake command commandName,
+// built from the backend's reply to hello. The reply presents the proxy as the
+// whole topology, with the wire versions and limits of both the proxy and the
+// backend, and the compressors of the ones the client offered that the proxy
+// supports.
+func HandshakeReply(commandName string, backend bson.M, offered []string, t Topology) bson.M {
+	reply := bson.M{}
+	for _, field := range handshakeFields {
+		if value, ok := backend[field]; ok {
+			reply[field] = value
+		}
+	}
+
+	if commandName == "hello" {
+		reply["isWritablePrimary"] = true
+	} else {
+		reply["ismaster"] = true
+	}
+	if t.ReplicaSet != "" {
+		reply["setName"] = t.ReplicaSet
+		reply["setVersion"] = 1
+		reply["secondary"] = false
+		reply["hosts"] = []string{t.Address}
+		reply["primary"] = t.Address
+		reply["me"] = t.Address
+	}
+
+	minWireVersion := convert.ToInt32(backend["minWireVersion"], MinWireVersion)
+	if minWireVersion < MinWireVersion {
+		minWireVersion = MinWireVersion
+	}
+	maxWireVersion := convert.ToInt32(backend["maxWireVersion"], MaxWireVersion)
+	if maxWireVersion > MaxWireVersion {
+		maxWireVersion = MaxWireVersion
+	}
+	reply["minWireVersion"] = minWireVersion
+	reply["maxWireVersion"] = maxWireVersion
+
+	reply["maxBsonObjectSize"] = minInt32(
+		convert.ToInt32(backend["maxBsonObjectSize"], DefaultMaxBsonObjectSize),
+		DefaultMaxBsonObjectSize)
+	reply["maxMessageSizeBytes"] = minInt32(
+		convert.ToInt32(backend["maxMessageSizeBytes"], MaxMessageSizeBytes),
+		MaxMessageSizeBytes)
+	reply["maxWriteBatchSize"] = convert.ToInt32(backend["maxWriteBatchSize"],
+		DefaultMaxWriteBatchSize)
+
+	if agreed := NegotiateCompressors(offered); len(agreed) > 0 {
+		reply["compression"] = agreed
+	}
+	reply["ok"] = 1
+	return reply
+}
+
+func minInt32(a int32, b int32) int32 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,73 @@
+package messages
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestHandshakeReply(t *testing.T) {
+	Convey("Build the proxy's reply to a handshake", t, func() {
+		backend := bson.M{
+			"isWritablePrimary":            true,
+			"setName":                      "rs0",
+			"hosts":                        bson.A{"db1:27017", "db2:27017"},
+			"me":                           "db1:27017",
+			"primary":                      "db1:27017",
+			"topologyVersion":              bson.M{"counter": int64(1)},
+			"maxBsonObjectSize":            int32(16777216),
+			"maxMessageSizeBytes":          int32(48000000),
+			"maxWriteBatchSize":            int32(100000),
+			"logicalSessionTimeoutMinutes": int32(30),
+			"minWireVersion":               int32(0),
+			"maxWireVersion":               int32(13),
+			"ok":                           1.0,
+		}
+
+		Convey("as a standalone", func() {
+			reply := HandshakeReply("hello", backend, []string{"zstd", "zlib"},
+				Topology{Address: "proxy:8124"})
+			So(reply["isWritablePrimary"], ShouldEqual, true)
+			So(reply["ok"], ShouldEqual, 1)
+			So(reply["logicalSessionTimeoutMinutes"], ShouldEqual, 30)
+			So(reply["compression"], ShouldResemble, []string{"zlib"})
+			for _, field := range []string{"setName", "hosts", "me", "primary", "topologyVersion"} {
+				So(reply, ShouldNotContainKey, field)
+			}
+		})
+
+		Convey("as a single member replica set", func() {
+			reply := HandshakeReply("isMaster", backend, nil,
+				Topology{Address: "proxy:8124", ReplicaSet: "proxy"})
+			So(reply["ismaster"], ShouldEqual, true)
+			So(reply, ShouldNotContainKey, "isWritablePrimary")
+			So(reply["setName"], ShouldEqual, "proxy")
+			So(reply["hosts"], ShouldResemble, []string{"proxy:8124"})
+			So(reply["me"], ShouldEqual, "proxy:8124")
+			So(reply["primary"], ShouldEqual, "proxy:8124")
+			So(reply, ShouldNotContainKey, "compression")
+		})
+
+		Convey("with the mechanisms of the client's user", func() {
+			backend["saslSupportedMechs"] = []string{"SCRAM-SHA-256"}
+			reply := HandshakeReply("hello", backend, nil, Topology{Address: "proxy:8124"})
+			So(reply["saslSupportedMechs"], ShouldResemble, []string{"SCRAM-SHA-256"})
+		})
+
+		Convey("with the wire versions and limits of both", func() {
+			reply := HandshakeReply("hello", backend, nil, Topology{})
+			So(reply["minWireVersion"], ShouldEqual, 0)
+			So(reply["maxWireVersion"], ShouldEqual, MaxWireVersion)
+			So(reply["maxBsonObjectSize"], ShouldEqual, 16777216)
+			So(reply["maxMessageSizeBytes"], ShouldEqual, MaxMessageSizeBytes)
+			So(reply["maxWriteBatchSize"], ShouldEqual, 100000)
+
+			old := bson.M{"maxWireVersion": int32(6), "maxWriteBatchSize": int32(1000)}
+			reply = HandshakeReply("isMaster", old, nil, Topology{})
+			So(reply["maxWireVersion"], ShouldEqual, 6)
+			So(reply["maxWriteBatchSize"], ShouldEqual, 1000)
+			So(reply["maxBsonObjectSize"], ShouldEqual, DefaultMaxBsonObjectSize)
+		})
+	})
+}
@@ -0,0 +1,73 @@
+package messages
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// IsGetLastError returns true if a request is a getLastError command, which
+// legacy clients send after a legacy write to learn its result.
+func IsGetLastError(req Requester) bool {
+	command, ok := req.(Command)
+	return ok && (command.CommandName == "getLastError" || command.CommandName == "getlasterror")
+}
+
+// LastErrorReply returns the reply to a getLastError command, from the response
+// to the legacy write that came before it on the connection, or from nil if the
+// request before it wasn't a legacy write. Legacy writes have no reply of their
+// own, so this is how their result reaches the client.
+func LastErrorReply(res *ModuleResponse) bson.M {
+	reply := bson.M{
+		"n":   int32(0),
+		"err": nil,
+		"ok":  1,
+	}
+	if res == nil {
+		return reply
+	}
+	if res.CommandError != nil {
+		setLastError(reply, res.CommandError.ErrorCode, res.CommandError.Message)
+		return reply
+	}
+
+	var writeErrors []WriteError
+	var writeConcernError *WriteConcernError
+	switch t := res.Writer.(type) {
+	case InsertResponse:
+		// n is always 0 for inserts, as it is with mongod
+		writeErrors, writeConcernError = t.WriteErrors, t.WriteConcernError
+	case UpdateResponse:
+		writeErrors, writeConcernError = t.WriteErrors, t.WriteConcernError
+		if t.N >= 0 {
+			reply["n"] = t.N
+		}
+		reply["updatedExisting"] = t.N > 0 && len(t.Upserted) == 0
+		if len(t.Upserted) > 0 {
+			for _, e := range t.Upserted[0] {
+				if e.Key == "_id" {
+					reply["upserted"] = e.Value
+				}
+			}
+		}
+	case DeleteResponse:
+		writeErrors, writeConcernError = t.WriteErrors, t.WriteConcernError
+		if t.N >= 0 {
+			reply["n"] = t.N
+		}
+	}
+
+	if len(writeErrors) > 0 {
+		setLastError(reply, writeErrors[0].Code, writeErrors[0].Message)
+	} else if writeConcernError != nil {
+		setLastError(reply, writeConcernError.Code, writeConcernError.Message)
+	}
+	return reply
+}
+
+// setLastError sets the error of a getLastError reply.
+func setLastError(reply bson.M, code int32, message string) {
+	reply["err"] = message
+	reply["code"] = code
+	if codeName := CodeName(code); codeName != "" {
+		reply["codeName"] = codeName
+	}
+}
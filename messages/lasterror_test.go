@@ -0,0 +1,62 @@
+package messages
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestLastErrorReply(t *testing.T) {
+	Convey("Reply to a getLastError with the result of the legacy write before it", t, func() {
+		So(IsGetLastError(Command{CommandName: "getLastError"}), ShouldBeTrue)
+		So(IsGetLastError(Command{CommandName: "getlasterror"}), ShouldBeTrue)
+		So(IsGetLastError(Command{CommandName: "ping"}), ShouldBeFalse)
+
+		Convey("when there was none", func() {
+			So(LastErrorReply(nil), ShouldResemble, bson.M{"n": int32(0), "err": nil, "ok": 1})
+		})
+
+		Convey("that was an insert", func() {
+			res := &ModuleResponse{}
+			res.Write(InsertResponse{N: 3})
+			So(LastErrorReply(res), ShouldResemble, bson.M{"n": int32(0), "err": nil, "ok": 1})
+
+			res.Write(InsertResponse{N: 1, WriteErrors: []WriteError{
+				{Index: 1, Code: 11000, Message: "E11000 duplicate key error"}}})
+			reply := LastErrorReply(res)
+			So(reply["err"], ShouldEqual, "E11000 duplicate key error")
+			So(reply["code"], ShouldEqual, 11000)
+			So(reply["ok"], ShouldEqual, 1)
+		})
+
+		Convey("that was an update", func() {
+			res := &ModuleResponse{}
+			res.Write(UpdateResponse{N: 2, NModified: 2})
+			reply := LastErrorReply(res)
+			So(reply["n"], ShouldEqual, 2)
+			So(reply["updatedExisting"], ShouldBeTrue)
+
+			res.Write(UpdateResponse{N: 1, Upserted: []bson.D{{{Key: "index", Value: 0}, {Key: "_id", Value: "a"}}}})
+			reply = LastErrorReply(res)
+			So(reply["updatedExisting"], ShouldBeFalse)
+			So(reply["upserted"], ShouldEqual, "a")
+		})
+
+		Convey("that was a delete", func() {
+			res := &ModuleResponse{}
+			res.Write(DeleteResponse{N: 4})
+			So(LastErrorReply(res)["n"], ShouldEqual, 4)
+		})
+
+		Convey("that failed", func() {
+			res := &ModuleResponse{}
+			res.Error(6, "no backend")
+			reply := LastErrorReply(res)
+			So(reply["err"], ShouldEqual, "no backend")
+			So(reply["code"], ShouldEqual, 6)
+			So(reply["codeName"], ShouldEqual, "HostUnreachable")
+			So(reply["ok"], ShouldEqual, 1)
+		})
+	})
+}
@@ -3,6 +3,7 @@
 package messages
 
 import (
+	"github.com/WyattNielsen/mongoproxy/convert"
 	"go.mongodb.org/mongo-driver/bson"
 )
 
@@ -14,19 +15,35 @@ const (
 	OP_GET_MORE           = 2005
 	OP_DELETE             = 2006
 	OP_KILL_CURSORS       = 2007
+	OP_COMPRESSED         = 2012
 	OP_MSG                = 2013
 )
 
+// constants representing the flag bits of an OP_MSG message.
+const (
+	MsgChecksumPresent int32 = 1 << 0
+	MsgMoreToCome            = 1 << 1
+	MsgExhaustAllowed        = 1 << 16
+)
+
+// MaxMessageSizeBytes is the largest wire protocol message the proxy will accept.
+const MaxMessageSizeBytes = 48000000
+
 // constants representing the types of request structs supported by proxy core.
 const (
-	CommandType     string = "command"
-	FindType               = "find"
-	InsertType             = "insert"
-	UpdateType             = "update"
-	DeleteType             = "delete"
-	GetMoreType            = "getMore"
-	KillCursorsType        = "killCursors"
-	MsgType                = "msg"
+	CommandType       string = "command"
+	FindType                 = "find"
+	InsertType               = "insert"
+	UpdateType               = "update"
+	DeleteType               = "delete"
+	GetMoreType              = "getMore"
+	KillCursorsType          = "killCursors"
+	AggregateType            = "aggregate"
+	CountType                = "count"
+	DistinctType             = "distinct"
+	FindAndModifyType        = "findAndModify"
+	CreateIndexesType        = "createIndexes"
+	MsgType                  = "msg"
 )
 
 // a struct to represent a wire protocol message header.
@@ -37,15 +54,94 @@ type MsgHeader struct {
 	OpCode        int32
 }
 
+// MsgInfo holds details about how a request was framed on the wire that are
+// not carried by its MsgHeader or its Requester.
+type MsgInfo struct {
+	// Flags are the flag bits of an OP_MSG request, and 0 for any other opcode.
+	Flags int32
+
+	// Compressed is true if the request arrived wrapped in an OP_COMPRESSED,
+	// in which case Compressor is the ID of the compressor that was used.
+	Compressed bool
+	Compressor uint8
+}
+
+// MoreToCome returns true if the client does not expect a reply to the request.
+func (i MsgInfo) MoreToCome() bool {
+	return i.Flags&MsgMoreToCome != 0
+}
+
+// ExhaustAllowed returns true if the client accepts multiple replies to the request.
+func (i MsgInfo) ExhaustAllowed() bool {
+	return i.Flags&MsgExhaustAllowed != 0
+}
+
+// A Session holds the logical session fields of a request, which clients send
+// with any command they run in one of their sessions. Requests outside of a
+// session have a nil Session.
+type Session struct {
+	// LSID is the client's id for the session.
+	LSID bson.D
+
+	// TxnNumber numbers the transactions and retryable writes of the session,
+	// and is 0 for other commands.
+	TxnNumber int64
+
+	// Transaction is true if the command is part of a multi-document
+	// transaction, which clients mark with autocommit: false.
+	Transaction bool
+
+	// StartTransaction is true for the first command of a transaction.
+	StartTransaction bool
+
+	// ReadConcern is the read concern of a transaction, which is only given with
+	// its first command.
+	ReadConcern *bson.M
+}
+
+// Fields returns the session fields to send with a command in the session.
+func (s *Session) Fields() bson.D {
+	fields := bson.D{{Key: "lsid", Value: s.LSID}}
+	if s.TxnNumber != 0 {
+		fields = append(fields, bson.E{Key: "txnNumber", Value: s.TxnNumber})
+	}
+	if s.Transaction {
+		fields = append(fields, bson.E{Key: "autocommit", Value: false})
+	}
+	if s.StartTransaction {
+		fields = append(fields, bson.E{Key: "startTransaction", Value: true})
+		if s.ReadConcern != nil {
+			fields = append(fields, bson.E{Key: "readConcern", Value: *s.ReadConcern})
+		}
+	}
+	return fields
+}
+
+// A ReadPreference is the read preference of a read, which chooses the members
+// of a replica set it can run on. Reads without one run on the primary.
+type ReadPreference struct {
+	// Mode is one of "primary", "primaryPreferred", "secondary",
+	// "secondaryPreferred" or "nearest".
+	Mode    string
+	TagSets []bson.M
+
+	// MaxStalenessSeconds is how far behind the primary a secondary can be to
+	// be read from, or 0 for no limit.
+	MaxStalenessSeconds int64
+}
+
 // struct for a generic command, the default Requester sent from proxy
-// core to modules
+// core to modules. Args is the command document as the client sent it, starting
+// with the command name, so that it is forwarded in its original order.
 type Command struct {
-	RequestID   int32
-	CommandName string
-	Database    string
-	Args        bson.M
-	Metadata    bson.M
-	Docs        []bson.D
+	RequestID      int32
+	Session        *Session
+	ReadPreference *ReadPreference
+	CommandName    string
+	Database       string
+	Args           bson.D
+	Metadata       bson.M
+	Docs           []bson.D
 }
 
 func (c Command) Type() string {
@@ -53,17 +149,18 @@ func (c Command) Type() string {
 }
 
 func (c Command) ToBSON() bson.D {
-	nameArg, ok := c.Args[c.CommandName]
-	if !ok {
-		nameArg = 1
+	if len(c.Args) > 0 && c.Args[0].Key == c.CommandName {
+		args := make(bson.D, len(c.Args))
+		copy(args, c.Args)
+		return args
 	}
+
 	args := bson.D{
-		{c.CommandName, nameArg},
+		{Key: c.CommandName, Value: 1},
 	}
-
-	for arg, value := range c.Args {
-		if arg != c.CommandName {
-			args = append(args, bson.E{arg, value})
+	for _, e := range c.Args {
+		if e.Key != c.CommandName {
+			args = append(args, e)
 		}
 	}
 
@@ -73,16 +170,31 @@ func (c Command) ToBSON() bson.D {
 // GetArg takes the name of an argument for the command and returns the
 // value of that argument.
 func (c Command) GetArg(arg string) interface{} {
-	a, ok := c.Args[arg]
-	if !ok {
-		return nil
+	for _, e := range c.Args {
+		if e.Key == arg {
+			return e.Value
+		}
 	}
-	return a
+	return nil
+}
+
+// SetArg sets the value of an argument for the command, keeping its position
+// if the command already has it, and adding it to the end otherwise.
+func (c *Command) SetArg(arg string, value interface{}) {
+	for i := range c.Args {
+		if c.Args[i].Key == arg {
+			c.Args[i].Value = value
+			return
+		}
+	}
+	c.Args = append(c.Args, bson.E{Key: arg, Value: value})
 }
 
 // the struct for the 'find' command.
 type Find struct {
 	RequestID       int32
+	Session         *Session
+	ReadPreference  *ReadPreference
 	Database        string
 	Collection      string
 	Filter          bson.D
@@ -90,25 +202,111 @@ type Find struct {
 	Projection      bson.D
 	Skip            int32
 	Limit           int32
+	BatchSize       int32
+	SingleBatch     bool
 	Tailable        bool
 	OplogReplay     bool
 	NoCursorTimeout bool
 	AwaitData       bool
 	Partial         bool
+	Hint            interface{}
+	MaxTimeMS       int64
+	Comment         interface{}
+	Min             bson.D
+	Max             bson.D
+	ReturnKey       bool
+	ShowRecordID    bool
+	AllowDiskUse    bool
+	Collation       bson.D
+	ReadConcern     *bson.M
+
+	// Extra holds the arguments the struct doesn't model, such as let, which
+	// ToBSON sends along unchanged.
+	Extra bson.D
+
+	// Explain is true for a legacy query with the $explain modifier, which
+	// expects the query plan instead of the results.
+	Explain bool
+
+	// Exhaust is true for a legacy query with the Exhaust flag, which expects
+	// every batch of its cursor in a stream of replies, without getMores.
+	Exhaust bool
 }
 
 func (f Find) Type() string {
 	return FindType
 }
 
+// ToBSON converts a Find to a find command document.
+func (f Find) ToBSON() bson.D {
+	args := bson.D{
+		{Key: "find", Value: f.Collection},
+	}
+	if f.Filter != nil {
+		args = append(args, bson.E{Key: "filter", Value: f.Filter})
+	}
+	if f.Sort != nil {
+		args = append(args, bson.E{Key: "sort", Value: f.Sort})
+	}
+	if f.Projection != nil {
+		args = append(args, bson.E{Key: "projection", Value: f.Projection})
+	}
+	if f.Skip != 0 {
+		args = append(args, bson.E{Key: "skip", Value: f.Skip})
+	}
+	if f.Limit != 0 {
+		args = append(args, bson.E{Key: "limit", Value: f.Limit})
+	}
+	if f.BatchSize != 0 {
+		args = append(args, bson.E{Key: "batchSize", Value: f.BatchSize})
+	}
+
+	flags := []struct {
+		name  string
+		value bool
+	}{
+		{"singleBatch", f.SingleBatch},
+		{"tailable", f.Tailable},
+		{"oplogReplay", f.OplogReplay},
+		{"noCursorTimeout", f.NoCursorTimeout},
+		{"awaitData", f.AwaitData},
+		{"allowPartialResults", f.Partial},
+		{"returnKey", f.ReturnKey},
+		{"showRecordId", f.ShowRecordID},
+		{"allowDiskUse", f.AllowDiskUse},
+	}
+	for _, flag := range flags {
+		if flag.value {
+			args = append(args, bson.E{Key: flag.name, Value: true})
+		}
+	}
+
+	if f.Min != nil {
+		args = append(args, bson.E{Key: "min", Value: f.Min})
+	}
+	if f.Max != nil {
+		args = append(args, bson.E{Key: "max", Value: f.Max})
+	}
+
+	args = appendOptional(args, f.Collation, f.Hint, f.MaxTimeMS, f.Comment, f.ReadConcern, nil)
+	return append(args, f.Extra...)
+}
+
 // the struct for the 'insert' command
 type Insert struct {
-	RequestID    int32
-	Database     string
-	Collection   string
-	Documents    []bson.D
-	Ordered      bool
-	WriteConcern *bson.M
+	RequestID                int32
+	Session                  *Session
+	Database                 string
+	Collection               string
+	Documents                []bson.D
+	Ordered                  bool
+	BypassDocumentValidation bool
+	Comment                  interface{}
+	WriteConcern             *bson.M
+
+	// Extra holds the arguments the struct doesn't model, such as let, which
+	// ToBSON sends along unchanged.
+	Extra bson.D
 }
 
 func (i Insert) Type() string {
@@ -121,29 +319,77 @@ func (i Insert) ToBSON() bson.D {
 		{"documents", i.Documents},
 		{"ordered", i.Ordered},
 	}
+	if i.BypassDocumentValidation {
+		args = append(args, bson.E{Key: "bypassDocumentValidation", Value: true})
+	}
+	if i.Comment != nil {
+		args = append(args, bson.E{Key: "comment", Value: i.Comment})
+	}
 
 	if i.WriteConcern != nil {
 		args = append(args, bson.E{"writeConcern", *i.WriteConcern})
 	}
 
-	return args
+	return append(args, i.Extra...)
+}
+
+// Retryable returns true if the insert can be retried safely, which is the case
+// unless it is unacknowledged.
+func (i Insert) Retryable() bool {
+	return acknowledged(i.WriteConcern)
 }
 
+// SingleUpdate is a statement of an update command. Update is either a
+// document or an aggregation pipeline ([]bson.D).
 type SingleUpdate struct {
-	Selector bson.D
-	Update   bson.D
-	Upsert   bool
-	Multi    bool
+	Selector     bson.D
+	Update       interface{}
+	Upsert       bool
+	Multi        bool
+	ArrayFilters []bson.D
+	Collation    bson.D
+	Hint         interface{}
+
+	// Extra holds the fields of the statement the struct doesn't model, which
+	// ToBSON sends along unchanged.
+	Extra bson.D
+}
+
+// ToBSON converts a SingleUpdate to a statement of an update command.
+func (s SingleUpdate) ToBSON() bson.D {
+	statement := bson.D{
+		{Key: "q", Value: s.Selector},
+		{Key: "u", Value: s.Update},
+		{Key: "upsert", Value: s.Upsert},
+		{Key: "multi", Value: s.Multi},
+	}
+	if s.ArrayFilters != nil {
+		statement = append(statement, bson.E{Key: "arrayFilters", Value: s.ArrayFilters})
+	}
+	if s.Collation != nil {
+		statement = append(statement, bson.E{Key: "collation", Value: s.Collation})
+	}
+	if s.Hint != nil {
+		statement = append(statement, bson.E{Key: "hint", Value: s.Hint})
+	}
+	return append(statement, s.Extra...)
 }
 
 // the struct for the 'update' command
 type Update struct {
-	RequestID    int32
-	Database     string
-	Collection   string
-	Updates      []SingleUpdate
-	Ordered      bool
-	WriteConcern *bson.M
+	RequestID                int32
+	Session                  *Session
+	Database                 string
+	Collection               string
+	Updates                  []SingleUpdate
+	Ordered                  bool
+	BypassDocumentValidation bool
+	Comment                  interface{}
+	WriteConcern             *bson.M
+
+	// Extra holds the arguments the struct doesn't model, such as let, which
+	// ToBSON sends along unchanged.
+	Extra bson.D
 }
 
 func (u Update) Type() string {
@@ -151,16 +397,9 @@ func (u Update) Type() string {
 }
 
 func (u Update) ToBSON() bson.D {
-	updates := make([]bson.M, len(u.Updates))
-
-	for i := 0; i < len(u.Updates); i++ {
-		singleUpdate := u.Updates[i]
-		updates[i] = bson.M{
-			"q":      singleUpdate.Selector,
-			"u":      singleUpdate.Update,
-			"upsert": singleUpdate.Upsert,
-			"multi":  singleUpdate.Multi,
-		}
+	updates := make([]bson.D, len(u.Updates))
+	for i, singleUpdate := range u.Updates {
+		updates[i] = singleUpdate.ToBSON()
 	}
 
 	args := bson.D{
@@ -168,27 +407,72 @@ func (u Update) ToBSON() bson.D {
 		{"updates", updates},
 		{"ordered", u.Ordered},
 	}
+	if u.BypassDocumentValidation {
+		args = append(args, bson.E{Key: "bypassDocumentValidation", Value: true})
+	}
+	if u.Comment != nil {
+		args = append(args, bson.E{Key: "comment", Value: u.Comment})
+	}
 
 	if u.WriteConcern != nil {
 		args = append(args, bson.E{"writeConcern", *u.WriteConcern})
 	}
 
-	return args
+	return append(args, u.Extra...)
+}
+
+// Retryable returns true if the update can be retried safely, which is the case
+// if it is acknowledged and updates at most one document per statement.
+func (u Update) Retryable() bool {
+	for _, update := range u.Updates {
+		if update.Multi {
+			return false
+		}
+	}
+	return acknowledged(u.WriteConcern)
 }
 
+// SingleDelete is a statement of a delete command.
 type SingleDelete struct {
-	Selector bson.D
-	Limit    int32
+	Selector  bson.D
+	Limit     int32
+	Collation bson.D
+	Hint      interface{}
+
+	// Extra holds the fields of the statement the struct doesn't model, which
+	// ToBSON sends along unchanged.
+	Extra bson.D
+}
+
+// ToBSON converts a SingleDelete to a statement of a delete command.
+func (s SingleDelete) ToBSON() bson.D {
+	statement := bson.D{
+		{Key: "q", Value: s.Selector},
+		{Key: "limit", Value: s.Limit},
+	}
+	if s.Collation != nil {
+		statement = append(statement, bson.E{Key: "collation", Value: s.Collation})
+	}
+	if s.Hint != nil {
+		statement = append(statement, bson.E{Key: "hint", Value: s.Hint})
+	}
+	return append(statement, s.Extra...)
 }
 
 // struct for 'delete' command
 type Delete struct {
 	RequestID    int32
+	Session      *Session
 	Database     string
 	Collection   string
 	Deletes      []SingleDelete
 	Ordered      bool
+	Comment      interface{}
 	WriteConcern *bson.M
+
+	// Extra holds the arguments the struct doesn't model, such as let, which
+	// ToBSON sends along unchanged.
+	Extra bson.D
 }
 
 func (d Delete) Type() string {
@@ -196,14 +480,9 @@ func (d Delete) Type() string {
 }
 
 func (d Delete) ToBSON() bson.D {
-	deletes := make([]bson.M, len(d.Deletes))
-
-	for i := 0; i < len(d.Deletes); i++ {
-		singleDelete := d.Deletes[i]
-		deletes[i] = bson.M{
-			"q":     singleDelete.Selector,
-			"limit": singleDelete.Limit,
-		}
+	deletes := make([]bson.D, len(d.Deletes))
+	for i, singleDelete := range d.Deletes {
+		deletes[i] = singleDelete.ToBSON()
 	}
 
 	args := bson.D{
@@ -211,41 +490,432 @@ func (d Delete) ToBSON() bson.D {
 		{"deletes", deletes},
 		{"ordered", d.Ordered},
 	}
+	if d.Comment != nil {
+		args = append(args, bson.E{Key: "comment", Value: d.Comment})
+	}
 
 	if d.WriteConcern != nil {
 		args = append(args, bson.E{"writeConcern", *d.WriteConcern})
 	}
 
-	return args
+	return append(args, d.Extra...)
+}
+
+// Retryable returns true if the delete can be retried safely, which is the case
+// if it is acknowledged and deletes at most one document per statement.
+func (d Delete) Retryable() bool {
+	for _, singleDelete := range d.Deletes {
+		if singleDelete.Limit != 1 {
+			return false
+		}
+	}
+	return acknowledged(d.WriteConcern)
+}
+
+// acknowledged returns false if a write concern asks for no acknowledgement.
+func acknowledged(writeConcern *bson.M) bool {
+	if writeConcern == nil {
+		return true
+	}
+	w, ok := (*writeConcern)["w"]
+	return !ok || convert.ToInt(w, 1) != 0
 }
 
 // struct for 'getMore' command
 type GetMore struct {
 	RequestID  int32
+	Session    *Session
 	Database   string
 	CursorID   int64
 	Collection string
 	BatchSize  int32
+
+	// MaxTimeMS is how long a getMore on an awaitData cursor waits for new
+	// documents, or 0 for the server's default.
+	MaxTimeMS int64
 }
 
 func (g GetMore) Type() string {
 	return GetMoreType
 }
 
+// ToBSON converts a GetMore to a getMore command document.
+func (g GetMore) ToBSON() bson.D {
+	args := bson.D{
+		{Key: "getMore", Value: g.CursorID},
+		{Key: "collection", Value: g.Collection},
+	}
+	if g.BatchSize > 0 {
+		args = append(args, bson.E{Key: "batchSize", Value: g.BatchSize})
+	}
+	if g.MaxTimeMS > 0 {
+		args = append(args, bson.E{Key: "maxTimeMS", Value: g.MaxTimeMS})
+	}
+	return args
+}
+
+// struct for 'killCursors' command. Database and Collection are empty if the
+// request came from an OP_KILL_CURSORS, which doesn't carry a namespace.
 type KillCursors struct {
-	CursorID []int64
+	RequestID  int32
+	Session    *Session
+	Database   string
+	Collection string
+	CursorID   []int64
 }
 
 func (k KillCursors) Type() string {
 	return KillCursorsType
 }
 
+func (k KillCursors) ToBSON() bson.D {
+	return bson.D{
+		{Key: "killCursors", Value: k.Collection},
+		{Key: "cursors", Value: k.CursorID},
+	}
+}
+
+// appendOptional appends the optional arguments of a command to its BSON form,
+// skipping the ones that aren't set.
+func appendOptional(args bson.D, collation bson.D, hint interface{}, maxTimeMS int64,
+	comment interface{}, readConcern *bson.M, writeConcern *bson.M) bson.D {
+	if collation != nil {
+		args = append(args, bson.E{Key: "collation", Value: collation})
+	}
+	if hint != nil {
+		args = append(args, bson.E{Key: "hint", Value: hint})
+	}
+	if maxTimeMS > 0 {
+		args = append(args, bson.E{Key: "maxTimeMS", Value: maxTimeMS})
+	}
+	if comment != nil {
+		args = append(args, bson.E{Key: "comment", Value: comment})
+	}
+	if readConcern != nil {
+		args = append(args, bson.E{Key: "readConcern", Value: *readConcern})
+	}
+	if writeConcern != nil {
+		args = append(args, bson.E{Key: "writeConcern", Value: *writeConcern})
+	}
+	return args
+}
+
+// struct for 'aggregate' command. Collection is empty for an aggregate on the
+// whole database, such as one starting with $currentOp.
+type Aggregate struct {
+	RequestID                int32
+	Session                  *Session
+	ReadPreference           *ReadPreference
+	Database                 string
+	Collection               string
+	Pipeline                 []bson.D
+	BatchSize                int32
+	AllowDiskUse             bool
+	Explain                  bool
+	BypassDocumentValidation bool
+	Collation                bson.D
+	Hint                     interface{}
+	MaxTimeMS                int64
+	Comment                  interface{}
+	ReadConcern              *bson.M
+	WriteConcern             *bson.M
+
+	// Extra holds the arguments the struct doesn't model, such as let, which
+	// ToBSON sends along unchanged.
+	Extra bson.D
+}
+
+func (a Aggregate) Type() string {
+	return AggregateType
+}
+
+// Namespace returns the collection part of the namespace of the aggregate's
+// cursor, which for an aggregate on the whole database is "$cmd.aggregate".
+func (a Aggregate) Namespace() string {
+	if a.Collection == "" {
+		return "$cmd.aggregate"
+	}
+	return a.Collection
+}
+
+// Writes returns true if the aggregate writes its results to a collection, with
+// an $out or $merge stage.
+func (a Aggregate) Writes() bool {
+	return pipelineWrites(a.Pipeline)
+}
+
+// pipelineWrites returns true if an aggregation pipeline has an $out or $merge
+// stage.
+func pipelineWrites(pipeline []bson.D) bool {
+	for _, stage := range pipeline {
+		if len(stage) > 0 && (stage[0].Key == "$out" || stage[0].Key == "$merge") {
+			return true
+		}
+	}
+	return false
+}
+
+// IsChangeStream returns true if the aggregate opens a change stream, which is
+// the case when the first stage of its pipeline is a $changeStream.
+func (a Aggregate) IsChangeStream() bool {
+	return len(a.Pipeline) > 0 && len(a.Pipeline[0]) > 0 &&
+		a.Pipeline[0][0].Key == "$changeStream"
+}
+
+func (a Aggregate) ToBSON() bson.D {
+	var aggregate interface{} = a.Collection
+	if a.Collection == "" {
+		aggregate = 1
+	}
+	pipeline := a.Pipeline
+	if pipeline == nil {
+		pipeline = make([]bson.D, 0)
+	}
+
+	args := bson.D{
+		{Key: "aggregate", Value: aggregate},
+		{Key: "pipeline", Value: pipeline},
+	}
+
+	// explains don't return a cursor
+	if !a.Explain {
+		cursor := bson.D{}
+		if a.BatchSize > 0 {
+			cursor = append(cursor, bson.E{Key: "batchSize", Value: a.BatchSize})
+		}
+		args = append(args, bson.E{Key: "cursor", Value: cursor})
+	} else {
+		args = append(args, bson.E{Key: "explain", Value: true})
+	}
+	if a.AllowDiskUse {
+		args = append(args, bson.E{Key: "allowDiskUse", Value: true})
+	}
+	if a.BypassDocumentValidation {
+		args = append(args, bson.E{Key: "bypassDocumentValidation", Value: true})
+	}
+
+	args = appendOptional(args, a.Collation, a.Hint, a.MaxTimeMS, a.Comment,
+		a.ReadConcern, a.WriteConcern)
+	return append(args, a.Extra...)
+}
+
+// struct for 'count' command
+type Count struct {
+	RequestID      int32
+	Session        *Session
+	ReadPreference *ReadPreference
+	Database       string
+	Collection     string
+	Query          bson.D
+	Limit          int64
+	Skip           int64
+	Collation      bson.D
+	Hint           interface{}
+	MaxTimeMS      int64
+	Comment        interface{}
+	ReadConcern    *bson.M
+
+	// Extra holds the arguments the struct doesn't model, which ToBSON sends
+	// along unchanged.
+	Extra bson.D
+}
+
+func (c Count) Type() string {
+	return CountType
+}
+
+func (c Count) ToBSON() bson.D {
+	args := bson.D{
+		{Key: "count", Value: c.Collection},
+	}
+	if c.Query != nil {
+		args = append(args, bson.E{Key: "query", Value: c.Query})
+	}
+	if c.Limit != 0 {
+		args = append(args, bson.E{Key: "limit", Value: c.Limit})
+	}
+	if c.Skip != 0 {
+		args = append(args, bson.E{Key: "skip", Value: c.Skip})
+	}
+
+	args = appendOptional(args, c.Collation, c.Hint, c.MaxTimeMS, c.Comment,
+		c.ReadConcern, nil)
+	return append(args, c.Extra...)
+}
+
+// struct for 'distinct' command
+type Distinct struct {
+	RequestID      int32
+	Session        *Session
+	ReadPreference *ReadPreference
+	Database       string
+	Collection     string
+	Key            string
+	Query          bson.D
+	Collation      bson.D
+	MaxTimeMS      int64
+	Comment        interface{}
+	ReadConcern    *bson.M
+
+	// Extra holds the arguments the struct doesn't model, which ToBSON sends
+	// along unchanged.
+	Extra bson.D
+}
+
+func (d Distinct) Type() string {
+	return DistinctType
+}
+
+func (d Distinct) ToBSON() bson.D {
+	args := bson.D{
+		{Key: "distinct", Value: d.Collection},
+		{Key: "key", Value: d.Key},
+	}
+	if d.Query != nil {
+		args = append(args, bson.E{Key: "query", Value: d.Query})
+	}
+
+	args = appendOptional(args, d.Collation, nil, d.MaxTimeMS, d.Comment,
+		d.ReadConcern, nil)
+	return append(args, d.Extra...)
+}
+
+// struct for 'findAndModify' command. Update is either an update document or,
+// for an update with an aggregation pipeline, a []bson.D.
+type FindAndModify struct {
+	RequestID                int32
+	Session                  *Session
+	Database                 string
+	Collection               string
+	Query                    bson.D
+	Sort                     bson.D
+	Remove                   bool
+	Update                   interface{}
+	New                      bool
+	Fields                   bson.D
+	Upsert                   bool
+	BypassDocumentValidation bool
+	ArrayFilters             []bson.D
+	Collation                bson.D
+	Hint                     interface{}
+	MaxTimeMS                int64
+	Comment                  interface{}
+	WriteConcern             *bson.M
+
+	// Extra holds the arguments the struct doesn't model, such as let, which
+	// ToBSON sends along unchanged.
+	Extra bson.D
+}
+
+func (f FindAndModify) Type() string {
+	return FindAndModifyType
+}
+
+// Retryable returns true if the findAndModify can be retried safely, which is
+// the case unless it is unacknowledged.
+func (f FindAndModify) Retryable() bool {
+	return acknowledged(f.WriteConcern)
+}
+
+func (f FindAndModify) ToBSON() bson.D {
+	args := bson.D{
+		{Key: "findAndModify", Value: f.Collection},
+	}
+	if f.Query != nil {
+		args = append(args, bson.E{Key: "query", Value: f.Query})
+	}
+	if f.Sort != nil {
+		args = append(args, bson.E{Key: "sort", Value: f.Sort})
+	}
+	if f.Remove {
+		args = append(args, bson.E{Key: "remove", Value: true})
+	}
+	if f.Update != nil {
+		args = append(args, bson.E{Key: "update", Value: f.Update})
+	}
+	if f.New {
+		args = append(args, bson.E{Key: "new", Value: true})
+	}
+	if f.Fields != nil {
+		args = append(args, bson.E{Key: "fields", Value: f.Fields})
+	}
+	if f.Upsert {
+		args = append(args, bson.E{Key: "upsert", Value: true})
+	}
+	if f.BypassDocumentValidation {
+		args = append(args, bson.E{Key: "bypassDocumentValidation", Value: true})
+	}
+	if f.ArrayFilters != nil {
+		args = append(args, bson.E{Key: "arrayFilters", Value: f.ArrayFilters})
+	}
+
+	args = appendOptional(args, f.Collation, f.Hint, f.MaxTimeMS, f.Comment,
+		nil, f.WriteConcern)
+	return append(args, f.Extra...)
+}
+
+// An Index is the specification of a single index in a 'createIndexes' command.
+// Options holds everything besides the key and the name, such as unique or
+// expireAfterSeconds.
+type Index struct {
+	Key     bson.D
+	Name    string
+	Options bson.D
+}
+
+// struct for 'createIndexes' command
+type CreateIndexes struct {
+	RequestID    int32
+	Session      *Session
+	Database     string
+	Collection   string
+	Indexes      []Index
+	CommitQuorum interface{}
+	MaxTimeMS    int64
+	Comment      interface{}
+	WriteConcern *bson.M
+
+	// Extra holds the arguments the struct doesn't model, which ToBSON sends
+	// along unchanged.
+	Extra bson.D
+}
+
+func (c CreateIndexes) Type() string {
+	return CreateIndexesType
+}
+
+func (c CreateIndexes) ToBSON() bson.D {
+	indexes := make([]bson.D, len(c.Indexes))
+	for i, index := range c.Indexes {
+		spec := bson.D{
+			{Key: "key", Value: index.Key},
+			{Key: "name", Value: index.Name},
+		}
+		indexes[i] = append(spec, index.Options...)
+	}
+
+	args := bson.D{
+		{Key: "createIndexes", Value: c.Collection},
+		{Key: "indexes", Value: indexes},
+	}
+	if c.CommitQuorum != nil {
+		args = append(args, bson.E{Key: "commitQuorum", Value: c.CommitQuorum})
+	}
+
+	args = appendOptional(args, nil, nil, c.MaxTimeMS, c.Comment, nil, c.WriteConcern)
+	return append(args, c.Extra...)
+}
+
+// A Section is a single section of an OP_MSG message. A kind 0 section holds
+// the command body as its only document, while a kind 1 section holds a
+// sequence of documents for the command argument named by Identifier.
 type Section struct {
 	Kind       int32
 	Content    []bson.D
 	Identifier string
 }
 
+// struct for a raw OP_MSG message, before it is converted into a Requester.
 type Msg struct {
 	Flag     int32
 	Sections []Section
@@ -2,6 +2,9 @@ package messages
 
 import (
 	"fmt"
+	"strings"
+
+	"github.com/WyattNielsen/mongoproxy/convert"
 )
 
 func ToFindRequest(r Requester) (Find, error) {
@@ -44,6 +47,54 @@ func ToDeleteRequest(r Requester) (Delete, error) {
 	return f, nil
 }
 
+func ToKillCursorsRequest(r Requester) (KillCursors, error) {
+	k, ok := r.(KillCursors)
+	if !ok {
+		return KillCursors{}, fmt.Errorf("Requester was not a killCursors object. Requester received instead: %#v", r)
+	}
+	return k, nil
+}
+
+func ToAggregateRequest(r Requester) (Aggregate, error) {
+	a, ok := r.(Aggregate)
+	if !ok {
+		return Aggregate{}, fmt.Errorf("Requester was not an aggregate object. Requester received instead: %#v", r)
+	}
+	return a, nil
+}
+
+func ToCountRequest(r Requester) (Count, error) {
+	c, ok := r.(Count)
+	if !ok {
+		return Count{}, fmt.Errorf("Requester was not a count object. Requester received instead: %#v", r)
+	}
+	return c, nil
+}
+
+func ToDistinctRequest(r Requester) (Distinct, error) {
+	d, ok := r.(Distinct)
+	if !ok {
+		return Distinct{}, fmt.Errorf("Requester was not a distinct object. Requester received instead: %#v", r)
+	}
+	return d, nil
+}
+
+func ToFindAndModifyRequest(r Requester) (FindAndModify, error) {
+	f, ok := r.(FindAndModify)
+	if !ok {
+		return FindAndModify{}, fmt.Errorf("Requester was not a findAndModify object. Requester received instead: %#v", r)
+	}
+	return f, nil
+}
+
+func ToCreateIndexesRequest(r Requester) (CreateIndexes, error) {
+	c, ok := r.(CreateIndexes)
+	if !ok {
+		return CreateIndexes{}, fmt.Errorf("Requester was not a createIndexes object. Requester received instead: %#v", r)
+	}
+	return c, nil
+}
+
 func ToCommandRequest(r Requester) (Command, error) {
 	c, ok := r.(Command)
 	if !ok {
@@ -51,3 +102,191 @@ func ToCommandRequest(r Requester) (Command, error) {
 	}
 	return c, nil
 }
+
+// SessionOf returns the logical session the request was sent in, or nil if it
+// wasn't sent in one.
+func SessionOf(r Requester) *Session {
+	switch t := r.(type) {
+	case Command:
+		return t.Session
+	case Find:
+		return t.Session
+	case GetMore:
+		return t.Session
+	case Insert:
+		return t.Session
+	case Update:
+		return t.Session
+	case Delete:
+		return t.Session
+	case KillCursors:
+		return t.Session
+	case Aggregate:
+		return t.Session
+	case Count:
+		return t.Session
+	case Distinct:
+		return t.Session
+	case FindAndModify:
+		return t.Session
+	case CreateIndexes:
+		return t.Session
+	}
+	return nil
+}
+
+// ReadPreferenceOf returns the read preference the client sent with a read, or
+// nil if it didn't send one.
+func ReadPreferenceOf(r Requester) *ReadPreference {
+	switch t := r.(type) {
+	case Command:
+		return t.ReadPreference
+	case Find:
+		return t.ReadPreference
+	case Aggregate:
+		return t.ReadPreference
+	case Count:
+		return t.ReadPreference
+	case Distinct:
+		return t.ReadPreference
+	}
+	return nil
+}
+
+// IsHandshake returns true if commandName is one of the commands a client
+// uses to open a connection and discover the server's capabilities.
+func IsHandshake(commandName string) bool {
+	switch commandName {
+	case "isMaster", "ismaster", "hello":
+		return true
+	default:
+		return false
+	}
+}
+
+// readOnlyCommands are the generic commands known not to change anything at
+// the backend, keyed by their lowercased names. Any other command is taken to
+// be a write, so that read-only mode rejects commands it doesn't know about.
+var readOnlyCommands = map[string]bool{
+	// handshakes, authentication and sessions
+	"ismaster":            true,
+	"hello":               true,
+	"ping":                true,
+	"buildinfo":           true,
+	"getnonce":            true,
+	"saslstart":           true,
+	"saslcontinue":        true,
+	"authenticate":        true,
+	"logout":              true,
+	"connectionstatus":    true,
+	"whatsmyuri":          true,
+	"startsession":        true,
+	"refreshsessions":     true,
+	"endsessions":         true,
+	"committransaction":   true,
+	"aborttransaction":    true,
+	"getlasterror":        true,
+	"getpreverror":        true,
+	"listcommands":        true,
+	"getparameter":        true,
+	"getcmdlineopts":      true,
+	"getdefaultrwconcern": true,
+
+	// reads
+	"find":              true,
+	"getmore":           true,
+	"killcursors":       true,
+	"count":             true,
+	"distinct":          true,
+	"explain":           true,
+	"listdatabases":     true,
+	"listcollections":   true,
+	"listindexes":       true,
+	"listsearchindexes": true,
+	"dbstats":           true,
+	"collstats":         true,
+	"datasize":          true,
+	"dbhash":            true,
+	"usersinfo":         true,
+	"rolesinfo":         true,
+
+	// diagnostics
+	"serverstatus":     true,
+	"hostinfo":         true,
+	"replsetgetstatus": true,
+	"replsetgetconfig": true,
+	"currentop":        true,
+	"top":              true,
+	"lockinfo":         true,
+	"connpoolstats":    true,
+	"getlog":           true,
+}
+
+// IsWrite returns true if the request may change anything at the backend, such
+// as a write, a command that drops or creates a collection or an index, an
+// aggregate with an $out or $merge stage, or any command that isn't known to
+// be read-only.
+func IsWrite(r Requester) bool {
+	switch t := r.(type) {
+	case Find, GetMore, KillCursors, Count, Distinct:
+		return false
+	case Aggregate:
+		return t.Writes()
+	case Command:
+		return commandWrites(t)
+	}
+	return true
+}
+
+// commandWrites returns true if a generic command may change anything at the
+// backend.
+func commandWrites(c Command) bool {
+	switch name := strings.ToLower(c.CommandName); name {
+	case "aggregate":
+		pipeline, err := convert.ConvertToBSONDocSlice(c.GetArg("pipeline"))
+		return err != nil || pipelineWrites(pipeline)
+	case "mapreduce":
+		// a mapReduce only writes if its output isn't inline
+		out := convert.ToBSONMap(c.GetArg("out"))
+		return out == nil || out["inline"] == nil
+	default:
+		return !readOnlyCommands[name]
+	}
+}
+
+// NamespaceOf returns the database and collection a request is for. The
+// collection is empty for requests on a whole database.
+func NamespaceOf(r Requester) (string, string) {
+	switch t := r.(type) {
+	case Command:
+		// most commands name their collection in their first argument
+		collection := ""
+		if len(t.Args) > 0 && t.Args[0].Key == t.CommandName {
+			collection, _ = t.Args[0].Value.(string)
+		}
+		return t.Database, collection
+	case Find:
+		return t.Database, t.Collection
+	case GetMore:
+		return t.Database, t.Collection
+	case Insert:
+		return t.Database, t.Collection
+	case Update:
+		return t.Database, t.Collection
+	case Delete:
+		return t.Database, t.Collection
+	case KillCursors:
+		return t.Database, t.Collection
+	case Aggregate:
+		return t.Database, t.Collection
+	case Count:
+		return t.Database, t.Collection
+	case Distinct:
+		return t.Database, t.Collection
+	case FindAndModify:
+		return t.Database, t.Collection
+	case CreateIndexes:
+		return t.Database, t.Collection
+	}
+	return "", ""
+}
@@ -4,6 +4,14 @@ package messages
 type ResponderError struct {
 	ErrorCode int32
 	Message   string
+
+	// CodeName is the name of the error code. If it is empty, the name the proxy
+	// knows for the code, if any, is sent instead.
+	CodeName string
+
+	// Labels are the error labels of the error, such as TransientTransactionError,
+	// which tell clients how to handle it.
+	Labels []string
 }
 
 // A Responder is the interface that are used to record responses from modules
@@ -17,6 +25,10 @@ type Responder interface {
 	// Error indicates that the response failed, and takes in an int32 error code
 	// and a string for an error message.
 	Error(int32, string)
+
+	// Fail indicates that the response failed with the given error, and keeps
+	// all of its details, such as its labels.
+	Fail(*ResponderError)
 }
 
 // Struct that records the responses from modules to be handled by proxy core.
@@ -35,5 +47,9 @@ func (r *ModuleResponse) Write(writer ResponseWriter) {
 }
 
 func (r *ModuleResponse) Error(code int32, message string) {
-	r.CommandError = &ResponderError{code, message}
+	r.CommandError = &ResponderError{ErrorCode: code, Message: message}
+}
+
+func (r *ModuleResponse) Fail(err *ResponderError) {
+	r.CommandError = err
 }
@@ -28,7 +28,24 @@ type CommandResponse struct {
 	Documents []bson.D
 }
 
+// replyDocument returns a copy of the reply to send, which succeeded unless it
+// says otherwise, such as a backend's reply with ok: 0.
+func (c CommandResponse) replyDocument() bson.M {
+	reply := bson.M{}
+	for key, value := range c.Reply {
+		reply[key] = value
+	}
+	if _, ok := reply["ok"]; !ok {
+		reply["ok"] = 1
+	}
+	return reply
+}
+
 func (c CommandResponse) ToBytes(header MsgHeader) ([]byte, error) {
+	if header.OpCode == OP_MSG {
+		return EncodeMsg(header, c.replyDocument())
+	}
+
 	resHeader := createResponseHeader(header)
 	startingFrom := int32(0)
 
@@ -42,9 +59,7 @@ func (c CommandResponse) ToBytes(header MsgHeader) ([]byte, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error writing prepared response: %v", err)
 	}
-	reply := c.Reply
-	reply["ok"] = 1
-	docBytes, err := marshalReplyDocs(reply, c.Documents)
+	docBytes, err := marshalReplyDocs(c.replyDocument(), c.Documents)
 	if err != nil {
 		return nil, fmt.Errorf("error marshaling documents: %v", err)
 	}
@@ -73,6 +88,16 @@ type FindResponse struct {
 }
 
 func (f FindResponse) ToBytes(header MsgHeader) ([]byte, error) {
+	if header.OpCode == OP_MSG {
+		_, ok := f.QueryFailure["$err"]
+		if ok {
+			return EncodeMsg(header, queryFailureToCommandError(f.QueryFailure))
+		}
+		b := f.ToBSON()
+		b["ok"] = 1
+		return EncodeMsg(header, b)
+	}
+
 	resHeader := createResponseHeader(header)
 	startingFrom := int32(0)
 
@@ -126,11 +151,69 @@ func (f FindResponse) ToBSON() bson.M {
 		"cursor": bson.M{
 			"id":         f.CursorID,
 			"ns":         f.Database + "." + f.Collection,
-			"firstBatch": f.Documents,
+			"firstBatch": nonNilDocs(f.Documents),
 		},
 	}
 }
 
+// A struct that represents a response to an aggregate command. Unlike a
+// FindResponse, it is always encoded as a command reply with a cursor document,
+// whatever the opcode of the request.
+type AggregateResponse struct {
+	CursorID   int64
+	Database   string
+	Collection string
+	Documents  []bson.D
+
+	// ChangeStream is true if the documents are the change events of a
+	// $changeStream aggregate.
+	ChangeStream bool
+
+	// PostBatchResumeToken is the resume token of a change stream after this
+	// batch, if the backend gave one.
+	PostBatchResumeToken bson.D
+}
+
+func (a AggregateResponse) ToBytes(header MsgHeader) ([]byte, error) {
+	return CommandResponse{Reply: a.ToBSON()}.ToBytes(header)
+}
+
+func (a AggregateResponse) ToBSON() bson.M {
+	cursor := bson.M{
+		"id":         a.CursorID,
+		"ns":         a.Database + "." + a.Collection,
+		"firstBatch": nonNilDocs(a.Documents),
+	}
+	if a.PostBatchResumeToken != nil {
+		cursor["postBatchResumeToken"] = a.PostBatchResumeToken
+	}
+	return bson.M{"cursor": cursor}
+}
+
+// queryFailureToCommandError converts the $err document of a legacy query
+// failure into the error document of a command reply.
+func queryFailureToCommandError(queryFailure bson.M) bson.M {
+	r := bson.M{"ok": 0}
+	qErr := convert.ToBSONMap(queryFailure["$err"])
+	if qErr != nil {
+		r["errmsg"] = qErr["errmsg"]
+		r["code"] = qErr["code"]
+	} else {
+		r["errmsg"] = queryFailure["$err"]
+		r["code"] = queryFailure["code"]
+	}
+	return r
+}
+
+// nonNilDocs returns docs, or an empty slice if docs is nil, so that batches
+// are always encoded as BSON arrays rather than null.
+func nonNilDocs(docs []bson.D) []bson.D {
+	if docs == nil {
+		return make([]bson.D, 0)
+	}
+	return docs
+}
+
 // A struct that represents a response to a getMore command.
 type GetMoreResponse struct {
 	CursorID      int64
@@ -138,9 +221,31 @@ type GetMoreResponse struct {
 	Collection    string
 	Documents     []bson.D
 	InvalidCursor bool // true if the cursor wasn't valid at the server.
+
+	// ChangeStream is true if the cursor is a change stream's, and the
+	// documents are change events.
+	ChangeStream bool
+
+	// PostBatchResumeToken is the resume token of a change stream after this
+	// batch, if the backend gave one.
+	PostBatchResumeToken bson.D
 }
 
 func (g GetMoreResponse) ToBytes(header MsgHeader) ([]byte, error) {
+	if header.OpCode == OP_MSG {
+		if g.InvalidCursor {
+			return EncodeMsg(header, bson.M{
+				"ok":       0,
+				"errmsg":   fmt.Sprintf("cursor id %v not found", g.CursorID),
+				"code":     43,
+				"codeName": "CursorNotFound",
+			})
+		}
+		b := g.ToBSON()
+		b["ok"] = 1
+		return EncodeMsg(header, b)
+	}
+
 	resHeader := createResponseHeader(header)
 	startingFrom := int32(0)
 
@@ -184,14 +289,15 @@ func (g GetMoreResponse) ToBytes(header MsgHeader) ([]byte, error) {
 }
 
 func (g GetMoreResponse) ToBSON() bson.M {
-
-	return bson.M{
-		"cursor": bson.M{
-			"id":        g.CursorID,
-			"ns":        g.Database + "." + g.Collection,
-			"nextBatch": g.Documents,
-		},
+	cursor := bson.M{
+		"id":        g.CursorID,
+		"ns":        g.Database + "." + g.Collection,
+		"nextBatch": nonNilDocs(g.Documents),
 	}
+	if g.PostBatchResumeToken != nil {
+		cursor["postBatchResumeToken"] = g.PostBatchResumeToken
+	}
+	return bson.M{"cursor": cursor}
 }
 
 // A struct that represents a response to an insert command.
@@ -201,9 +307,11 @@ type InsertResponse struct {
 	// will not be exported when writing to the wire protocol.
 	N int32
 
-	// a list of write errors
-	// TODO: create a WriteError struct
-	WriteErrors []bson.M
+	// the documents that failed to be inserted
+	WriteErrors []WriteError
+
+	// set if the write concern of the insert wasn't satisfied
+	WriteConcernError *WriteConcernError
 }
 
 func (i InsertResponse) ToBytes(header MsgHeader) ([]byte, error) {
@@ -220,13 +328,22 @@ func (i InsertResponse) ToBSON() bson.M {
 	if i.N >= 0 {
 		r["n"] = i.N
 	}
-	if i.WriteErrors != nil && len(i.WriteErrors) > 0 {
-		r["writeErrors"] = i.WriteErrors
+	if len(i.WriteErrors) > 0 {
+		r["writeErrors"] = writeErrorsToBSON(i.WriteErrors)
+	}
+	if i.WriteConcernError != nil {
+		r["writeConcernError"] = i.WriteConcernError.ToBSON()
 	}
 
 	return r
 }
 
+// Results returns the result of inserting each document of the insert the
+// response is for.
+func (i InsertResponse) Results(insert Insert) []WriteResult {
+	return WriteResults(len(insert.Documents), insert.Ordered, i.WriteErrors)
+}
+
 // A struct that represents a response to an update command.
 type UpdateResponse struct {
 
@@ -241,7 +358,10 @@ type UpdateResponse struct {
 	Upserted []bson.D
 
 	// a list of write errors that occurred while updating
-	WriteErrors []bson.M
+	WriteErrors []WriteError
+
+	// set if the write concern of the update wasn't satisfied
+	WriteConcernError *WriteConcernError
 }
 
 func (u UpdateResponse) ToBytes(header MsgHeader) ([]byte, error) {
@@ -261,20 +381,31 @@ func (u UpdateResponse) ToBSON() bson.M {
 	if u.Upserted != nil && len(u.Upserted) > 0 {
 		r["upserted"] = u.Upserted
 	}
-	if u.WriteErrors != nil && len(u.WriteErrors) > 0 {
-		r["writeErrors"] = u.WriteErrors
+	if len(u.WriteErrors) > 0 {
+		r["writeErrors"] = writeErrorsToBSON(u.WriteErrors)
+	}
+	if u.WriteConcernError != nil {
+		r["writeConcernError"] = u.WriteConcernError.ToBSON()
 	}
 
 	return r
 }
 
+// Results returns the result of each statement of the update the response is for.
+func (u UpdateResponse) Results(update Update) []WriteResult {
+	return WriteResults(len(update.Updates), update.Ordered, u.WriteErrors)
+}
+
 // A struct that represents a response to a delete command.
 type DeleteResponse struct {
 	// the number of documents deleted. Not exported on a negative value.
 	N int32
 
 	// a list of write errors that occurred while deleting
-	WriteErrors []bson.M
+	WriteErrors []WriteError
+
+	// set if the write concern of the delete wasn't satisfied
+	WriteConcernError *WriteConcernError
 }
 
 func (d DeleteResponse) ToBytes(header MsgHeader) ([]byte, error) {
@@ -288,9 +419,47 @@ func (d DeleteResponse) ToBSON() bson.M {
 	if d.N >= 0 {
 		r["n"] = d.N
 	}
-	if d.WriteErrors != nil && len(d.WriteErrors) > 0 {
-		r["writeErrors"] = d.WriteErrors
+	if len(d.WriteErrors) > 0 {
+		r["writeErrors"] = writeErrorsToBSON(d.WriteErrors)
+	}
+	if d.WriteConcernError != nil {
+		r["writeConcernError"] = d.WriteConcernError.ToBSON()
 	}
 
 	return r
 }
+
+// Results returns the result of each statement of the delete the response is for.
+func (d DeleteResponse) Results(del Delete) []WriteResult {
+	return WriteResults(len(del.Deletes), del.Ordered, d.WriteErrors)
+}
+
+// A struct that represents a response to a killCursors command.
+type KillCursorsResponse struct {
+	CursorsKilled   []int64
+	CursorsNotFound []int64
+	CursorsAlive    []int64
+	CursorsUnknown  []int64
+}
+
+func (k KillCursorsResponse) ToBytes(header MsgHeader) ([]byte, error) {
+	b := k.ToBSON()
+	b["ok"] = 1
+	return EncodeBSON(header, b)
+}
+
+func (k KillCursorsResponse) ToBSON() bson.M {
+	nonNil := func(ids []int64) []int64 {
+		if ids == nil {
+			return make([]int64, 0)
+		}
+		return ids
+	}
+
+	return bson.M{
+		"cursorsKilled":   nonNil(k.CursorsKilled),
+		"cursorsNotFound": nonNil(k.CursorsNotFound),
+		"cursorsAlive":    nonNil(k.CursorsAlive),
+		"cursorsUnknown":  nonNil(k.CursorsUnknown),
+	}
+}
@@ -0,0 +1,104 @@
+package bi
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/WyattNielsen/mongoproxy/messages"
+	"github.com/WyattNielsen/mongoproxy/server"
+	"github.com/globalsign/mgo"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Config is the configuration document of a BIModule, which is described in the README.
+type Config struct {
+	Connection ConnectionConfig `config:"connection,required"`
+	Rules      []RuleConfig     `config:"rules"`
+}
+
+// ConnectionConfig describes the MongoDB instance that metrics are stored in.
+type ConnectionConfig struct {
+	Addresses []string      `config:"addresses,required"`
+	Direct    bool          `config:"direct"`
+	Timeout   time.Duration `config:"timeout" default:"10s"`
+	Auth      AuthConfig    `config:"auth"`
+}
+
+// AuthConfig holds the credentials for the metrics connection.
+type AuthConfig struct {
+	Database string `config:"database"`
+	Username string `config:"username"`
+	Password string `config:"password"`
+}
+
+// RuleConfig is a rule as written in the configuration, before its namespaces are parsed.
+type RuleConfig struct {
+	Origin          string   `config:"origin,required"`
+	Prefix          string   `config:"prefix,required"`
+	TimeGranularity []string `config:"timeGranularity,required"`
+	ValueField      string   `config:"valueField,required"`
+	TimeField       string   `config:"timeField"`
+}
+
+// ParseConfig decodes and validates a bi configuration document.
+func ParseConfig(conf bson.M) (Config, error) {
+	var c Config
+	err := server.DecodeConfig(conf, &c)
+	if err != nil {
+		return c, err
+	}
+
+	errs := server.ConfigErrors{}
+	for i, r := range c.Rules {
+		path := fmt.Sprintf("rules[%v]", i)
+		if _, _, err := messages.ParseNamespace(r.Origin); err != nil {
+			errs = append(errs, &server.ConfigError{Path: path + ".origin", Message: err.Error()})
+		}
+		if _, _, err := messages.ParseNamespace(r.Prefix); err != nil {
+			errs = append(errs, &server.ConfigError{Path: path + ".prefix", Message: err.Error()})
+		}
+		for j, granularity := range r.TimeGranularity {
+			if _, err := GetSuffix(granularity); err != nil {
+				errs = append(errs, &server.ConfigError{
+					Path:    fmt.Sprintf("%v.timeGranularity[%v]", path, j),
+					Message: fmt.Sprintf("%v is not a valid time granularity", granularity)})
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return c, errs
+	}
+	return c, nil
+}
+
+// DialInfo returns the mgo dial info for the connection.
+func (c ConnectionConfig) DialInfo() mgo.DialInfo {
+	return mgo.DialInfo{
+		Addrs:    c.Addresses,
+		Direct:   c.Direct,
+		Timeout:  c.Timeout,
+		Database: c.Auth.Database,
+		Username: c.Auth.Username,
+		Password: c.Auth.Password,
+	}
+}
+
+// Rule returns the rule that the configuration describes. The configuration must
+// have been validated by ParseConfig.
+func (r RuleConfig) Rule() Rule {
+	originD, originC, _ := messages.ParseNamespace(r.Origin)
+	prefixD, prefixC, _ := messages.ParseNamespace(r.Prefix)
+	rule := Rule{
+		OriginDatabase:    originD,
+		OriginCollection:  originC,
+		PrefixDatabase:    prefixD,
+		PrefixCollection:  prefixC,
+		TimeGranularities: r.TimeGranularity,
+		ValueField:        r.ValueField,
+	}
+	if len(r.TimeField) > 0 {
+		timeField := r.TimeField
+		rule.TimeField = &timeField
+	}
+	return rule
+}
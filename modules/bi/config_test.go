@@ -0,0 +1,63 @@
+package bi
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestConfigure(t *testing.T) {
+	Convey("Configure a BI module", t, func() {
+		Convey("with a valid configuration", func() {
+			conf := bson.M{
+				"connection": bson.M{
+					"addresses": []interface{}{"localhost"},
+					"auth":      bson.M{"database": "test"},
+				},
+				"rules": []interface{}{
+					bson.M{
+						"origin":          "db.foo",
+						"prefix":          "db.foo-metrics",
+						"timeGranularity": []interface{}{"M", "D"},
+						"valueField":      "users",
+						"timeField":       "created",
+					},
+				},
+			}
+
+			b := BIModule{}
+			So(b.Configure(conf), ShouldBeNil)
+			So(b.Connection.Addrs, ShouldResemble, []string{"localhost"})
+			So(b.Connection.Database, ShouldEqual, "test")
+			So(b.Connection.Timeout, ShouldEqual, 10*time.Second)
+			So(len(b.Rules), ShouldEqual, 1)
+			So(b.Rules[0].OriginDatabase, ShouldEqual, "db")
+			So(b.Rules[0].PrefixCollection, ShouldEqual, "foo-metrics")
+			So(*b.Rules[0].TimeField, ShouldEqual, "created")
+		})
+
+		Convey("with an invalid configuration", func() {
+			conf := bson.M{
+				"connection": bson.M{"addresses": []interface{}{"localhost"}},
+				"rules": []interface{}{
+					bson.M{
+						"origin":          "foo",
+						"prefix":          "db.foo-metrics",
+						"timeGranularity": []interface{}{"M", "week"},
+						"valueField":      "users",
+					},
+				},
+			}
+
+			b := BIModule{}
+			err := b.Configure(conf)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "rules[0].origin")
+			So(err.Error(), ShouldContainSubstring, "rules[0].timeGranularity[1]")
+
+			So(b.Configure(nil), ShouldNotBeNil)
+		})
+	})
+}
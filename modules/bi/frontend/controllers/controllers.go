@@ -11,6 +11,7 @@ import (
 	"github.com/WyattNielsen/mongoproxy/modules/bi"
 	"github.com/gin-gonic/gin"
 	"github.com/globalsign/mgo"
+	log "github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson"
 )
 
@@ -363,13 +364,16 @@ func Setup(r *gin.Engine, config bson.M, baseDir string) error {
 	biConfig = config
 
 	if config != nil {
-		biModule.Configure(config)
+		err := biModule.Configure(config)
+		if err != nil {
+			log.Errorf("Invalid BI configuration: %v", err)
+			return err
+		}
 
 		// set up mongod connection
-		var err error
 		mongoSession, err = mgo.DialWithInfo(&biModule.Connection)
 		if err != nil {
-			Log(ERROR, "Error connecting to MongoDB: %v", err)
+			log.Errorf("Error connecting to MongoDB: %v", err)
 			return err
 		}
 
@@ -3,7 +3,7 @@
 package bi
 
 import (
-	"fmt"
+	"context"
 	"time"
 
 	"github.com/WyattNielsen/mongoproxy/bsonutil"
@@ -11,6 +11,7 @@ import (
 	"github.com/WyattNielsen/mongoproxy/messages"
 	"github.com/WyattNielsen/mongoproxy/server"
 	"github.com/globalsign/mgo"
+	log "github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson"
 )
 
@@ -35,128 +36,42 @@ func (b *BIModule) Name() string {
 	return "bi"
 }
 
-/*
-Configuration structure:
-{
-	connection: {
-		addresses: []string,
-		direct: boolean,
-		timeout: integer,
-		auth: {
-			username: string,
-			password: string,
-			database: string
-		}
-	}
-	rules: [
-		{
-			origin: string,
-			prefix: string,
-			timeGranularity: []string,
-			valueField: string,
-			timeField: string
-		}
-	]
-}
-*/
+// Configure configures the module from its configuration document, which is
+// described by Config and in the README.
 func (b *BIModule) Configure(conf bson.M) error {
-
-	conn := convert.ToBSONMap(conf["connection"])
-	if conn == nil {
-		return fmt.Errorf("No connection data")
-	}
-	addrs, err := convert.ConvertToStringSlice(conn["addresses"])
+	config, err := ParseConfig(conf)
 	if err != nil {
-		return fmt.Errorf("Invalid addresses: %v", err)
-	}
-
-	timeout := time.Duration(convert.ToInt64(conn["timeout"], -1))
-	if timeout == -1 {
-		timeout = time.Second * 10
-	}
-
-	dialInfo := mgo.DialInfo{
-		Addrs:   addrs,
-		Direct:  convert.ToBool(conn["direct"]),
-		Timeout: timeout,
+		return err
 	}
 
-	auth := convert.ToBSONMap(conn["auth"])
-	if auth != nil {
-		username, ok := auth["username"].(string)
-		if ok {
-			dialInfo.Username = username
-		}
-		password, ok := auth["password"].(string)
-		if ok {
-			dialInfo.Password = password
-		}
-		database, ok := auth["database"].(string)
-		if ok {
-			dialInfo.Database = database
-		}
+	b.Connection = config.Connection.DialInfo()
+	b.Rules = make([]Rule, len(config.Rules))
+	for i, r := range config.Rules {
+		b.Rules[i] = r.Rule()
 	}
 
-	b.Connection = dialInfo
-
-	// Rules
-	b.Rules = make([]Rule, 0)
-	rules, err := convert.ConvertToBSONMapSlice(conf["rules"])
-	if err != nil {
-		return fmt.Errorf("Error parsing rules: %v", err)
-	}
-
-	for i := 0; i < len(rules); i++ {
-		r := rules[i]
-		originD, originC, err := messages.ParseNamespace(convert.ToString(r["origin"]))
-		if err != nil {
-			return fmt.Errorf("Error parsing origin namespace: %v", err)
-		}
-		prefixD, prefixC, err := messages.ParseNamespace(convert.ToString(r["prefix"]))
-		if err != nil {
-			return fmt.Errorf("Error parsing prefix namespace: %v", err)
-		}
-		timeGranularities, err := convert.ConvertToStringSlice(r["timeGranularity"])
-		if err != nil {
-			return fmt.Errorf("Error parsing time granularities: %v", err)
-		}
-		valueField, ok := r["valueField"].(string)
-		if !ok {
-			return fmt.Errorf("Invalid valueField.")
-		}
-		rule := Rule{
-			OriginDatabase:    originD,
-			OriginCollection:  originC,
-			PrefixDatabase:    prefixD,
-			PrefixCollection:  prefixC,
-			TimeGranularities: timeGranularities,
-			ValueField:        valueField,
-		}
-		timeFieldRaw, ok := r["timeField"].(string)
-		if ok {
-			if len(timeFieldRaw) > 0 {
-				rule.TimeField = &timeFieldRaw
-
-			}
-
-		}
+	return nil
+}
 
-		b.Rules = append(b.Rules, rule)
+// Close closes the module's session with the metrics database, once the proxy
+// has shut down.
+func (b *BIModule) Close(ctx context.Context) error {
+	if b.mongoSession != nil {
+		b.mongoSession.Close()
 	}
-
 	return nil
 }
 
-func (b *BIModule) Process(req messages.Requester, res messages.Responder,
-	next server.PipelineFunc) {
+func (b *BIModule) Process(ctx server.Context, req messages.Requester,
+	res messages.Responder, next server.PipelineFunc) {
 
 	resNext := messages.ModuleResponse{}
-	next(req, &resNext)
+	next(ctx, req, &resNext)
 
 	res.Write(resNext.Writer)
 
 	if resNext.CommandError != nil {
-		res.Error(resNext.CommandError.ErrorCode, resNext.CommandError.Message)
+		res.Fail(resNext.CommandError)
 		return // we're done. An error occured, so we shouldn't do any aggregating
 	}
 
@@ -165,7 +80,7 @@ func (b *BIModule) Process(req messages.Requester, res messages.Responder,
 		var err error
 		b.mongoSession, err = mgo.DialWithInfo(&b.Connection)
 		if err != nil {
-			Log(ERROR, "Error connecting to MongoDB: %v", err)
+			log.Errorf("Error connecting to MongoDB: %v", err)
 			return
 		}
 		b.mongoSession.SetPrefetch(0)
@@ -180,6 +95,13 @@ func (b *BIModule) Process(req messages.Requester, res messages.Responder,
 		// create metrics
 		opi := req.(messages.Insert)
 
+		// only the documents that were actually inserted count. An unordered insert
+		// carries on past documents that fail, and an ordered one stops at the first.
+		var results []messages.WriteResult
+		if insertResponse, ok := resNext.Writer.(messages.InsertResponse); ok {
+			results = insertResponse.Results(opi)
+		}
+
 		for i := 0; i < len(b.Rules); i++ {
 			rule := b.Rules[i]
 
@@ -189,7 +111,7 @@ func (b *BIModule) Process(req messages.Requester, res messages.Responder,
 			// and pass it on to mongod
 			if opi.Collection != rule.OriginCollection ||
 				opi.Database != rule.OriginDatabase {
-				Log(DEBUG, "Didn't match database %v.%v. Was %v.%v", rule.OriginDatabase,
+				log.Debugf("Didn't match database %v.%v. Was %v.%v", rule.OriginDatabase,
 					rule.OriginCollection, opi.Database, opi.Collection)
 				continue
 			}
@@ -199,11 +121,15 @@ func (b *BIModule) Process(req messages.Requester, res messages.Responder,
 				granularity := rule.TimeGranularities[j]
 				suffix, err := GetSuffix(granularity)
 				if err != nil {
-					Log(INFO, "%v is not a time granularity", granularity)
+					log.Infof("%v is not a time granularity", granularity)
 					continue
 				}
 
 				for k := 0; k < len(opi.Documents); k++ {
+					if results != nil && !results[k].Succeeded() {
+						log.Debugf("Skipping document %v, which wasn't inserted", k)
+						continue
+					}
 
 					update := messages.Update{
 						Database:   rule.PrefixDatabase,
@@ -268,9 +194,9 @@ func (b *BIModule) Process(req messages.Requester, res messages.Responder,
 			reply := bson.D{}
 			err := session.DB(u.Database).Run(b, &reply)
 			if err != nil {
-				Log(ERROR, "Error updating database: %v", err)
+				log.Errorf("Error updating database: %v", err)
 			} else {
-				Log(INFO, "Successfully updated database!")
+				log.Infof("Successfully updated database!")
 			}
 		}
 
@@ -78,8 +78,8 @@ func createUpdate(t time.Time, granularity string, value float64) (bson.D, error
 
 	timeField := strconv.Itoa(M)
 
-	totalUpdate := bson.DocElem{"$inc", bson.D{{"total", value}}}
-	fieldUpdate := bson.DocElem{"$inc", bson.D{{granularityField + "." + timeField, value}}}
+	totalUpdate := bson.E{Key: "$inc", Value: bson.D{{Key: "total", Value: value}}}
+	fieldUpdate := bson.E{Key: "$inc", Value: bson.D{{Key: granularityField + "." + timeField, Value: value}}}
 
 	doc := bson.D{
 		totalUpdate, fieldUpdate,
@@ -6,12 +6,13 @@ import (
 
 	"github.com/WyattNielsen/mongoproxy/convert"
 	"github.com/WyattNielsen/mongoproxy/messages"
+	log "github.com/sirupsen/logrus"
 	. "github.com/smartystreets/goconvey/convey"
 	"go.mongodb.org/mongo-driver/bson"
 )
 
 func TestCreateSelector(t *testing.T) {
-	SetLogLevel(DEBUG)
+	log.SetLevel(log.DebugLevel)
 
 	Convey("Create a selector", t, func() {
 		Convey("for a monthly metric", func() {
@@ -112,7 +113,7 @@ func TestCreateSelector(t *testing.T) {
 }
 
 func TestCreateUpdate(t *testing.T) {
-	SetLogLevel(DEBUG)
+	log.SetLevel(log.DebugLevel)
 
 	// NOTE: all of these fail for some reason, even though the actual / expected are identical
 	// in every way. Goconvey complains of type mismatch between bson.D and bson.D (?!)
@@ -3,11 +3,16 @@
 package mockule
 
 import (
+	"fmt"
 	"math/rand"
 	"strconv"
+	"sync"
+	"time"
 
+	"github.com/WyattNielsen/mongoproxy/bsonutil"
 	"github.com/WyattNielsen/mongoproxy/messages"
 	"github.com/WyattNielsen/mongoproxy/server"
+	log "github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson"
 )
 
@@ -17,6 +22,32 @@ var maxWireVersion = 3
 // have an array of bson documents.
 var database = make(map[string][]bson.D)
 
+// fake cursors for finds that returned more than one batch. The keys are
+// the cursor IDs, which have the documents that are left to return.
+var cursors = make(map[int64][]bson.D)
+var cursorsMutex sync.Mutex
+var nextCursorID = int64(100)
+
+// takeBatch splits off the first batchSize documents of docs, or all of them
+// if batchSize is 0, returning the batch and the documents left over.
+func takeBatch(docs []bson.D, batchSize int32) ([]bson.D, []bson.D) {
+	if batchSize <= 0 || int(batchSize) >= len(docs) {
+		return docs, nil
+	}
+	return docs[:batchSize], docs[batchSize:]
+}
+
+// registerCursor holds on to docs in a new fake cursor, and returns its ID.
+func registerCursor(docs []bson.D) int64 {
+	cursorsMutex.Lock()
+	defer cursorsMutex.Unlock()
+
+	id := nextCursorID
+	cursors[id] = docs
+	nextCursorID++
+	return id
+}
+
 // The Mockule is a mock module used for testing. It currently
 // logs requests and sends valid but generally nonsense responses back to
 // the client, without touching mongod.
@@ -35,12 +66,13 @@ func (m Mockule) Name() string {
 	return "mockule"
 }
 
-func (m Mockule) Configure(bson.M) error {
-	return nil
+// Configure checks that the configuration is empty, since the mockule has no settings.
+func (m Mockule) Configure(conf bson.M) error {
+	return server.DecodeConfig(conf, &struct{}{})
 }
 
-func (m Mockule) Process(req messages.Requester, res messages.Responder,
-	next server.PipelineFunc) {
+func (m Mockule) Process(ctx server.Context, req messages.Requester,
+	res messages.Responder, next server.PipelineFunc) {
 
 	switch req.Type() {
 	case messages.FindType:
@@ -48,7 +80,7 @@ func (m Mockule) Process(req messages.Requester, res messages.Responder,
 		if err != nil {
 			break
 		}
-		Log(INFO, "%#v", opq)
+		log.Infof("%#v", opq)
 
 		// TODO: actually do something with the query
 
@@ -56,9 +88,16 @@ func (m Mockule) Process(req messages.Requester, res messages.Responder,
 		// the queries at the moment
 		r := messages.FindResponse{}
 		docs, ok := database[opq.Collection]
-		r.Documents = docs
 		if !ok {
-			r.Documents = make([]bson.D, 0)
+			docs = make([]bson.D, 0)
+		}
+
+		// hold on to the rest of the documents in a fake cursor if they
+		// don't fit in the first batch
+		batch, rest := takeBatch(docs, opq.BatchSize)
+		r.Documents = batch
+		if len(rest) > 0 && !opq.SingleBatch {
+			r.CursorID = registerCursor(rest)
 		}
 		r.Database = opq.Database
 		r.Collection = opq.Collection
@@ -68,22 +107,160 @@ func (m Mockule) Process(req messages.Requester, res messages.Responder,
 		if err != nil {
 			break
 		}
-		Log(INFO, "%#v", opg)
+		log.Infof("%#v", opg)
 		r := messages.GetMoreResponse{}
-		if opg.CursorID == int64(100) {
-			Log(NOTICE, "Retrieved valid getMore\n")
-		}
 		r.Database = opg.Database
 		r.Collection = opg.Collection
 		r.CursorID = opg.CursorID
-		r.Documents = make([]bson.D, 0)
+
+		cursorsMutex.Lock()
+		docs, ok := cursors[opg.CursorID]
+		if ok {
+			log.Infof("Retrieved valid getMore\n")
+			batch, rest := takeBatch(docs, opg.BatchSize)
+			r.Documents = batch
+			if len(rest) > 0 {
+				cursors[opg.CursorID] = rest
+			} else {
+				delete(cursors, opg.CursorID)
+				r.CursorID = 0
+			}
+		} else {
+			r.InvalidCursor = true
+		}
+		cursorsMutex.Unlock()
 		res.Write(r)
+	case messages.KillCursorsType:
+		opk, err := messages.ToKillCursorsRequest(req)
+		if err != nil {
+			break
+		}
+		log.Infof("%#v", opk)
+
+		r := messages.KillCursorsResponse{}
+		cursorsMutex.Lock()
+		for _, id := range opk.CursorID {
+			_, ok := cursors[id]
+			if ok {
+				delete(cursors, id)
+				r.CursorsKilled = append(r.CursorsKilled, id)
+			} else {
+				r.CursorsNotFound = append(r.CursorsNotFound, id)
+			}
+		}
+		cursorsMutex.Unlock()
+		res.Write(r)
+	case messages.AggregateType:
+		opa, err := messages.ToAggregateRequest(req)
+		if err != nil {
+			break
+		}
+		log.Infof("%#v", opa)
+
+		if opa.Explain {
+			reply := messages.CommandResponse{}
+			reply.Reply = bson.M{"stages": opa.Pipeline}
+			res.Write(reply)
+			break
+		}
+
+		// like finds, aggregates ignore the pipeline and return the whole collection
+		r := messages.AggregateResponse{}
+		batch, rest := takeBatch(database[opa.Collection], opa.BatchSize)
+		r.Documents = batch
+		if len(rest) > 0 {
+			r.CursorID = registerCursor(rest)
+		}
+		r.Database = opa.Database
+		r.Collection = opa.Namespace()
+		res.Write(r)
+	case messages.CountType:
+		opc, err := messages.ToCountRequest(req)
+		if err != nil {
+			break
+		}
+		log.Infof("%#v", opc)
+
+		n := int64(len(database[opc.Collection])) - opc.Skip
+		if n < 0 {
+			n = 0
+		}
+		if opc.Limit != 0 && n > opc.Limit {
+			n = opc.Limit
+		}
+
+		reply := messages.CommandResponse{}
+		reply.Reply = bson.M{"n": n}
+		res.Write(reply)
+	case messages.DistinctType:
+		opd, err := messages.ToDistinctRequest(req)
+		if err != nil {
+			break
+		}
+		log.Infof("%#v", opd)
+
+		values := make([]interface{}, 0)
+		seen := make(map[string]bool)
+		for _, doc := range database[opd.Collection] {
+			value := bsonutil.FindValueByKey(opd.Key, doc)
+			key := fmt.Sprintf("%#v", value)
+			if value != nil && !seen[key] {
+				seen[key] = true
+				values = append(values, value)
+			}
+		}
+
+		reply := messages.CommandResponse{}
+		reply.Reply = bson.M{"values": values}
+		res.Write(reply)
+	case messages.FindAndModifyType:
+		opf, err := messages.ToFindAndModifyRequest(req)
+		if err != nil {
+			break
+		}
+		log.Infof("%#v", opf)
+
+		// the first document in the collection always matches, and updates
+		// aren't applied to it
+		var value interface{}
+		n := 0
+		docs := database[opf.Collection]
+		if len(docs) > 0 {
+			value = docs[0]
+			n = 1
+			if opf.Remove {
+				database[opf.Collection] = docs[1:]
+			}
+		}
+
+		lastErrorObject := bson.M{"n": n}
+		if !opf.Remove {
+			lastErrorObject["updatedExisting"] = n > 0
+		}
+
+		reply := messages.CommandResponse{}
+		reply.Reply = bson.M{"lastErrorObject": lastErrorObject, "value": value}
+		res.Write(reply)
+	case messages.CreateIndexesType:
+		opc, err := messages.ToCreateIndexesRequest(req)
+		if err != nil {
+			break
+		}
+		log.Infof("%#v", opc)
+
+		reply := messages.CommandResponse{}
+		reply.Reply = bson.M{
+			"createdCollectionAutomatically": false,
+			"numIndexesBefore":               1,
+			"numIndexesAfter":                1 + len(opc.Indexes),
+		}
+		res.Write(reply)
 	case messages.InsertType:
 		opi, err := messages.ToInsertRequest(req)
 		if err != nil {
 			break
 		}
-		Log(INFO, "%#v", opi)
+		log.Infof("%#v", opi)
 
 		// insert documents into the 'database'
 		for doc := range opi.Documents {
@@ -104,7 +281,7 @@ func (m Mockule) Process(req messages.Requester, res messages.Responder,
 			break
 		}
 		r := messages.UpdateResponse{}
-		Log(INFO, "%#v", opu)
+		log.Infof("%#v", opu)
 		r.N = 5
 		r.NModified = 4
 
@@ -114,7 +291,7 @@ func (m Mockule) Process(req messages.Requester, res messages.Responder,
 		if err != nil {
 			break
 		}
-		Log(INFO, "%#v", opd)
+		log.Infof("%#v", opd)
 		r := messages.DeleteResponse{}
 		r.N = 1
 
@@ -124,7 +301,7 @@ func (m Mockule) Process(req messages.Requester, res messages.Responder,
 		if err != nil {
 			break
 		}
-		Log(INFO, "%#v", command)
+		log.Infof("%#v", command)
 
 		switch command.CommandName {
 		case "ismaster":
@@ -133,7 +310,7 @@ func (m Mockule) Process(req messages.Requester, res messages.Responder,
 			r := bson.M{}
 			r["ismaster"] = true
 			r["secondary"] = false
-			r["localTime"] = bson.Now()
+			r["localTime"] = time.Now()
 			r["maxWireVersion"] = maxWireVersion
 			r["minWireVersion"] = 0
 			r["maxWriteBatchSize"] = 1000
@@ -185,7 +362,7 @@ func (m Mockule) Process(req messages.Requester, res messages.Responder,
 		case "replSetGetStatus":
 			r := bson.M{}
 			r["set"] = "repl"
-			r["date"] = bson.Now()
+			r["date"] = time.Now()
 			r["myState"] = 1
 			members := make([]bson.M, 0)
 
@@ -209,5 +386,5 @@ func (m Mockule) Process(req messages.Requester, res messages.Responder,
 		reply.Reply = bson.M{"ok": 1}
 		res.Write(reply)
 	}
-	next(req, res)
+	next(ctx, req, res)
 }
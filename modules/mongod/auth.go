@@ -0,0 +1,325 @@
+package mongod
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/WyattNielsen/mongoproxy/convert"
+	"github.com/WyattNielsen/mongoproxy/messages"
+	"github.com/WyattNielsen/mongoproxy/server"
+	"github.com/xdg-go/scram"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// scramSHA256 is the only mechanism the proxy authenticates clients with itself.
+const scramSHA256 = "SCRAM-SHA-256"
+
+// A UserConfig is a user of the proxy, with the SCRAM-SHA-256 credentials of
+// its password. The credentials are those mongod keeps in system.users, so they
+// can be copied from a user there, and none of them reveal the password.
+type UserConfig struct {
+	User string `config:"user,required"`
+
+	// DB is the database the user authenticates against.
+	DB string `config:"db" default:"admin"`
+
+	IterationCount int `config:"iterationCount,required"`
+
+	// Salt, StoredKey and ServerKey are base64 encoded.
+	Salt      string `config:"salt,required"`
+	StoredKey string `config:"storedKey,required"`
+	ServerKey string `config:"serverKey,required"`
+
+	// Backend is the backend whose connection, and credentials, the requests of
+	// the user run with. If it is empty, they are routed like any other.
+	Backend string `config:"backend"`
+}
+
+// UsersFile is the file of the proxy's users.
+type UsersFile struct {
+	Users []UserConfig `config:"users"`
+}
+
+// ParseUsersFile reads and validates a JSON file of users.
+func ParseUsersFile(filename string) (UsersFile, error) {
+	var f UsersFile
+	var result bson.M
+
+	file, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return f, fmt.Errorf("Error reading users file: %v", err)
+	}
+	err = json.Unmarshal(file, &result)
+	if err != nil {
+		return f, fmt.Errorf("Invalid JSON users file: %v", err)
+	}
+
+	err = server.DecodeConfig(result, &f)
+	if err != nil {
+		return f, err
+	}
+
+	errs := server.ConfigErrors{}
+	seen := make(map[string]bool)
+	for i, u := range f.Users {
+		prefix := fmt.Sprintf("users[%v]", i)
+		if seen[userKey(u.DB, u.User)] {
+			errs = append(errs, &server.ConfigError{Path: prefix + ".user",
+				Message: fmt.Sprintf("%v.%v is already a user", u.DB, u.User)})
+		}
+		seen[userKey(u.DB, u.User)] = true
+		for key, value := range map[string]string{"salt": u.Salt, "storedKey": u.StoredKey,
+			"serverKey": u.ServerKey} {
+			if _, err := base64.StdEncoding.DecodeString(value); err != nil {
+				errs = append(errs, &server.ConfigError{Path: prefix + "." + key,
+					Message: "is not base64"})
+			}
+		}
+		if u.IterationCount < 4096 {
+			errs = append(errs, &server.ConfigError{Path: prefix + ".iterationCount",
+				Message: "must be at least 4096"})
+		}
+	}
+
+	if len(errs) > 0 {
+		return f, errs
+	}
+	return f, nil
+}
+
+// A localUser is a user the proxy authenticates clients as.
+type localUser struct {
+	name        string
+	db          string
+	credentials scram.StoredCredentials
+	backend     string
+}
+
+func newLocalUser(config UserConfig) *localUser {
+	// the file has been validated
+	salt, _ := base64.StdEncoding.DecodeString(config.Salt)
+	storedKey, _ := base64.StdEncoding.DecodeString(config.StoredKey)
+	serverKey, _ := base64.StdEncoding.DecodeString(config.ServerKey)
+	return &localUser{
+		name: config.User,
+		db:   config.DB,
+		credentials: scram.StoredCredentials{
+			KeyFactors: scram.KeyFactors{Salt: string(salt), Iters: config.IterationCount},
+			StoredKey:  storedKey,
+			ServerKey:  serverKey,
+		},
+		backend: config.Backend,
+	}
+}
+
+// userKey returns the key of a user of a database.
+func userKey(db string, user string) string {
+	return db + "." + user
+}
+
+// A connAuth is the authentication state of a client connection.
+type connAuth struct {
+	// conversation is the SCRAM conversation in progress, if any, and
+	// verified is true once the client's proof was checked, and the client only
+	// has to acknowledge the server's. Clients that skip the empty exchange
+	// take the server's proof as the end of the conversation.
+	conversation      *scram.ServerConversation
+	conversationDB    string
+	skipEmptyExchange bool
+	verified          bool
+
+	// user is set once the client authenticated.
+	user *localUser
+}
+
+// An authRegistry holds the proxy's users, and the authentication state of the
+// client connections, keyed by their IDs, until they are closed.
+type authRegistry struct {
+	users map[string]*localUser
+
+	mu    sync.Mutex
+	conns map[int64]*connAuth
+}
+
+func newAuthRegistry(users []UserConfig) *authRegistry {
+	r := &authRegistry{
+		users: make(map[string]*localUser),
+		conns: make(map[int64]*connAuth),
+	}
+	for _, u := range users {
+		r.users[userKey(u.DB, u.User)] = newLocalUser(u)
+	}
+	return r
+}
+
+// userOf returns the user a client connection authenticated as, or nil.
+func (r *authRegistry) userOf(id int64) *localUser {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	a, ok := r.conns[id]
+	if !ok {
+		return nil
+	}
+	return a.user
+}
+
+// state returns the authentication state of a client connection, creating it
+// if the connection is new. It is called with the registry locked.
+func (r *authRegistry) state(ctx server.Context) *connAuth {
+	a, ok := r.conns[ctx.Conn.ID]
+	if !ok {
+		a = &connAuth{}
+		r.conns[ctx.Conn.ID] = a
+		forgetOnClose(ctx, r.forget)
+	}
+	return a
+}
+
+// mechanisms returns the mechanisms a user can authenticate with, for the
+// saslSupportedMechs of handshakes, which is given as "db.user".
+func (r *authRegistry) mechanisms(name string) []string {
+	if _, ok := r.users[name]; !ok {
+		return nil
+	}
+	return []string{scramSHA256}
+}
+
+// authenticate runs a step of a client's SCRAM conversation, for a saslStart or
+// a saslContinue, and writes the reply to the response. A saslStart starts a new
+// conversation, as the connection's user if it is already authenticated. The
+// user is returned once the client's proof has been verified.
+func (r *authRegistry) authenticate(ctx server.Context, command messages.Command,
+	res messages.Responder) *localUser {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	a := r.state(ctx)
+
+	if command.CommandName == "saslStart" {
+		mechanism := convert.ToString(command.GetArg("mechanism"))
+		if mechanism != scramSHA256 {
+			res.Error(mechanismUnavailable,
+				fmt.Sprintf("Received authentication for mechanism %v which is not enabled",
+					mechanism))
+			return nil
+		}
+		db := command.Database
+		lookup := func(name string) (scram.StoredCredentials, error) {
+			u, ok := r.users[userKey(db, name)]
+			if !ok {
+				return scram.StoredCredentials{}, fmt.Errorf("unknown user")
+			}
+			return u.credentials, nil
+		}
+		scramServer, _ := scram.SHA256.NewServer(lookup)
+		a.conversation = scramServer.NewConversation()
+		a.conversationDB = db
+		options := convert.ToBSONMap(command.GetArg("options"))
+		a.skipEmptyExchange = convert.ToBool(options["skipEmptyExchange"])
+		a.verified = false
+	} else if a.conversation == nil ||
+		convert.ToInt32(command.GetArg("conversationId")) != 1 {
+		res.Error(protocolError, "No SASL session state found")
+		return nil
+	}
+
+	if a.verified {
+		// the client acknowledged the server's proof
+		a.conversation = nil
+		writeSASLReply(res, true, nil)
+		return nil
+	}
+
+	response, err := a.conversation.Step(string(saslPayload(command.GetArg("payload"))))
+	if err != nil || (a.conversation.Done() && !a.conversation.Valid()) {
+		a.conversation = nil
+		res.Error(authenticationFailed, "Authentication failed.")
+		return nil
+	}
+	if !a.conversation.Done() {
+		writeSASLReply(res, false, []byte(response))
+		return nil
+	}
+
+	a.user = r.users[userKey(a.conversationDB, a.conversation.Username())]
+
+	if a.skipEmptyExchange {
+		a.conversation = nil
+		writeSASLReply(res, true, []byte(response))
+	} else {
+		a.verified = true
+		writeSASLReply(res, false, []byte(response))
+	}
+	return a.user
+}
+
+// forget ends the authentication of a client connection, when it logs out or
+// is closed.
+func (r *authRegistry) forget(id int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.conns, id)
+}
+
+// saslPayload returns the bytes of the payload of a SASL command, which clients
+// send as binary data or, in old drivers, as a string.
+func saslPayload(v interface{}) []byte {
+	switch t := v.(type) {
+	case primitive.Binary:
+		return t.Data
+	case []byte:
+		return t
+	case string:
+		return []byte(t)
+	}
+	return nil
+}
+
+// writeSASLReply writes the reply to a step of a SASL conversation.
+func writeSASLReply(res messages.Responder, done bool, payload []byte) {
+	if payload == nil {
+		payload = []byte{}
+	}
+	res.Write(messages.CommandResponse{Reply: bson.M{
+		"conversationId": int32(1),
+		"done":           done,
+		"payload":        primitive.Binary{Data: payload},
+	}})
+}
+
+// requiresAuth returns true if a request needs an authenticated connection. Only
+// the commands that clients send to connect and authenticate don't.
+func requiresAuth(req messages.Requester) bool {
+	command, ok := req.(messages.Command)
+	if !ok {
+		return true
+	}
+	if messages.IsHandshake(command.CommandName) {
+		return false
+	}
+	switch command.CommandName {
+	case "saslStart", "saslContinue", "logout", "buildInfo", "buildinfo", "ping":
+		return false
+	default:
+		return true
+	}
+}
+
+// unauthorizedError returns the error for a request on a connection that
+// hasn't authenticated.
+func unauthorizedError(req messages.Requester) *messages.ResponderError {
+	name := req.Type()
+	if command, ok := req.(messages.Command); ok {
+		name = command.CommandName
+	}
+	return &messages.ResponderError{
+		ErrorCode: unauthorized,
+		Message:   fmt.Sprintf("command %v requires authentication", name),
+	}
+}
@@ -0,0 +1,240 @@
+package mongod
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/WyattNielsen/mongoproxy/messages"
+	"github.com/WyattNielsen/mongoproxy/server"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xdg-go/scram"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// testUser returns the configuration of a user with the given password.
+func testUser(name string, password string) UserConfig {
+	client, err := scram.SHA256.NewClient(name, password, "")
+	So(err, ShouldBeNil)
+	credentials := client.GetStoredCredentials(scram.KeyFactors{Salt: "pepper", Iters: 4096})
+	return UserConfig{
+		User:           name,
+		DB:             "admin",
+		IterationCount: 4096,
+		Salt:           base64.StdEncoding.EncodeToString([]byte(credentials.Salt)),
+		StoredKey:      base64.StdEncoding.EncodeToString(credentials.StoredKey),
+		ServerKey:      base64.StdEncoding.EncodeToString(credentials.ServerKey),
+	}
+}
+
+// saslCommand returns a step of a SASL conversation, as a client sends it.
+func saslCommand(name string, payload string, args ...bson.E) messages.Command {
+	c := messages.Command{
+		CommandName: name,
+		Database:    "admin",
+		Args: bson.D{{Key: name, Value: 1}, {Key: "conversationId", Value: int32(1)},
+			{Key: "payload", Value: primitive.Binary{Data: []byte(payload)}}},
+	}
+	c.Args = append(c.Args, args...)
+	return c
+}
+
+// saslStep runs a step of a conversation, and returns the server's payload and
+// whether it is done, or the error the step failed with.
+func saslStep(r *authRegistry, ctx server.Context, command messages.Command) (string, bool,
+	*messages.ResponderError) {
+	res := &messages.ModuleResponse{}
+	r.authenticate(ctx, command, res)
+	if res.CommandError != nil {
+		return "", false, res.CommandError
+	}
+	reply := res.Writer.(messages.CommandResponse).Reply
+	return string(reply["payload"].(primitive.Binary).Data), reply["done"].(bool), nil
+}
+
+// login runs a client's whole SCRAM-SHA-256 conversation, and returns the error
+// of the step that failed, if any.
+func login(r *authRegistry, ctx server.Context, name string, password string,
+	skipEmptyExchange bool) *messages.ResponderError {
+	client, err := scram.SHA256.NewClient(name, password, "")
+	So(err, ShouldBeNil)
+	conversation := client.NewConversation()
+
+	first, err := conversation.Step("")
+	So(err, ShouldBeNil)
+	payload, done, rErr := saslStep(r, ctx, saslCommand("saslStart", first,
+		bson.E{Key: "mechanism", Value: scramSHA256},
+		bson.E{Key: "options", Value: bson.D{{Key: "skipEmptyExchange", Value: skipEmptyExchange}}}))
+	if rErr != nil {
+		return rErr
+	}
+	So(done, ShouldBeFalse)
+
+	final, err := conversation.Step(payload)
+	So(err, ShouldBeNil)
+	payload, done, rErr = saslStep(r, ctx, saslCommand("saslContinue", final))
+	if rErr != nil {
+		return rErr
+	}
+	_, err = conversation.Step(payload)
+	So(err, ShouldBeNil)
+	So(conversation.Valid(), ShouldBeTrue)
+	So(done, ShouldEqual, skipEmptyExchange)
+
+	if !done {
+		_, done, rErr = saslStep(r, ctx, saslCommand("saslContinue", ""))
+		So(rErr, ShouldBeNil)
+		So(done, ShouldBeTrue)
+	}
+	return nil
+}
+
+func TestParseUsersFile(t *testing.T) {
+	Convey("Read the proxy's users from a file", t, func() {
+		dir, err := ioutil.TempDir("", "mongoproxy")
+		So(err, ShouldBeNil)
+		Reset(func() {
+			os.RemoveAll(dir)
+		})
+		write := func(contents string) string {
+			filename := filepath.Join(dir, "users.json")
+			So(ioutil.WriteFile(filename, []byte(contents), 0600), ShouldBeNil)
+			return filename
+		}
+		user := `{"user": "%v", "db": "%v", "iterationCount": %v, "salt": "%v",
+			"storedKey": "c3RvcmVk", "serverKey": "c2VydmVy"}`
+
+		Convey("that is valid", func() {
+			f, err := ParseUsersFile(write(`{"users": [` +
+				fmt.Sprintf(user, "analyst", "admin", 4096, "cGVwcGVy") + `,` +
+				fmt.Sprintf(user, "analyst", "reports", 15000, "cGVwcGVy") + `]}`))
+			So(err, ShouldBeNil)
+			So(len(f.Users), ShouldEqual, 2)
+			So(f.Users[1].DB, ShouldEqual, "reports")
+		})
+
+		Convey("with a user twice", func() {
+			_, err := ParseUsersFile(write(`{"users": [` +
+				fmt.Sprintf(user, "analyst", "admin", 4096, "cGVwcGVy") + `,` +
+				fmt.Sprintf(user, "analyst", "admin", 4096, "cGVwcGVy") + `]}`))
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "users[1].user")
+		})
+
+		Convey("with credentials that aren't base64", func() {
+			_, err := ParseUsersFile(write(`{"users": [` +
+				fmt.Sprintf(user, "analyst", "admin", 4096, "not base64!") + `]}`))
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "users[0].salt")
+		})
+
+		Convey("with too few iterations", func() {
+			_, err := ParseUsersFile(write(`{"users": [` +
+				fmt.Sprintf(user, "analyst", "admin", 1000, "cGVwcGVy") + `]}`))
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "users[0].iterationCount")
+		})
+	})
+}
+
+func TestAuthenticate(t *testing.T) {
+	Convey("Authenticate clients as the proxy's users", t, func() {
+		r := newAuthRegistry([]UserConfig{testUser("analyst", "s3cret")})
+		ctx := server.NewContext(context.Background(), server.NewConn(1, nil))
+
+		Convey("with the right password", func() {
+			So(login(r, ctx, "analyst", "s3cret", false), ShouldBeNil)
+			So(r.userOf(1), ShouldNotBeNil)
+			So(r.userOf(1).name, ShouldEqual, "analyst")
+		})
+
+		Convey("skipping the empty exchange", func() {
+			So(login(r, ctx, "analyst", "s3cret", true), ShouldBeNil)
+			So(r.userOf(1), ShouldNotBeNil)
+		})
+
+		Convey("but not with a wrong password", func() {
+			err := login(r, ctx, "analyst", "guess", false)
+			So(err, ShouldNotBeNil)
+			So(err.ErrorCode, ShouldEqual, authenticationFailed)
+			So(r.userOf(1), ShouldBeNil)
+		})
+
+		Convey("but not as an unknown user", func() {
+			err := login(r, ctx, "intruder", "s3cret", false)
+			So(err, ShouldNotBeNil)
+			So(err.ErrorCode, ShouldEqual, authenticationFailed)
+			So(r.userOf(1), ShouldBeNil)
+		})
+
+		Convey("but not with a saslContinue without a saslStart", func() {
+			_, _, err := saslStep(r, ctx, saslCommand("saslContinue", "c=biws,r=nonce,p=proof"))
+			So(err, ShouldNotBeNil)
+			So(err.ErrorCode, ShouldEqual, protocolError)
+			So(r.userOf(1), ShouldBeNil)
+		})
+
+		Convey("but not with another mechanism", func() {
+			_, _, err := saslStep(r, ctx, saslCommand("saslStart", "",
+				bson.E{Key: "mechanism", Value: "SCRAM-SHA-1"}))
+			So(err, ShouldNotBeNil)
+			So(err.ErrorCode, ShouldEqual, mechanismUnavailable)
+		})
+
+		Convey("until they log out", func() {
+			So(login(r, ctx, "analyst", "s3cret", false), ShouldBeNil)
+			r.forget(1)
+			So(r.userOf(1), ShouldBeNil)
+		})
+	})
+}
+
+func TestRequireAuth(t *testing.T) {
+	Convey("Only let authenticated clients through", t, func() {
+		So(requiresAuth(messages.Command{CommandName: "hello"}), ShouldBeFalse)
+		So(requiresAuth(messages.Command{CommandName: "saslStart"}), ShouldBeFalse)
+		So(requiresAuth(messages.Command{CommandName: "ping"}), ShouldBeFalse)
+		So(requiresAuth(messages.Command{CommandName: "listDatabases"}), ShouldBeTrue)
+		So(requiresAuth(messages.Find{Database: "shop", Collection: "orders"}), ShouldBeTrue)
+		So(requiresAuth(messages.Insert{Database: "shop", Collection: "orders"}), ShouldBeTrue)
+
+		m := &MongodModule{Logger: log.New()}
+		m.auth = newAuthRegistry([]UserConfig{testUser("analyst", "s3cret")})
+		ctx := server.NewContext(context.Background(), server.NewConn(1, nil))
+		process := func(req messages.Requester) *messages.ModuleResponse {
+			res := &messages.ModuleResponse{}
+			m.Process(ctx, req, res, func(server.Context, messages.Requester, messages.Responder) {})
+			return res
+		}
+
+		Convey("rejecting finds and writes from clients that haven't authenticated", func() {
+			for _, req := range []messages.Requester{
+				messages.Find{Database: "shop", Collection: "orders"},
+				messages.Insert{Database: "shop", Collection: "orders",
+					Documents: []bson.D{{{Key: "total", Value: 12}}}},
+				messages.Command{CommandName: "listDatabases", Database: "admin"},
+			} {
+				res := process(req)
+				So(res.CommandError, ShouldNotBeNil)
+				So(res.CommandError.ErrorCode, ShouldEqual, unauthorized)
+				So(res.Writer, ShouldBeNil)
+			}
+		})
+
+		Convey("and logging them out", func() {
+			So(login(m.auth, ctx, "analyst", "s3cret", false), ShouldBeNil)
+			res := process(messages.Command{CommandName: "logout", Database: "admin"})
+			So(res.CommandError, ShouldBeNil)
+			So(m.auth.userOf(1), ShouldBeNil)
+
+			res = process(messages.Find{Database: "shop", Collection: "orders"})
+			So(res.CommandError.ErrorCode, ShouldEqual, unauthorized)
+		})
+	})
+}
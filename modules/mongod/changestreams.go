@@ -0,0 +1,140 @@
+package mongod
+
+import (
+	"context"
+
+	"github.com/WyattNielsen/mongoproxy/messages"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// A changeStream is the backend cursor of a $changeStream aggregate. Unlike other
+// cursors, it isn't read through the driver. Its batches are passed through as
+// the backend returns them, so that each one comes with the backend's
+// postBatchResumeToken, which clients resume from.
+type changeStream struct {
+	database   *mongo.Database
+	collection string
+
+	// readPref is the read preference of the aggregate, which its getMores
+	// follow as well, or nil for the primary.
+	readPref *readpref.ReadPref
+
+	// session is the session the aggregate ran in, which the backend requires
+	// its getMores to run in as well. It is the backend session of the client's
+	// session if it had one, or else one the stream started, and ends when it
+	// is closed.
+	session    mongo.Session
+	ownSession bool
+
+	// id is the backend's cursor ID, which is 0 once the backend closed the cursor.
+	id int64
+
+	// resumeToken is the postBatchResumeToken of the last batch, if any.
+	resumeToken bson.D
+}
+
+// changeStreamReply is the reply to a $changeStream aggregate, or to a getMore
+// on its cursor.
+type changeStreamReply struct {
+	Cursor struct {
+		ID                   int64    `bson:"id"`
+		FirstBatch           []bson.D `bson:"firstBatch"`
+		NextBatch            []bson.D `bson:"nextBatch"`
+		PostBatchResumeToken bson.D   `bson:"postBatchResumeToken"`
+	} `bson:"cursor"`
+}
+
+// openChangeStream runs a $changeStream aggregate, and returns its cursor and its
+// first batch. Any resumeAfter or startAfter token in the pipeline is passed on
+// unchanged. The aggregate runs in the session of ctx, if there is one, on a
+// member that rp allows.
+func openChangeStream(ctx context.Context, client *mongo.Client, a messages.Aggregate,
+	rp *readpref.ReadPref) (*changeStream, []bson.D, error) {
+
+	cs := &changeStream{
+		database:   client.Database(a.Database),
+		collection: a.Namespace(),
+		readPref:   rp,
+		session:    mongo.SessionFromContext(ctx),
+	}
+	if cs.session == nil {
+		session, err := client.StartSession()
+		if err != nil {
+			return nil, nil, err
+		}
+		cs.session = session
+		cs.ownSession = true
+	}
+
+	reply, err := cs.run(ctx, a.ToBSON())
+	if err != nil {
+		cs.endSession(ctx)
+		return nil, nil, err
+	}
+	return cs, reply.Cursor.FirstBatch, nil
+}
+
+// getMore returns the next batch of change events, waiting at the backend for
+// up to maxTimeMS, or the backend's default if it is 0.
+func (cs *changeStream) getMore(ctx context.Context, batchSize int32,
+	maxTimeMS int64) ([]bson.D, error) {
+
+	getMore := bson.D{{Key: "getMore", Value: cs.id}, {Key: "collection", Value: cs.collection}}
+	if batchSize > 0 {
+		getMore = append(getMore, bson.E{Key: "batchSize", Value: batchSize})
+	}
+	if maxTimeMS > 0 {
+		getMore = append(getMore, bson.E{Key: "maxTimeMS", Value: maxTimeMS})
+	}
+
+	reply, err := cs.run(ctx, getMore)
+	if err != nil {
+		return nil, err
+	}
+	return reply.Cursor.NextBatch, nil
+}
+
+// run runs a command for the stream in its session, and keeps track of the
+// cursor ID and resume token in the reply.
+func (cs *changeStream) run(ctx context.Context, command bson.D) (changeStreamReply, error) {
+	var reply changeStreamReply
+	sctx := mongo.NewSessionContext(ctx, cs.session)
+	opts := options.RunCmd()
+	if cs.readPref != nil {
+		opts.SetReadPreference(cs.readPref)
+	}
+	err := cs.database.RunCommand(sctx, command, opts).Decode(&reply)
+	if err != nil {
+		return reply, err
+	}
+	cs.id = reply.Cursor.ID
+	cs.resumeToken = reply.Cursor.PostBatchResumeToken
+	return reply, nil
+}
+
+// close kills the backend cursor if it is still open, and ends its session if
+// the stream started it.
+func (cs *changeStream) close(ctx context.Context) {
+	if cs.id != 0 {
+		killCursors := bson.D{{Key: "killCursors", Value: cs.collection}, {Key: "cursors", Value: bson.A{cs.id}}}
+		sctx := mongo.NewSessionContext(ctx, cs.session)
+		opts := options.RunCmd()
+		if cs.readPref != nil {
+			opts.SetReadPreference(cs.readPref)
+		}
+		cs.database.RunCommand(sctx, killCursors, opts)
+		cs.id = 0
+	}
+	cs.endSession(ctx)
+}
+
+// endSession ends the session of the stream, unless it is the client's, which
+// lives on until the client ends it.
+func (cs *changeStream) endSession(ctx context.Context) {
+	if cs.ownSession {
+		cs.session.EndSession(ctx)
+	}
+}
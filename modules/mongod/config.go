@@ -0,0 +1,263 @@
+package mongod
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/WyattNielsen/mongoproxy/server"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// Config describes the parameters needed to make a connection to a Mongo database.
+type Config struct {
+	Scheme    string        `config:"scheme" default:"mongodb"`
+	Addresses []string      `config:"addresses" default:"localhost:27017"`
+	TLS       bool          `config:"tls"`
+	Database  string        `config:"database"`
+	Username  string        `config:"username"`
+	Password  string        `config:"password"`
+	Timeout   time.Duration `config:"timeout" default:"20s"`
+	OptParams string        `config:"optParams"`
+	ReadOnly  bool          `config:"readonly"`
+
+	// ReadOnlyCode is the error code writes are rejected with in read-only mode.
+	ReadOnlyCode int32 `config:"readonlyCode" default:"10107"`
+
+	// CursorTimeout is how long a cursor can be idle before it is closed.
+	CursorTimeout time.Duration `config:"cursorTimeout" default:"10m"`
+
+	// Compressors are the compressors to negotiate on connections to the
+	// database, in order of preference.
+	Compressors []string `config:"compressors"`
+
+	// AuthPassthrough sends each client connection's requests, including its
+	// authentication, over a backend connection of its own.
+	AuthPassthrough bool `config:"authPassthrough"`
+
+	// UsersFile is a JSON file of users that the proxy authenticates clients as
+	// itself, see ParseUsersFile.
+	UsersFile string `config:"usersFile"`
+
+	// Backends are further databases that Routes send some namespaces to. The
+	// namespaces that no route matches go to the database above.
+	Backends []BackendConfig `config:"backends"`
+	Routes   []RouteConfig   `config:"routes"`
+
+	// ReadPreferences set the read preference of reads on the namespaces that
+	// match them, in place of the client's.
+	ReadPreferences []ReadPreferenceConfig `config:"readPreferences"`
+}
+
+// BackendConfig describes a backend that routes send namespaces to, and has the
+// connection parameters of Config.
+type BackendConfig struct {
+	Name        string        `config:"name,required"`
+	Scheme      string        `config:"scheme" default:"mongodb"`
+	Addresses   []string      `config:"addresses,required"`
+	TLS         bool          `config:"tls"`
+	Database    string        `config:"database"`
+	Username    string        `config:"username"`
+	Password    string        `config:"password"`
+	Timeout     time.Duration `config:"timeout" default:"20s"`
+	OptParams   string        `config:"optParams"`
+	Compressors []string      `config:"compressors"`
+}
+
+// A RouteConfig sends the namespaces that match its database and collection
+// patterns to a backend. Patterns are names, or globs such as "logs_*".
+type RouteConfig struct {
+	Database   string `config:"database,required"`
+	Collection string `config:"collection" default:"*"`
+
+	// Backend is the name of a backend, or "default" for the module's own.
+	Backend string `config:"backend,required"`
+}
+
+// envConfig maps the keys of the configuration to the environment variables
+// they are read from when the module has no configuration.
+var envConfig = map[string]string{
+	"scheme":          "MONGO_SCHEME",
+	"addresses":       "MONGO_ADDRESSES",
+	"username":        "MONGO_USERNAME",
+	"password":        "MONGO_PASSWORD",
+	"database":        "MONGO_DATABASE",
+	"optParams":       "MONGO_OPT_PARAMS",
+	"tls":             "MONGO_TLS",
+	"timeout":         "MONGOPROXY_TIMEOUT",
+	"readonly":        "MONGOPROXY_READONLY",
+	"readonlyCode":    "MONGOPROXY_READONLY_CODE",
+	"compressors":     "MONGO_COMPRESSORS",
+	"cursorTimeout":   "MONGOPROXY_CURSOR_TIMEOUT",
+	"authPassthrough": "MONGOPROXY_AUTH_PASSTHROUGH",
+	"usersFile":       "MONGOPROXY_USERS_FILE",
+}
+
+// configFromEnv builds a configuration document from the environment variables
+// that are set.
+func configFromEnv() bson.M {
+	conf := bson.M{}
+	for key, name := range envConfig {
+		if value := os.Getenv(name); value != "" {
+			conf[key] = value
+		}
+	}
+	return conf
+}
+
+// ParseConfig decodes and validates a mongod configuration document.
+func ParseConfig(conf bson.M) (Config, error) {
+	var c Config
+	err := server.DecodeConfig(conf, &c)
+	if err != nil {
+		return c, err
+	}
+
+	errs := server.ConfigErrors{}
+	if len(c.Addresses) == 0 {
+		errs = append(errs, &server.ConfigError{Path: "addresses", Message: "is empty"})
+	}
+	errs = append(errs, checkCompressors("compressors", c.Compressors)...)
+	if c.AuthPassthrough && c.Scheme != "mongodb" {
+		errs = append(errs, &server.ConfigError{Path: "authPassthrough",
+			Message: "needs the mongodb scheme, with the addresses of the servers"})
+	}
+	if c.AuthPassthrough {
+		// passthrough sends every request as it is to the module's own
+		// backend, so nothing may check or route it on the way
+		if c.UsersFile != "" {
+			errs = append(errs, &server.ConfigError{Path: "usersFile",
+				Message: "cannot be used with authPassthrough"})
+		}
+		if len(c.Backends) > 0 {
+			errs = append(errs, &server.ConfigError{Path: "backends",
+				Message: "cannot be used with authPassthrough"})
+		}
+		if len(c.Routes) > 0 {
+			errs = append(errs, &server.ConfigError{Path: "routes",
+				Message: "cannot be used with authPassthrough"})
+		}
+		if len(c.ReadPreferences) > 0 {
+			errs = append(errs, &server.ConfigError{Path: "readPreferences",
+				Message: "cannot be used with authPassthrough"})
+		}
+	}
+
+	names := map[string]bool{defaultBackend: true}
+	for i, b := range c.Backends {
+		prefix := fmt.Sprintf("backends[%v]", i)
+		if names[b.Name] {
+			errs = append(errs, &server.ConfigError{Path: prefix + ".name",
+				Message: fmt.Sprintf("%v is already a backend", b.Name)})
+		}
+		names[b.Name] = true
+		if len(b.Addresses) == 0 {
+			errs = append(errs, &server.ConfigError{Path: prefix + ".addresses", Message: "is empty"})
+		}
+		errs = append(errs, checkCompressors(prefix+".compressors", b.Compressors)...)
+	}
+	for i, r := range c.Routes {
+		prefix := fmt.Sprintf("routes[%v]", i)
+		if _, err := path.Match(r.Database, ""); err != nil {
+			errs = append(errs, &server.ConfigError{Path: prefix + ".database", Message: "bad pattern"})
+		}
+		if _, err := path.Match(r.Collection, ""); err != nil {
+			errs = append(errs, &server.ConfigError{Path: prefix + ".collection", Message: "bad pattern"})
+		}
+		if !names[r.Backend] {
+			errs = append(errs, &server.ConfigError{Path: prefix + ".backend",
+				Message: fmt.Sprintf("unknown backend %v", r.Backend)})
+		}
+	}
+
+	for i, p := range c.ReadPreferences {
+		prefix := fmt.Sprintf("readPreferences[%v]", i)
+		mode, err := readpref.ModeFromString(p.Mode)
+		if err != nil {
+			errs = append(errs, &server.ConfigError{Path: prefix + ".mode", Message: err.Error()})
+		}
+		if p.MaxStaleness != 0 && (mode == readpref.PrimaryMode || p.MaxStaleness < minMaxStaleness) {
+			errs = append(errs, &server.ConfigError{Path: prefix + ".maxStaleness",
+				Message: fmt.Sprintf("must be at least %v, and not used with primary", minMaxStaleness)})
+		}
+	}
+
+	if len(errs) > 0 {
+		return c, errs
+	}
+	return c, nil
+}
+
+// minMaxStaleness is the smallest maxStaleness the backend accepts.
+const minMaxStaleness = 90 * time.Second
+
+// A ReadPreferenceConfig sets the read preference of reads on the namespaces that
+// match its database and collection patterns, which are like those of routes.
+type ReadPreferenceConfig struct {
+	Database   string `config:"database,required"`
+	Collection string `config:"collection" default:"*"`
+	Mode       string `config:"mode,required"`
+
+	// MaxStaleness is how far behind the primary a secondary can be to be read
+	// from, or 0 for no limit.
+	MaxStaleness time.Duration `config:"maxStaleness"`
+}
+
+// checkCompressors returns an error for each compressor that isn't supported.
+func checkCompressors(key string, compressors []string) server.ConfigErrors {
+	errs := server.ConfigErrors{}
+	for i, compressor := range compressors {
+		switch compressor {
+		case "snappy", "zlib", "zstd":
+		default:
+			errs = append(errs, &server.ConfigError{Path: fmt.Sprintf("%v[%v]", key, i),
+				Message: fmt.Sprintf("unknown compressor %v", compressor)})
+		}
+	}
+	return errs
+}
+
+// AsConnectionString constructs a MongoDB connection string from a Config
+func (c *Config) AsConnectionString() string {
+	return connectionString(c.Scheme, c.Addresses, c.Database, c.Username, c.Password,
+		c.TLS, c.OptParams)
+}
+
+// AsConnectionString constructs a MongoDB connection string from a BackendConfig
+func (b *BackendConfig) AsConnectionString() string {
+	return connectionString(b.Scheme, b.Addresses, b.Database, b.Username, b.Password,
+		b.TLS, b.OptParams)
+}
+
+func connectionString(scheme string, addresses []string, database string, username string,
+	password string, tls bool, optParams string) string {
+	url := scheme + "://"
+
+	if username != "" {
+		url += username
+		if password != "" {
+			url += ":"
+			url += password
+		}
+		url += "@"
+	}
+	url += strings.Join(addresses, ",")
+	url += "/"
+	url += database
+
+	params := make([]string, 0)
+	if tls {
+		params = append(params, "tls=true")
+	}
+	if optParams != "" {
+		params = append(params, optParams)
+	}
+	if len(params) > 0 {
+		url += "?" + strings.Join(params, "&")
+	}
+
+	return url
+}
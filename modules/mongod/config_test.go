@@ -0,0 +1,78 @@
+package mongod
+
+import (
+	"testing"
+
+	"github.com/WyattNielsen/mongoproxy/server"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestParseConfig(t *testing.T) {
+	Convey("Parse a mongod configuration", t, func() {
+		Convey("with the defaults", func() {
+			c, err := ParseConfig(bson.M{})
+			So(err, ShouldBeNil)
+			So(c.Addresses, ShouldResemble, []string{"localhost:27017"})
+			So(c.AsConnectionString(), ShouldEqual, "mongodb://localhost:27017/")
+		})
+
+		Convey("with auth passthrough", func() {
+			_, err := ParseConfig(bson.M{"authPassthrough": true})
+			So(err, ShouldBeNil)
+		})
+
+		Convey("rejecting what auth passthrough would bypass", func() {
+			_, err := ParseConfig(bson.M{
+				"authPassthrough": true,
+				"usersFile":       "users.json",
+				"backends": []interface{}{
+					bson.M{"name": "archive", "addresses": []interface{}{"archive:27017"}},
+				},
+				"routes": []interface{}{
+					bson.M{"database": "archive", "backend": "archive"},
+				},
+				"readPreferences": []interface{}{
+					bson.M{"database": "reports", "mode": "secondary"},
+				},
+			})
+			So(err, ShouldHaveSameTypeAs, server.ConfigErrors{})
+
+			paths := []string{}
+			for _, e := range err.(server.ConfigErrors) {
+				So(e.Message, ShouldEqual, "cannot be used with authPassthrough")
+				paths = append(paths, e.Path)
+			}
+			So(paths, ShouldResemble, []string{"usersFile", "backends", "routes", "readPreferences"})
+		})
+	})
+}
+
+func TestPinnedTLSConfig(t *testing.T) {
+	Convey("Configure TLS for pinned connections like the driver's client", t, func() {
+		Convey("without TLS", func() {
+			config, err := pinnedTLSConfig("mongodb://db1:27017/", "db1:27017")
+			So(err, ShouldBeNil)
+			So(config, ShouldBeNil)
+		})
+
+		Convey("with TLS, verifying the address it dials", func() {
+			config, err := pinnedTLSConfig("mongodb://db1:27017,db2:27017/?tls=true", "db2:27017")
+			So(err, ShouldBeNil)
+			So(config, ShouldNotBeNil)
+			So(config.ServerName, ShouldEqual, "db2")
+			So(config.InsecureSkipVerify, ShouldBeFalse)
+		})
+
+		Convey("with the options of the connection string", func() {
+			config, err := pinnedTLSConfig("mongodb://db1:27017/?tls=true&tlsInsecure=true", "db1:27017")
+			So(err, ShouldBeNil)
+			So(config.InsecureSkipVerify, ShouldBeTrue)
+		})
+
+		Convey("failing on a CA file that can't be read", func() {
+			_, err := pinnedTLSConfig("mongodb://db1:27017/?tls=true&tlsCAFile=missing.pem", "db1:27017")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
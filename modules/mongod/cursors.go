@@ -0,0 +1,330 @@
+package mongod
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// DefaultCursorTimeout is how long a cursor can sit idle before it is closed,
+// matching the default of mongod.
+const DefaultCursorTimeout = 10 * time.Minute
+
+// DefaultMaxAwaitTime is how long a getMore on an awaitData cursor waits for new
+// documents when the client doesn't set maxTimeMS, matching the default of mongod.
+const DefaultMaxAwaitTime = time.Second
+
+// awaitPollInterval is how long each getMore the proxy sends for an awaitData
+// cursor waits at the backend. A client's getMore can wait longer than this,
+// in which case the proxy polls the backend until the client's wait is over.
+const awaitPollInterval = 100 * time.Millisecond
+
+// maxBatchBytes caps the total size of the documents in a single batch, leaving
+// room for the rest of the reply in a 16MB document.
+const maxBatchBytes = 16*1024*1024 - 16*1024
+
+// errCursorInUse is returned when a cursor is requested while another request
+// is still reading from it.
+var errCursorInUse = fmt.Errorf("cursor is in use")
+
+// A proxyCursor is a live driver cursor for a find or an aggregate that didn't
+// return all of its results in the first batch, or the cursor of a change stream.
+type proxyCursor struct {
+	id         int64
+	database   string
+	collection string
+	cursor     *mongo.Cursor
+
+	// owner is the user that opened the cursor, as "db.user", or empty if the
+	// client wasn't authenticated. Like mongod, only requests from the same
+	// user can read or kill it.
+	owner string
+
+	// stream is set instead of cursor for a change stream.
+	stream *changeStream
+
+	// noTimeout exempts the cursor from being closed when idle.
+	noTimeout bool
+
+	// tailable cursors stay open at the end of their results, waiting for new
+	// documents, and awaitData ones wait at the backend for a while before
+	// returning an empty batch.
+	tailable  bool
+	awaitData bool
+
+	// pending holds a document that was read from the driver cursor but didn't
+	// fit in the last batch.
+	pending bson.Raw
+
+	// done is true once the driver cursor has no more documents.
+	done bool
+
+	// killed is true if the cursor was killed while checked out, in which case
+	// it is closed when it is released.
+	killed bool
+
+	inUse    bool
+	lastUsed time.Time
+}
+
+// nextBatch reads the next batch of at most batchSize documents from the cursor.
+// If batchSize is 0, the batch ends with the documents the driver already has
+// buffered, so that batching follows the backend's. For a tailable cursor, the
+// batch also ends when the backend has no new documents, and may be empty.
+func (c *proxyCursor) nextBatch(ctx context.Context, batchSize int32) ([]bson.D, error) {
+	docs := make([]bson.D, 0)
+	size := 0
+	for batchSize <= 0 || len(docs) < int(batchSize) {
+		raw := c.pending
+		c.pending = nil
+		if raw == nil {
+			if len(docs) > 0 && batchSize <= 0 && c.cursor.RemainingBatchLength() == 0 {
+				break
+			}
+			if !c.advance(ctx) {
+				if err := c.cursor.Err(); err != nil {
+					return nil, err
+				}
+				// a tailable cursor with nothing new is still alive
+				if !c.tailable || c.cursor.ID() == 0 {
+					c.done = true
+				}
+				break
+			}
+			raw = append(bson.Raw{}, c.cursor.Current...)
+		}
+
+		if len(docs) > 0 && size+len(raw) > maxBatchBytes {
+			c.pending = raw
+			break
+		}
+
+		var doc bson.D
+		if err := bson.Unmarshal(raw, &doc); err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+		size += len(raw)
+	}
+	return docs, nil
+}
+
+// advance moves the driver cursor to its next document, returning false if there
+// isn't one. Tailable cursors don't block until a new document arrives, since
+// that could be forever.
+func (c *proxyCursor) advance(ctx context.Context) bool {
+	if c.tailable {
+		return c.cursor.TryNext(ctx)
+	}
+	return c.cursor.Next(ctx)
+}
+
+// awaitBatch reads the next batch like nextBatch, but if the cursor is an
+// awaitData cursor and the batch would be empty, it keeps polling the backend
+// for new documents until maxAwaitTime has passed.
+func (c *proxyCursor) awaitBatch(ctx context.Context, batchSize int32,
+	maxAwaitTime time.Duration) ([]bson.D, error) {
+	deadline := time.Now().Add(maxAwaitTime)
+	for {
+		docs, err := c.nextBatch(ctx, batchSize)
+		if err != nil || len(docs) > 0 || !c.awaitData || c.exhausted() ||
+			!time.Now().Before(deadline) {
+			return docs, err
+		}
+	}
+}
+
+// exhausted returns true if there are no documents left to read from the cursor.
+func (c *proxyCursor) exhausted() bool {
+	if c.stream != nil {
+		return c.stream.id == 0
+	}
+	if c.pending != nil {
+		return false
+	}
+	return c.done || (c.cursor.ID() == 0 && c.cursor.RemainingBatchLength() == 0)
+}
+
+// close closes the backend cursor.
+func (c *proxyCursor) close(ctx context.Context) {
+	if c.stream != nil {
+		c.stream.close(ctx)
+		return
+	}
+	c.cursor.Close(ctx)
+}
+
+// A cursorRegistry holds the live cursors of a MongodModule, keyed by cursor IDs
+// issued by the proxy. Clients only ever see the proxy's IDs, never the backend's.
+type cursorRegistry struct {
+	mu      sync.Mutex
+	cursors map[int64]*proxyCursor
+	ids     *rand.Rand
+	timeout time.Duration
+	stop    chan struct{}
+}
+
+func newCursorRegistry(timeout time.Duration) *cursorRegistry {
+	if timeout <= 0 {
+		timeout = DefaultCursorTimeout
+	}
+	return &cursorRegistry{
+		cursors: make(map[int64]*proxyCursor),
+		ids:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		timeout: timeout,
+		stop:    make(chan struct{}),
+	}
+}
+
+// add registers a cursor under a new proxy cursor ID, and returns the ID.
+func (r *cursorRegistry) add(c *proxyCursor) int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for {
+		id := r.ids.Int63()
+		if _, ok := r.cursors[id]; id != 0 && !ok {
+			c.id = id
+			break
+		}
+	}
+	c.lastUsed = time.Now()
+	r.cursors[c.id] = c
+	return c.id
+}
+
+// checkout returns the cursor with the given ID, and marks it as in use until
+// it is released. False is returned if there is no such cursor of the owner,
+// and an error if the cursor is already checked out.
+func (r *cursorRegistry) checkout(owner string, id int64) (*proxyCursor, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.cursors[id]
+	if !ok || c.owner != owner {
+		return nil, false, nil
+	}
+	if c.inUse {
+		return nil, true, errCursorInUse
+	}
+	c.inUse = true
+	return c, true, nil
+}
+
+// release returns a checked out cursor to the registry, or closes and removes
+// it if it has no documents left.
+func (r *cursorRegistry) release(ctx context.Context, c *proxyCursor) {
+	r.mu.Lock()
+	c.inUse = false
+	c.lastUsed = time.Now()
+	closing := c.killed || c.exhausted()
+	if closing {
+		delete(r.cursors, c.id)
+	}
+	r.mu.Unlock()
+
+	if closing {
+		c.close(ctx)
+	}
+}
+
+// kill closes and removes the cursors of the owner with the given IDs that
+// belong to the namespace database.collection, or to any namespace if database
+// is empty. It returns the IDs that were killed, and the IDs that weren't found.
+func (r *cursorRegistry) kill(ctx context.Context, owner string, database string,
+	collection string, ids []int64) ([]int64, []int64) {
+	killed := make([]int64, 0)
+	notFound := make([]int64, 0)
+	closing := make([]*proxyCursor, 0)
+
+	r.mu.Lock()
+	for _, id := range ids {
+		c, ok := r.cursors[id]
+		if ok && c.owner != owner {
+			ok = false
+		}
+		if ok && database != "" && (c.database != database || c.collection != collection) {
+			ok = false
+		}
+		if !ok {
+			notFound = append(notFound, id)
+			continue
+		}
+		delete(r.cursors, id)
+		killed = append(killed, id)
+		if c.inUse {
+			// the request using it closes it once it is done
+			c.killed = true
+		} else {
+			closing = append(closing, c)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, c := range closing {
+		c.close(ctx)
+	}
+	return killed, notFound
+}
+
+// reap closes and removes cursors that have been idle for longer than the timeout.
+func (r *cursorRegistry) reap(ctx context.Context, now time.Time) {
+	expired := make([]*proxyCursor, 0)
+
+	r.mu.Lock()
+	for id, c := range r.cursors {
+		if !c.inUse && !c.noTimeout && now.Sub(c.lastUsed) > r.timeout {
+			delete(r.cursors, id)
+			expired = append(expired, c)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, c := range expired {
+		c.close(ctx)
+	}
+}
+
+// close stops reaping cursors and closes every cursor that isn't in use, for
+// the module to shut down. Those in use are closed with the client.
+func (r *cursorRegistry) close(ctx context.Context) {
+	close(r.stop)
+
+	closing := make([]*proxyCursor, 0)
+	r.mu.Lock()
+	for id, c := range r.cursors {
+		if !c.inUse {
+			delete(r.cursors, id)
+			closing = append(closing, c)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, c := range closing {
+		c.close(ctx)
+	}
+}
+
+// run reaps idle cursors periodically until the registry is closed.
+func (r *cursorRegistry) run() {
+	interval := r.timeout / 10
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			r.reap(context.Background(), now)
+		case <-r.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package mongod
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCursorOwner(t *testing.T) {
+	Convey("Only let the user that opened a cursor use it", t, func() {
+		r := newCursorRegistry(0)
+		// a change stream cursor whose backend cursor is still open, so that
+		// releasing it doesn't close it
+		id := r.add(&proxyCursor{database: "shop", collection: "orders", owner: "shop.alice",
+			stream: &changeStream{id: 5}})
+
+		Convey("reading it as its owner", func() {
+			c, ok, err := r.checkout("shop.alice", id)
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+			So(c.id, ShouldEqual, id)
+			r.release(context.Background(), c)
+		})
+
+		Convey("not finding it for another user", func() {
+			_, ok, err := r.checkout("shop.bob", id)
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("not finding it for an unauthenticated client", func() {
+			_, ok, _ := r.checkout("", id)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("not killing it for another user", func() {
+			killed, notFound := r.kill(context.Background(), "shop.bob", "shop", "orders",
+				[]int64{id})
+			So(killed, ShouldBeEmpty)
+			So(notFound, ShouldResemble, []int64{id})
+
+			_, ok, _ := r.checkout("shop.alice", id)
+			So(ok, ShouldBeTrue)
+		})
+	})
+}
@@ -5,6 +5,10 @@ package mongod
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
 
 	"github.com/WyattNielsen/mongoproxy/bsonutil"
 	"github.com/WyattNielsen/mongoproxy/convert"
@@ -14,6 +18,7 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
 // A MongodModule takes the request, sends it to a mongod instance, and then
@@ -21,12 +26,47 @@ import (
 // the next module. It passes on requests unchanged.
 type MongodModule struct {
 	ConnectionString string
+	Addresses        []string
 	ReadOnly         bool
+	ReadOnlyCode     int32
+	AuthPassthrough  bool
+	Compressors      []string
+	Timeout          time.Duration
 	Logger           *log.Logger
 	Client           *mongo.Client
+
+	// clientMu guards connecting the Client, which happens on the first request
+	// of any connection.
+	clientMu sync.Mutex
+
+	// cursors holds the open cursors of finds that returned more than one batch.
+	cursors *cursorRegistry
+
+	// sessions maps the logical sessions of clients onto backend sessions.
+	sessions *sessionRegistry
+
+	// backends are the backends other than the module's own, by name, and routes
+	// send namespaces to them, in order.
+	backends map[string]*backend
+	routes   []route
+
+	// readPolicies set the read preference of reads on some namespaces.
+	readPolicies []readPolicy
+
+	// pinned holds the backend connections of client connections in auth
+	// passthrough.
+	pinned *pinnedRegistry
+
+	// auth holds the users the proxy authenticates clients as itself, if it
+	// has any, and which user each client connection authenticated as.
+	auth *authRegistry
+
+	// retrySupport remembers which backends support retryable writes.
+	retrySupport retrySupport
 }
 
 func init() {
+	server.Publish(&MongodModule{})
 }
 
 func (m *MongodModule) New() server.Module {
@@ -37,112 +77,636 @@ func (m *MongodModule) Name() string {
 	return "mongod"
 }
 
-func (m *MongodModule) Configure(config server.Config) error {
+// Configure configures the module from its configuration document, which is
+// described in the README, or from the environment if conf is nil.
+func (m *MongodModule) Configure(conf bson.M) error {
+	if conf == nil {
+		conf = configFromEnv()
+	}
+	config, err := ParseConfig(conf)
+	if err != nil {
+		return err
+	}
+
 	m.ConnectionString = config.AsConnectionString()
+	m.Addresses = config.Addresses
+	m.Timeout = config.Timeout
 
 	m.ReadOnly = config.ReadOnly
+	m.ReadOnlyCode = config.ReadOnlyCode
+	m.cursors = newCursorRegistry(config.CursorTimeout)
+	go m.cursors.run()
+	m.sessions = newSessionRegistry(DefaultSessionTimeout)
+	go m.sessions.run()
+	m.AuthPassthrough = config.AuthPassthrough
+	if m.AuthPassthrough {
+		m.pinned = newPinnedRegistry(m.dialPinned)
+	}
+	m.Compressors = config.Compressors
+	m.backends = make(map[string]*backend)
+	for _, b := range config.Backends {
+		m.backends[b.Name] = newBackend(b)
+	}
+	if config.UsersFile != "" {
+		users, err := ParseUsersFile(config.UsersFile)
+		if err != nil {
+			return fmt.Errorf("Error in users file %v: %v", config.UsersFile, err)
+		}
+		for i, u := range users.Users {
+			if _, ok := m.backends[u.Backend]; !ok && u.Backend != "" && u.Backend != defaultBackend {
+				return fmt.Errorf("Error in users file %v: users[%v].backend: unknown backend %v",
+					config.UsersFile, i, u.Backend)
+			}
+		}
+		m.auth = newAuthRegistry(users.Users)
+	}
+	m.routes = make([]route, len(config.Routes))
+	for i, r := range config.Routes {
+		m.routes[i] = route{namespacePattern{r.Database, r.Collection}, r.Backend}
+	}
+	m.readPolicies = make([]readPolicy, len(config.ReadPreferences))
+	for i, p := range config.ReadPreferences {
+		m.readPolicies[i] = readPolicy{namespacePattern{p.Database, p.Collection},
+			&messages.ReadPreference{
+				Mode:                p.Mode,
+				MaxStalenessSeconds: int64(p.MaxStaleness / time.Second),
+			}}
+	}
 	m.Logger = log.New()
+	m.Logger.SetLevel(log.GetLevel())
 	m.Logger.SetReportCaller(true)
 
 	return nil
 }
 
-func (m *MongodModule) Process(req messages.Requester, res messages.Responder,
-	next server.PipelineFunc) {
+// connect returns the module's client, connecting it if it isn't connected yet.
+// If connecting fails, the next request tries again.
+func (m *MongodModule) connect() (*mongo.Client, error) {
+	m.clientMu.Lock()
+	defer m.clientMu.Unlock()
+
+	if m.Client != nil {
+		return m.Client, nil
+	}
+	client, err := dial(m.ConnectionString, m.Compressors, m.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	m.Client = client
+	return client, nil
+}
 
-	var ctx = context.Background()
+// Close closes the module's cursors, ends its sessions and disconnects its
+// clients, once the proxy has shut down. Requests still running after it fail
+// rather than connect again.
+func (m *MongodModule) Close(ctx context.Context) error {
+	if m.cursors != nil {
+		m.cursors.close(ctx)
+	}
+	if m.sessions != nil {
+		m.sessions.close(ctx)
+	}
+	if m.pinned != nil {
+		m.pinned.close()
+	}
 
-	// spin up the session if it doesn't exist
-	if m.Client == nil {
-		var err error
-		m.Client, err = mongo.Connect(context.TODO(), options.Client().ApplyURI(m.ConnectionString))
-		if err != nil {
-			log.Errorf("Error connecting to MongoDB: %#v", err)
-			next(req, res)
+	var first error
+	m.clientMu.Lock()
+	if m.Client != nil {
+		first = m.Client.Disconnect(ctx)
+	}
+	m.clientMu.Unlock()
+	for _, b := range m.backends {
+		if err := b.disconnect(ctx); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// error codes of the backend that the proxy reports itself
+const (
+	internalError                      = 1
+	badValue                           = 2
+	hostUnreachable                    = 6
+	unauthorized                       = 13
+	protocolError                      = 17
+	authenticationFailed               = 18
+	cursorNotFound                     = 43
+	maxTimeMSExpired                   = 50
+	commandNotFound                    = 59
+	transactionTooOld                  = 225
+	noSuchTransaction                  = 251
+	transactionCommitted               = 256
+	operationNotSupportedInTransaction = 263
+	cursorInUse                        = 292
+	mechanismUnavailable               = 334
+)
+
+// writeError writes an error from the driver to the response, keeping the code,
+// code name and labels of the backend's error.
+func writeError(res messages.Responder, err error) {
+	res.Fail(toResponderError(err))
+}
+
+// toResponderError maps an error from the driver to the error the backend would
+// have returned to the client.
+func toResponderError(err error) *messages.ResponderError {
+	if cErr, ok := err.(mongo.CommandError); ok {
+		if cErr.Code == 0 {
+			// the driver reports network errors without a code
+			return &messages.ResponderError{
+				ErrorCode: hostUnreachable,
+				Message:   cErr.Message,
+				Labels:    cErr.Labels,
+			}
+		}
+		return &messages.ResponderError{
+			ErrorCode: cErr.Code,
+			CodeName:  cErr.Name,
+			Message:   cErr.Message,
+			Labels:    cErr.Labels,
+		}
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &messages.ResponderError{ErrorCode: maxTimeMSExpired, Message: err.Error()}
+	}
+	return &messages.ResponderError{ErrorCode: internalError, Message: err.Error()}
+}
+
+// insertResponse returns the response to an insert from the backend's reply.
+func insertResponse(reply bson.M) messages.InsertResponse {
+	return messages.InsertResponse{
+		// default to -1 if n doesn't exist to hide the field on export
+		N:                 convert.ToInt32(reply["n"], -1),
+		WriteErrors:       messages.ParseWriteErrors(reply["writeErrors"]),
+		WriteConcernError: messages.ParseWriteConcernError(reply["writeConcernError"]),
+	}
+}
+
+// updateResponse returns the response to an update from the backend's reply.
+func updateResponse(reply bson.D) messages.UpdateResponse {
+	response := messages.UpdateResponse{
+		N:         convert.ToInt32(bsonutil.FindValueByKey("n", reply), -1),
+		NModified: convert.ToInt32(bsonutil.FindValueByKey("nModified", reply), -1),
+		WriteErrors: messages.ParseWriteErrors(
+			bsonutil.FindValueByKey("writeErrors", reply)),
+		WriteConcernError: messages.ParseWriteConcernError(
+			bsonutil.FindValueByKey("writeConcernError", reply)),
+	}
+
+	rawUpserted := bsonutil.FindValueByKey("upserted", reply)
+	upserted, err := convert.ConvertToBSONDocSlice(rawUpserted)
+	if err == nil {
+		// we have upserts
+		response.Upserted = upserted
+	}
+	return response
+}
+
+// deleteResponse returns the response to a delete from the backend's reply.
+func deleteResponse(reply bson.M) messages.DeleteResponse {
+	return messages.DeleteResponse{
+		N:                 convert.ToInt32(reply["n"], -1),
+		WriteErrors:       messages.ParseWriteErrors(reply["writeErrors"]),
+		WriteConcernError: messages.ParseWriteConcernError(reply["writeConcernError"]),
+	}
+}
+
+// runCommand runs a command on the database, with the read preference rp if it
+// isn't nil, and writes its reply or its error to the response.
+func (m *MongodModule) runCommand(ctx context.Context, db *mongo.Database, commandName string,
+	b bson.D, rp *readpref.ReadPref, res messages.Responder) {
+
+	opts := options.RunCmd()
+	if rp != nil {
+		opts.SetReadPreference(rp)
+	}
+	reply := bson.M{}
+	err := db.RunCommand(ctx, b, opts).Decode(&reply)
+	if err != nil {
+		m.Logger.Warnf("Error running command %v: %v", commandName, err)
+		writeError(res, err)
+		return
+	}
+
+	res.Write(messages.CommandResponse{
+		Reply: reply,
+	})
+}
+
+// hello runs hello at the backend for a client's handshake, and writes the
+// backend's reply to the response, for the proxy to build its own reply from.
+// Backends older than 4.4.2 don't know hello, and run isMaster instead. The
+// mechanisms a client's user can authenticate with, which the client asks for
+// with saslSupportedMechs, are those of the proxy's users if it has any, and
+// otherwise the backend's.
+func (m *MongodModule) hello(ctx context.Context, client *mongo.Client,
+	command messages.Command, res messages.Responder) {
+
+	user, _ := command.GetArg("saslSupportedMechs").(string)
+	helloCommand := func(name string) bson.D {
+		b := bson.D{{Key: name, Value: 1}}
+		if user != "" && m.auth == nil {
+			b = append(b, bson.E{Key: "saslSupportedMechs", Value: user})
+		}
+		return b
+	}
+
+	admin := client.Database("admin")
+	reply := bson.M{}
+	err := admin.RunCommand(ctx, helloCommand("hello")).Decode(&reply)
+	if cErr, ok := err.(mongo.CommandError); ok && cErr.Code == commandNotFound {
+		reply = bson.M{}
+		err = admin.RunCommand(ctx, helloCommand("isMaster")).Decode(&reply)
+	}
+	if err != nil {
+		m.Logger.Warnf("Error running command hello: %v", err)
+		writeError(res, err)
+		return
+	}
+	if user != "" && m.auth != nil {
+		if mechanisms := m.auth.mechanisms(user); mechanisms != nil {
+			reply["saslSupportedMechs"] = mechanisms
+		}
+	}
+	res.Write(messages.CommandResponse{Reply: reply})
+}
+
+// endTransaction commits or aborts the transaction of a client's session, and
+// writes the reply to the response.
+func (m *MongodModule) endTransaction(ctx context.Context, session *proxySession,
+	commandName string, res messages.Responder) {
+
+	if session == nil {
+		res.Error(noSuchTransaction, "Transaction commands must be run in a session")
+		return
+	}
+
+	var err error
+	if commandName == "commitTransaction" {
+		err = session.commit(ctx)
+	} else {
+		err = session.abort(ctx)
+	}
+	if err != nil {
+		m.Logger.Warnf("Error running command %v: %v", commandName, err)
+		writeError(res, err)
+		return
+	}
+	res.Write(messages.CommandResponse{Reply: bson.M{}})
+}
+
+func (m *MongodModule) Process(ctx server.Context, req messages.Requester,
+	res messages.Responder, next server.PipelineFunc) {
+
+	// with local users, the proxy authenticates clients itself, and only lets
+	// authenticated clients through
+	var user *localUser
+	if m.auth != nil {
+		if command, ok := req.(messages.Command); ok {
+			switch command.CommandName {
+			case "saslStart", "saslContinue":
+				if u := m.auth.authenticate(ctx, command, res); u != nil {
+					ctx.Conn.SetUser(userKey(u.db, u.name))
+				}
+				next(ctx, req, res)
+				return
+			case "authenticate":
+				res.Error(mechanismUnavailable,
+					"The proxy only authenticates clients with "+scramSHA256)
+				next(ctx, req, res)
+				return
+			case "logout":
+				m.auth.forget(ctx.Conn.ID)
+				ctx.Conn.SetUser("")
+				res.Write(messages.CommandResponse{Reply: bson.M{}})
+				next(ctx, req, res)
+				return
+			}
+		}
+		user = m.auth.userOf(ctx.Conn.ID)
+		if user == nil && requiresAuth(req) {
+			res.Fail(unauthorizedError(req))
+			next(ctx, req, res)
+			return
+		}
+	}
+
+	if m.ReadOnly && messages.IsWrite(req) {
+		m.rejectWrite(ctx, req, res)
+		next(ctx, req, res)
+		return
+	}
+
+	// in auth passthrough, everything but handshakes runs on the client
+	// connection's own backend connection
+	if m.AuthPassthrough {
+		command, err := messages.ToCommandRequest(req)
+		if err != nil || !messages.IsHandshake(command.CommandName) {
+			m.passthrough(ctx, req, res)
+			next(ctx, req, res)
 			return
 		}
 	}
 
-	session, err := m.Client.StartSession()
+	// spin up the client of the request's backend if it doesn't exist. The
+	// requests of a local user with a backend of its own go there
+	var client *mongo.Client
+	var err error
+	if user != nil && user.backend != "" {
+		client, err = m.backendClient(user.backend)
+	} else {
+		client, err = m.clientFor(messages.NamespaceOf(req))
+	}
 	if err != nil {
-		log.Errorf("Error starting session: %#v", err)
+		log.Errorf("Error connecting to MongoDB: %#v", err)
+		next(ctx, req, res)
+		return
+	}
+
+	// requests in a client's session run in the backend session it is mapped to.
+	// Those that run on several backends run outside of it, in requestCtx
+	requestCtx := ctx
+	var session *proxySession
+	info := messages.SessionOf(req)
+	if info != nil && info.Transaction {
+		client, err = m.transactionClient(client, req, info)
+		if err != nil {
+			writeError(res, err)
+			next(ctx, req, res)
+			return
+		}
+	}
+	if info != nil {
+		session, err = m.sessions.checkout(client, info.LSID)
+		if err != nil {
+			m.Logger.Warnf("Error starting session: %#v", err)
+			writeError(res, err)
+			next(ctx, req, res)
+			return
+		}
+		defer m.sessions.release(session)
+
+		sctx, err := session.begin(ctx, info)
+		if err != nil {
+			m.Logger.Warnf("Error in session: %v", err)
+			writeError(res, err)
+			next(ctx, req, res)
+			return
+		}
+		ctx = ctx.WithContext(sctx)
+	}
+
+	// reads go to the members of the backend their read preference allows
+	var rp *readpref.ReadPref
+	if !messages.IsWrite(req) {
+		rp, err = toReadPref(m.readPreferenceFor(req))
+		if err != nil {
+			res.Error(badValue, err.Error())
+			next(ctx, req, res)
+			return
+		}
 	}
-	defer session.EndSession(ctx)
 
 	switch req.Type() {
 	case messages.CommandType:
 		command, err := messages.ToCommandRequest(req)
 		if err != nil {
 			m.Logger.Warnf("Error converting to command: %#v", err)
-			next(req, res)
+			next(ctx, req, res)
 			return
 		}
 
-		b := command.ToBSON()
-
-		reply := bson.M{}
 		switch command.CommandName {
-		case "ismaster":
-			b = bson.D{
-				{"isMaster", 1},
+		case "commitTransaction", "abortTransaction":
+			m.endTransaction(ctx, session, command.CommandName, res)
+			next(ctx, req, res)
+			return
+
+		case "listDatabases":
+			if len(m.backends) > 0 && (user == nil || user.backend == "") {
+				m.listDatabases(requestCtx, command, res)
+				next(ctx, req, res)
+				return
 			}
 
-		case "createIndexes":
-			m.Logger.Infof("Skipping command %v", command.CommandName)
-			reply["ok"] = 1
-			reply["code"] = 0
-			response := messages.CommandResponse{
-				Reply: reply,
+		case "listCollections":
+			if m.splitsDatabase(command.Database) && (user == nil || user.backend == "") {
+				m.listCollections(requestCtx, command, res)
+				next(ctx, req, res)
+				return
 			}
-			res.Write(response)
+
+		case "endSessions":
+			lsids, err := convert.ConvertToBSONDocSlice(command.GetArg("endSessions"))
+			if err != nil {
+				res.Error(badValue, "endSessions needs an array of session ids")
+			} else {
+				m.sessions.end(ctx, lsids)
+				res.Write(messages.CommandResponse{Reply: bson.M{}})
+			}
+			next(ctx, req, res)
 			return
+		}
+
+		if messages.IsHandshake(command.CommandName) {
+			m.hello(ctx, client, command, res)
+			break
+		}
+
+		b := command.ToBSON()
+
+		switch command.CommandName {
 		case "ping":
 		case "buildInfo":
-		case "isMaster":
 		default:
 			m.Logger.Infof("processing %v", b)
 		}
-		err = session.Client().Database(command.Database).RunCommand(ctx, b).Decode(&reply)
+		m.runCommand(ctx, client.Database(command.Database), command.CommandName, b, rp, res)
 
+	case messages.AggregateType:
+		a, err := messages.ToAggregateRequest(req)
 		if err != nil {
-			// log an error if we can
-			qErr, ok := err.(*mongo.CommandError)
-			m.Logger.Warnf("Error running command %v: %v", command.CommandName, err)
-			if ok {
-				res.Error(int32(qErr.Code), qErr.Message)
+			m.Logger.Warnf("Error converting to Aggregate command: %#v", err)
+			next(ctx, req, res)
+			return
+		}
+
+		db := client.Database(a.Database)
+		if a.Explain {
+			// an explain returns its plan instead of a cursor
+			m.runCommand(ctx, db, "aggregate", a.ToBSON(), rp, res)
+			break
+		}
+
+		if a.IsChangeStream() {
+			cs, results, err := openChangeStream(ctx, client, a, rp)
+			if err != nil {
+				m.Logger.Warnf("Error on Aggregate Command: %#v", err)
+				writeError(res, err)
+				next(ctx, req, res)
+				return
+			}
+
+			response := messages.AggregateResponse{
+				Database:             a.Database,
+				Collection:           a.Namespace(),
+				Documents:            results,
+				ChangeStream:         true,
+				PostBatchResumeToken: cs.resumeToken,
+			}
+
+			pc := &proxyCursor{
+				database:   a.Database,
+				collection: a.Namespace(),
+				owner:      ctx.Conn.User(),
+				stream:     cs,
+			}
+			if pc.exhausted() {
+				cs.close(ctx)
 			} else {
-				res.Error(-1, "Unknown error")
+				response.CursorID = m.cursors.add(pc)
 			}
-			next(req, res)
+
+			res.Write(response)
+			break
+		}
+
+		opts := options.RunCmd()
+		if rp != nil {
+			opts.SetReadPreference(rp)
+		}
+		cur, err := db.RunCommandCursor(ctx, a.ToBSON(), opts)
+		if err != nil {
+			m.Logger.Warnf("Error on Aggregate Command: %#v", err)
+			writeError(res, err)
+			next(ctx, req, res)
 			return
 		}
 
-		response := messages.CommandResponse{
-			Reply: reply,
+		pc := &proxyCursor{
+			database:   a.Database,
+			collection: a.Namespace(),
+			owner:      ctx.Conn.User(),
+			cursor:     cur,
 		}
 
-		if convert.ToInt(reply["ok"]) == 0 {
-			// we have a command error.
-			res.Error(convert.ToInt32(reply["code"]), convert.ToString(reply["errmsg"]))
-			next(req, res)
+		results, err := pc.nextBatch(ctx, a.BatchSize)
+		if err != nil {
+			m.Logger.Warnf("Error on Aggregate Command: %#v", err)
+			writeError(res, err)
+			cur.Close(ctx)
+			next(ctx, req, res)
 			return
 		}
 
+		response := messages.AggregateResponse{
+			Database:   a.Database,
+			Collection: a.Namespace(),
+			Documents:  results,
+		}
+
+		if pc.exhausted() {
+			cur.Close(ctx)
+		} else {
+			// keep the cursor open for the getMores to come
+			response.CursorID = m.cursors.add(pc)
+		}
+
 		res.Write(response)
 
+	case messages.CountType:
+		c, err := messages.ToCountRequest(req)
+		if err != nil {
+			m.Logger.Warnf("Error converting to Count command: %#v", err)
+			next(ctx, req, res)
+			return
+		}
+		m.runCommand(ctx, client.Database(c.Database), "count", c.ToBSON(), rp, res)
+
+	case messages.DistinctType:
+		d, err := messages.ToDistinctRequest(req)
+		if err != nil {
+			m.Logger.Warnf("Error converting to Distinct command: %#v", err)
+			next(ctx, req, res)
+			return
+		}
+		m.runCommand(ctx, client.Database(d.Database), "distinct", d.ToBSON(), rp, res)
+
+	case messages.FindAndModifyType:
+		f, err := messages.ToFindAndModifyRequest(req)
+		if err != nil {
+			m.Logger.Warnf("Error converting to FindAndModify command: %#v", err)
+			next(ctx, req, res)
+			return
+		}
+
+		reply := bson.M{}
+		err = m.runWrite(ctx, client.Database(f.Database), f.ToBSON(), f.Retryable(),
+			writeSession{info, session}, &reply)
+		if err != nil {
+			m.Logger.Warnf("Error running command findAndModify: %v", err)
+			writeError(res, err)
+			next(ctx, req, res)
+			return
+		}
+		res.Write(messages.CommandResponse{Reply: reply})
+
+	case messages.CreateIndexesType:
+		c, err := messages.ToCreateIndexesRequest(req)
+		if err != nil {
+			m.Logger.Warnf("Error converting to CreateIndexes command: %#v", err)
+			next(ctx, req, res)
+			return
+		}
+
+		m.runCommand(ctx, client.Database(c.Database), "createIndexes", c.ToBSON(), nil, res)
+
 	case messages.FindType:
 		f, err := messages.ToFindRequest(req)
 		if err != nil {
 			m.Logger.Warnf("Error converting to a Find command: %#v", err)
-			next(req, res)
+			next(ctx, req, res)
 			return
 		}
 
+		if f.Explain {
+			// a legacy $explain gets the query plan as its only document
+			plan := bson.D{}
+			explain := bson.D{{Key: "explain", Value: f.ToBSON()}}
+			opts := options.RunCmd()
+			if rp != nil {
+				opts.SetReadPreference(rp)
+			}
+			err := client.Database(f.Database).RunCommand(ctx, explain, opts).Decode(&plan)
+			if err != nil {
+				m.Logger.Warnf("Error explaining Find Command: %#v", err)
+				writeError(res, err)
+				next(ctx, req, res)
+				return
+			}
+			res.Write(messages.FindResponse{
+				Database:   f.Database,
+				Collection: f.Collection,
+				Documents:  []bson.D{plan},
+			})
+			break
+		}
+
 		opts := options.Find()
-		opts.SetBatchSize(int32(f.Limit))
-		opts.SetLimit(int64(f.Limit))
+		if f.SingleBatch && f.Limit > 0 {
+			// a negative limit asks for a single batch
+			opts.SetLimit(-int64(f.Limit))
+		} else {
+			opts.SetLimit(int64(f.Limit))
+		}
 		opts.SetSkip(int64(f.Skip))
 
+		if f.BatchSize > 0 {
+			opts.SetBatchSize(f.BatchSize)
+		}
+
 		if f.Projection != nil {
 			opts.SetProjection(f.Projection)
 		}
@@ -151,60 +715,115 @@ func (m *MongodModule) Process(req messages.Requester, res messages.Responder,
 			opts.SetSort(f.Sort)
 		}
 
-		c := session.Client().Database(f.Database).Collection(f.Collection)
+		if f.Hint != nil {
+			opts.SetHint(f.Hint)
+		}
+
+		if f.MaxTimeMS > 0 {
+			opts.SetMaxTime(time.Duration(f.MaxTimeMS) * time.Millisecond)
+		}
+
+		if comment, ok := f.Comment.(string); ok {
+			opts.SetComment(comment)
+		}
+
+		if f.Min != nil {
+			opts.SetMin(f.Min)
+		}
+
+		if f.Max != nil {
+			opts.SetMax(f.Max)
+		}
+
+		if f.ReturnKey {
+			opts.SetReturnKey(true)
+		}
+
+		if f.ShowRecordID {
+			opts.SetShowRecordID(true)
+		}
+
+		if f.Tailable && f.AwaitData {
+			opts.SetCursorType(options.TailableAwait)
+			// the getMores of the cursor wait in short polls, see awaitBatch
+			opts.SetMaxAwaitTime(awaitPollInterval)
+		} else if f.Tailable {
+			opts.SetCursorType(options.Tailable)
+		}
+
+		if f.NoCursorTimeout {
+			opts.SetNoCursorTimeout(true)
+		}
+
+		if f.OplogReplay {
+			opts.SetOplogReplay(true)
+		}
+
+		if f.Partial {
+			opts.SetAllowPartialResults(true)
+		}
+
+		if f.AllowDiskUse {
+			opts.SetAllowDiskUse(true)
+		}
+
+		if collation := toCollation(f.Collation); collation != nil {
+			opts.SetCollation(collation)
+		}
+
+		filter := f.Filter
+		if filter == nil {
+			filter = bson.D{}
+		}
+
+		collOpts := options.Collection()
+		if rp != nil {
+			collOpts.SetReadPreference(rp)
+		}
+		if readConcern := toReadConcern(f.ReadConcern); readConcern != nil {
+			collOpts.SetReadConcern(readConcern)
+		}
 
 		var cur *mongo.Cursor
-		if cur, err = c.Find(ctx, f.Filter, opts); err != nil {
+		if levelOnly(f.ReadConcern) && len(f.Extra) == 0 {
+			c := client.Database(f.Database).Collection(f.Collection, collOpts)
+			cur, err = c.Find(ctx, filter, opts)
+		} else {
+			// the driver only sends the level of a read concern and the options
+			// it knows, so a find that reads at or after a cluster time, or that
+			// has arguments such as let, is sent as the client's command
+			cmdOpts := options.RunCmd()
+			if rp != nil {
+				cmdOpts.SetReadPreference(rp)
+			}
+			cur, err = client.Database(f.Database).RunCommandCursor(ctx, f.ToBSON(), cmdOpts)
+		}
+		if err != nil {
 			m.Logger.Warnf("Error on Find Command: %#v", err)
 
-			// log an error if we can
-			qErr, ok := err.(*mongo.CommandError)
-			if ok {
-				res.Error(int32(qErr.Code), qErr.Message)
-			}
+			writeError(res, err)
+			next(ctx, req, res)
+			return
 		}
 
-		var results []bson.D
+		pc := &proxyCursor{
+			database:   f.Database,
+			collection: f.Collection,
+			owner:      ctx.Conn.User(),
+			cursor:     cur,
+			noTimeout:  f.NoCursorTimeout,
+			tailable:   f.Tailable,
+			awaitData:  f.Tailable && f.AwaitData,
+		}
 
-		if f.Limit > 0 {
-			// only store the amount specified by the limit
-			for i := 0; i < int(f.Limit); i++ {
-				var result bson.D
-				ok := cur.Next(ctx)
-				cur.Decode(&result)
-				if !ok {
-					err = cur.Err()
-					if err != nil {
-						m.Logger.Warnf("Error on Find Command: %#v", err)
-
-						// log an error if we can
-						qErr, ok := err.(*mongo.CommandError)
-						if ok {
-							res.Error(int32(qErr.Code), qErr.Message)
-						}
-						cur.Close(ctx)
-						next(req, res)
-						return
-					}
-					// we ran out of documents, but didn't have an error
-					break
-				}
-				results = append(results, result)
-			}
-		} else {
-			// dump all of them
-			err = cur.All(ctx, &results)
-			if err != nil {
-				m.Logger.Warnf("Error on Find Command: %#v", err)
+		results, err := pc.nextBatch(ctx, f.BatchSize)
+		if err != nil {
+			m.Logger.Warnf("Error on Find Command: %#v", err)
 
-				// log an error if we can
-				qErr, ok := err.(*mongo.CommandError)
-				if ok {
-					res.Error(int32(qErr.Code), qErr.Message)
-				}
-				next(req, res)
-				return
-			}
+			writeError(res, err)
+			cur.Close(ctx)
+			next(ctx, req, res)
+			return
 		}
 
 		response := messages.FindResponse{
@@ -213,84 +832,55 @@ func (m *MongodModule) Process(req messages.Requester, res messages.Responder,
 			Documents:  results,
 		}
 
+		if f.SingleBatch || pc.exhausted() {
+			cur.Close(ctx)
+		} else {
+			// keep the cursor open for the getMores to come
+			response.CursorID = m.cursors.add(pc)
+		}
+
 		res.Write(response)
 
 	case messages.InsertType:
 		insert, err := messages.ToInsertRequest(req)
 		if err != nil {
 			m.Logger.Warnf("Error converting to Insert command: %#v", err)
-			next(req, res)
-			return
-		}
-
-		if m.ReadOnly {
-			response := messages.InsertResponse{N: -1}
-			res.Write(response)
+			next(ctx, req, res)
 			return
 		}
 
 		b := insert.ToBSON()
 
 		reply := bson.M{}
-		result := session.Client().Database(insert.Database).RunCommand(ctx, b)
+		err = m.runWrite(ctx, client.Database(insert.Database), b, insert.Retryable(),
+			writeSession{info, session}, &reply)
 
 		// collection = client.Database(dbName).Collection(collectionName)
 		// if result, err = collection.InsertOne(ctx, doc); err != nil {
 		// 	t.Fatal(err)
 		// }
 
-		if result.Err() != nil {
-			// log an error if we can
-			qErr, ok := err.(*mongo.WriteError)
-			if ok {
-				res.Error(int32(qErr.Code), qErr.Message)
-			}
-			next(req, res)
-			return
-		}
-
-		result.Decode(&reply)
-
-		response := messages.InsertResponse{
-			// default to -1 if n doesn't exist to hide the field on export
-			N: convert.ToInt32(reply["n"], -1),
-		}
-		writeErrors, err := convert.ConvertToBSONMapSlice(reply["writeErrors"])
-		if err == nil {
-			// we have write errors
-			response.WriteErrors = writeErrors
-		}
-
-		if convert.ToInt(reply["ok"]) == 0 {
-			// we have a command error.
-			res.Error(convert.ToInt32(reply["code"]), convert.ToString(reply["errmsg"]))
-			next(req, res)
+		if err != nil {
+			writeError(res, err)
+			next(ctx, req, res)
 			return
 		}
 
-		res.Write(response)
+		res.Write(insertResponse(reply))
 
 	case messages.UpdateType:
 		u, err := messages.ToUpdateRequest(req)
 		if err != nil {
 			m.Logger.Warnf("Error converting to Update command: %v", err)
-			next(req, res)
-			return
-		}
-
-		if m.ReadOnly {
-			response := messages.UpdateResponse{
-				N:         -1,
-				NModified: -1,
-			}
-			res.Write(response)
+			next(ctx, req, res)
 			return
 		}
 
 		b := u.ToBSON()
 
 		reply := bson.D{}
-		result := session.Client().Database(u.Database).RunCommand(ctx, b)
+		err = m.runWrite(ctx, client.Database(u.Database), b, u.Retryable(),
+			writeSession{info, session}, &reply)
 
 		// var update bson.M
 		// json.Unmarshal([]byte(`{ "$set": {"year": 1998}}`), &update)
@@ -302,166 +892,112 @@ func (m *MongodModule) Process(req messages.Requester, res messages.Responder,
 		// 	t.Fatal(err)
 		// }
 
-		if result.Err() != nil {
-			// log an error if we can
-			qErr, ok := err.(*mongo.WriteError)
-			if ok {
-				res.Error(int32(qErr.Code), qErr.Message)
-			}
-			next(req, res)
-			return
-		}
-
-		result.Decode(&reply)
-
-		response := messages.UpdateResponse{
-			N:         convert.ToInt32(bsonutil.FindValueByKey("n", reply), -1),
-			NModified: convert.ToInt32(bsonutil.FindValueByKey("nModified", reply), -1),
-		}
-
-		writeErrors, err := convert.ConvertToBSONMapSlice(
-			bsonutil.FindValueByKey("writeErrors", reply))
-		if err == nil {
-			// we have write errors
-			response.WriteErrors = writeErrors
-		}
-
-		rawUpserted := bsonutil.FindValueByKey("upserted", reply)
-		upserted, err := convert.ConvertToBSONDocSlice(rawUpserted)
-		if err == nil {
-			// we have upserts
-			response.Upserted = upserted
-		}
-
-		if convert.ToInt(bsonutil.FindValueByKey("ok", reply)) == 0 {
-			// we have a command error.
-			res.Error(convert.ToInt32(bsonutil.FindValueByKey("code", reply)),
-				convert.ToString(bsonutil.FindValueByKey("errmsg", reply)))
-			next(req, res)
+		if err != nil {
+			writeError(res, err)
+			next(ctx, req, res)
 			return
 		}
 
-		res.Write(response)
+		res.Write(updateResponse(reply))
 
 	case messages.DeleteType:
 		d, err := messages.ToDeleteRequest(req)
 		if err != nil {
 			m.Logger.Warnf("Error converting to Delete command: %v", err)
-			next(req, res)
-			return
-		}
-
-		if m.ReadOnly {
-			response := messages.DeleteResponse{
-				N: -1,
-			}
-			res.Write(response)
+			next(ctx, req, res)
 			return
 		}
 
 		b := d.ToBSON()
 
 		reply := bson.M{}
-		result := session.Client().Database(d.Database).RunCommand(ctx, b)
+		err = m.runWrite(ctx, client.Database(d.Database), b, d.Retryable(),
+			writeSession{info, session}, &reply)
 
 		// if result, err = collection.DeleteMany(ctx, bson.M{"hometown": "Atlanta"}); err != nil {
 		// 	t.Fatal(err)
 		// }
 
-		if result.Err() != nil {
-			// log an error if we can
-			qErr, ok := err.(*mongo.WriteError)
-			if ok {
-				res.Error(int32(qErr.Code), qErr.Message)
-			}
-			next(req, res)
-			return
-		}
-
-		result.Decode(&reply)
-
-		response := messages.DeleteResponse{
-			N: convert.ToInt32(reply["n"], -1),
-		}
-		writeErrors, err := convert.ConvertToBSONMapSlice(reply["writeErrors"])
-		if err == nil {
-			// we have write errors
-			response.WriteErrors = writeErrors
-		}
-
-		if convert.ToInt(reply["ok"]) == 0 {
-			// we have a command error.
-			res.Error(convert.ToInt32(reply["code"]), convert.ToString(reply["errmsg"]))
-			next(req, res)
+		if err != nil {
+			writeError(res, err)
+			next(ctx, req, res)
 			return
 		}
 
 		m.Logger.Infof("Reply: %#v", reply)
 
-		res.Write(response)
+		res.Write(deleteResponse(reply))
 
 	case messages.GetMoreType:
 		g, err := messages.ToGetMoreRequest(req)
 		if err != nil {
 			m.Logger.Warnf("Error converting to GetMore command: %#v", err)
-			next(req, res)
+			next(ctx, req, res)
 			return
 		}
 		m.Logger.Debugf("%#v", g)
 
-		// make an iterable to get more
-		// https://docs.mongodb.com/manual/reference/command/getMore/
-		d := session.Client().Database(g.Database)
-		cur, err := d.RunCommandCursor(ctx, g)
-		defer cur.Close(ctx)
-
+		pc, ok, err := m.cursors.checkout(ctx.Conn.User(), g.CursorID)
 		if err != nil {
-			// log an error if we can
-			qErr, ok := err.(*mongo.CommandError)
+			res.Error(cursorInUse, fmt.Sprintf("cursor id %v is already in use", g.CursorID))
+			next(ctx, req, res)
+			return
+		}
+		if !ok || pc.database != g.Database || pc.collection != g.Collection {
 			if ok {
-				res.Error(int32(qErr.Code), qErr.Message)
+				m.cursors.release(ctx, pc)
+			}
+
+			// we return an empty getMore with an errored out cursor
+			response := messages.GetMoreResponse{
+				CursorID:      g.CursorID,
+				Database:      g.Database,
+				Collection:    g.Collection,
+				InvalidCursor: true,
 			}
-			next(req, res)
+			res.Write(response)
+			next(ctx, req, res)
 			return
 		}
 
+		maxAwaitTime := DefaultMaxAwaitTime
+		if g.MaxTimeMS > 0 {
+			maxAwaitTime = time.Duration(g.MaxTimeMS) * time.Millisecond
+		}
+
+		// only this cursor is checked out while waiting, so other connections
+		// aren't held up by an awaitData getMore
 		var results []bson.D
+		if pc.stream != nil {
+			// the backend waits for change events itself
+			results, err = pc.stream.getMore(ctx, g.BatchSize, g.MaxTimeMS)
+		} else {
+			results, err = pc.awaitBatch(ctx, g.BatchSize, maxAwaitTime)
+		}
+		if err != nil {
+			m.Logger.Warnf("Error on GetMore Command: %#v", err)
 
-		for i := 0; i < int(g.BatchSize); i++ {
-			var result bson.D
-			ok := cur.Next(ctx)
-			if !ok {
-				err = cur.Err()
-				if err != nil {
-					m.Logger.Warnf("Error on GetMore Command: %#v", err)
-
-					if err == mongo.ErrNilCursor {
-						// we return an empty getMore with an errored out
-						// cursor
-						response := messages.GetMoreResponse{
-							CursorID:      g.CursorID,
-							Database:      g.Database,
-							Collection:    g.Collection,
-							InvalidCursor: true,
-						}
-						res.Write(response)
-						next(req, res)
-						return
-					}
-
-					// log an error if we can
-					qErr, ok := err.(*mongo.CommandError)
-					if ok {
-						res.Error(int32(qErr.Code), qErr.Message)
-					}
-					cur.Close(ctx)
-					next(req, res)
-					return
-				}
-				break
+			// the backend cursor is unusable after an error
+			pc.done = true
+			if pc.stream != nil {
+				pc.stream.id = 0
 			}
-			cur.Decode(&result)
-			results = append(results, result)
+			m.cursors.release(ctx, pc)
+
+			if qErr, ok := err.(mongo.CommandError); ok && qErr.Code == cursorNotFound {
+				// the backend closed the cursor, e.g. a tailable cursor whose
+				// position in a capped collection was overwritten
+				res.Write(messages.GetMoreResponse{
+					CursorID:      g.CursorID,
+					Database:      g.Database,
+					Collection:    g.Collection,
+					InvalidCursor: true,
+				})
+			} else {
+				writeError(res, err)
+			}
+			next(ctx, req, res)
+			return
 		}
 
 		response := messages.GetMoreResponse{
@@ -470,17 +1006,41 @@ func (m *MongodModule) Process(req messages.Requester, res messages.Responder,
 			Collection: g.Collection,
 			Documents:  results,
 		}
+		if pc.stream != nil {
+			response.ChangeStream = true
+			response.PostBatchResumeToken = pc.stream.resumeToken
+		}
+		if pc.exhausted() {
+			response.CursorID = 0
+		}
+		m.cursors.release(ctx, pc)
 
 		res.Write(response)
 
 	case messages.MsgType:
 
 	case messages.KillCursorsType:
+		k, err := messages.ToKillCursorsRequest(req)
+		if err != nil {
+			m.Logger.Warnf("Error converting to KillCursors command: %#v", err)
+			next(ctx, req, res)
+			return
+		}
+
+		killed, notFound := m.cursors.kill(ctx, ctx.Conn.User(), k.Database, k.Collection,
+			k.CursorID)
+		m.Logger.Debugf("Killed cursors %v, not found %v", killed, notFound)
+
+		response := messages.KillCursorsResponse{
+			CursorsKilled:   killed,
+			CursorsNotFound: notFound,
+		}
+		res.Write(response)
 
 	default:
 		m.Logger.Warnf("Unsupported operation: %v", req.Type())
 	}
 
-	next(req, res)
+	next(ctx, req, res)
 
 }
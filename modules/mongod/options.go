@@ -0,0 +1,107 @@
+package mongod
+
+import (
+	"time"
+
+	"github.com/WyattNielsen/mongoproxy/convert"
+	"github.com/WyattNielsen/mongoproxy/messages"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/tag"
+)
+
+// toCollation converts a collation document from a request into the driver's
+// Collation, or returns nil if there is no collation.
+func toCollation(d bson.D) *options.Collation {
+	if d == nil {
+		return nil
+	}
+
+	c := &options.Collation{}
+	for _, e := range d {
+		switch e.Key {
+		case "locale":
+			c.Locale = convert.ToString(e.Value)
+		case "caseLevel":
+			c.CaseLevel = convert.ToBool(e.Value)
+		case "caseFirst":
+			c.CaseFirst = convert.ToString(e.Value)
+		case "strength":
+			c.Strength = convert.ToInt(e.Value)
+		case "numericOrdering":
+			c.NumericOrdering = convert.ToBool(e.Value)
+		case "alternate":
+			c.Alternate = convert.ToString(e.Value)
+		case "maxVariable":
+			c.MaxVariable = convert.ToString(e.Value)
+		case "normalization":
+			c.Normalization = convert.ToBool(e.Value)
+		case "backwards":
+			c.Backwards = convert.ToBool(e.Value)
+		}
+	}
+	return c
+}
+
+// toReadConcern converts a readConcern document from a request into the driver's
+// ReadConcern, or returns nil if there is no read concern or it has no level.
+// The driver's ReadConcern only has a level, see levelOnly.
+func toReadConcern(m *bson.M) *readconcern.ReadConcern {
+	if m == nil {
+		return nil
+	}
+	level := convert.ToString((*m)["level"])
+	if level == "" {
+		return nil
+	}
+	return readconcern.New(readconcern.Level(level))
+}
+
+// levelOnly returns true if a readConcern document from a request has nothing
+// but a level, and can be sent as the driver's ReadConcern. One with other
+// fields, such as afterClusterTime or atClusterTime, has to be sent on the
+// command as it is.
+func levelOnly(m *bson.M) bool {
+	if m == nil {
+		return true
+	}
+	for key := range *m {
+		if key != "level" {
+			return false
+		}
+	}
+	return true
+}
+
+// toReadPref converts a read preference from a request into the driver's
+// ReadPref, or returns nil if there is no read preference.
+func toReadPref(p *messages.ReadPreference) (*readpref.ReadPref, error) {
+	if p == nil {
+		return nil, nil
+	}
+	mode, err := readpref.ModeFromString(p.Mode)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := make([]readpref.Option, 0)
+	if p.MaxStalenessSeconds > 0 {
+		opts = append(opts,
+			readpref.WithMaxStaleness(time.Duration(p.MaxStalenessSeconds)*time.Second))
+	}
+	tagSets := make([]tag.Set, 0)
+	for _, m := range p.TagSets {
+		tags := make(map[string]string)
+		for name, value := range m {
+			tags[name] = convert.ToString(value)
+		}
+		tagSets = append(tagSets, tag.NewTagSetFromMap(tags))
+	}
+	// a single empty tag set matches any member, the same as none
+	if len(tagSets) > 0 && !(len(tagSets) == 1 && len(tagSets[0]) == 0) {
+		opts = append(opts, readpref.WithTagSets(tagSets...))
+	}
+	return readpref.New(mode, opts...)
+}
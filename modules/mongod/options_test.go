@@ -0,0 +1,31 @@
+package mongod
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestReadConcern(t *testing.T) {
+	Convey("Convert the read concern of a request", t, func() {
+		Convey("without one", func() {
+			So(toReadConcern(nil), ShouldBeNil)
+			So(levelOnly(nil), ShouldBeTrue)
+		})
+
+		Convey("with a level", func() {
+			readConcern := bson.M{"level": "majority"}
+			So(toReadConcern(&readConcern).GetLevel(), ShouldEqual, "majority")
+			So(levelOnly(&readConcern), ShouldBeTrue)
+		})
+
+		Convey("reading at or after a cluster time, which the driver can't send", func() {
+			after := bson.M{"level": "majority", "afterClusterTime": primitive.Timestamp{T: 1700000000, I: 1}}
+			So(levelOnly(&after), ShouldBeFalse)
+			at := bson.M{"level": "snapshot", "atClusterTime": primitive.Timestamp{T: 1700000000, I: 1}}
+			So(levelOnly(&at), ShouldBeFalse)
+		})
+	})
+}
@@ -0,0 +1,215 @@
+package mongod
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/WyattNielsen/mongoproxy/bsonutil"
+	"github.com/WyattNielsen/mongoproxy/convert"
+	"github.com/WyattNielsen/mongoproxy/messages"
+	"github.com/WyattNielsen/mongoproxy/server"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// isAuthCommand returns true if a command authenticates its connection.
+func isAuthCommand(commandName string) bool {
+	switch commandName {
+	case "saslStart", "saslContinue", "authenticate":
+		return true
+	default:
+		return false
+	}
+}
+
+// passthrough sends a request over the backend connection pinned to the client
+// connection it came from, and writes the backend's reply to the response. The
+// request goes as the client sent it, with its session, so that the backend runs
+// it as the user the client authenticated as on that connection.
+func (m *MongodModule) passthrough(ctx server.Context, req messages.Requester,
+	res messages.Responder) {
+
+	database, command, err := passthroughCommand(req)
+	if err != nil {
+		res.Error(badValue, err.Error())
+		return
+	}
+	command = append(command, bson.E{Key: "$db", Value: database})
+	if info := messages.SessionOf(req); info != nil {
+		command = append(command, info.Fields()...)
+	}
+
+	p, err := m.pinned.checkout(ctx)
+	if err != nil {
+		m.Logger.Warnf("Error connecting to the backend: %v", err)
+		res.Error(hostUnreachable, err.Error())
+		return
+	}
+	commandName := command[0].Key
+	if c, ok := req.(messages.Command); ok && commandName != "saslContinue" &&
+		isAuthCommand(commandName) {
+		p.user = userKey(c.Database, authUser(c))
+	}
+	reply, err := p.roundTrip(ctx, command)
+	ok := err == nil && convert.ToInt(bsonutil.FindValueByKey("ok", reply)) == 1
+	if ok && isAuthCommand(commandName) {
+		// saslStart and saslContinue are steps of a conversation, which is
+		// over once the backend says it is done
+		done := convert.ToBool(bsonutil.FindValueByKey("done", reply))
+		if commandName == "authenticate" || done {
+			p.authenticated = true
+			ctx.Conn.SetUser(p.user)
+		}
+	}
+	m.pinned.release(p)
+
+	if err != nil {
+		m.Logger.Warnf("Error running command %v on the pinned connection: %v", commandName, err)
+		res.Error(hostUnreachable, err.Error())
+		return
+	}
+	if !ok {
+		res.Fail(replyError(reply))
+		return
+	}
+	res.Write(passthroughResponse(req, reply))
+}
+
+// authUser returns the name of the user a saslStart or an authenticate command
+// authenticates as. A SCRAM conversation gives it in the client's first
+// message, after its header, as "n=name".
+func authUser(command messages.Command) string {
+	if command.CommandName == "authenticate" {
+		return convert.ToString(command.GetArg("user"))
+	}
+	fields := strings.Split(string(saslPayload(command.GetArg("payload"))), ",")
+	for i, field := range fields {
+		if i >= 2 && strings.HasPrefix(field, "n=") {
+			name := strings.TrimPrefix(field, "n=")
+			return strings.NewReplacer("=2C", ",", "=3D", "=").Replace(name)
+		}
+	}
+	return ""
+}
+
+// passthroughCommand returns the command document of a request, and the
+// database to run it on.
+func passthroughCommand(req messages.Requester) (string, bson.D, error) {
+	switch t := req.(type) {
+	case messages.Command:
+		return t.Database, t.ToBSON(), nil
+	case messages.Find:
+		if t.Explain {
+			return t.Database, bson.D{{Key: "explain", Value: t.ToBSON()}}, nil
+		}
+		return t.Database, t.ToBSON(), nil
+	case messages.GetMore:
+		return t.Database, t.ToBSON(), nil
+	case messages.Insert:
+		return t.Database, t.ToBSON(), nil
+	case messages.Update:
+		return t.Database, t.ToBSON(), nil
+	case messages.Delete:
+		return t.Database, t.ToBSON(), nil
+	case messages.KillCursors:
+		if t.Database == "" {
+			return "", nil, fmt.Errorf("killCursors needs a namespace in auth passthrough")
+		}
+		return t.Database, t.ToBSON(), nil
+	case messages.Aggregate:
+		return t.Database, t.ToBSON(), nil
+	case messages.Count:
+		return t.Database, t.ToBSON(), nil
+	case messages.Distinct:
+		return t.Database, t.ToBSON(), nil
+	case messages.FindAndModify:
+		return t.Database, t.ToBSON(), nil
+	case messages.CreateIndexes:
+		return t.Database, t.ToBSON(), nil
+	}
+	return "", nil, fmt.Errorf("unsupported operation %v", req.Type())
+}
+
+// passthroughResponse returns the response to a request from the backend's
+// successful reply. Cursors keep the backend's IDs, since the getMores of a
+// client in passthrough go to the backend as they are.
+func passthroughResponse(req messages.Requester, reply bson.D) messages.ResponseWriter {
+	replyMap := reply.Map()
+	cursor := convert.ToBSONMap(replyMap["cursor"])
+
+	switch t := req.(type) {
+	case messages.Find:
+		if t.Explain {
+			return messages.FindResponse{
+				Database:   t.Database,
+				Collection: t.Collection,
+				Documents:  []bson.D{reply},
+			}
+		}
+		docs, _ := convert.ConvertToBSONDocSlice(cursor["firstBatch"])
+		return messages.FindResponse{
+			CursorID:   convert.ToInt64(cursor["id"]),
+			Database:   t.Database,
+			Collection: t.Collection,
+			Documents:  docs,
+		}
+
+	case messages.Aggregate:
+		if cursor == nil {
+			// an explain
+			return messages.CommandResponse{Reply: replyMap}
+		}
+		docs, _ := convert.ConvertToBSONDocSlice(cursor["firstBatch"])
+		return messages.AggregateResponse{
+			CursorID:             convert.ToInt64(cursor["id"]),
+			Database:             t.Database,
+			Collection:           t.Namespace(),
+			Documents:            docs,
+			ChangeStream:         t.IsChangeStream(),
+			PostBatchResumeToken: convert.ToBSONDoc(cursor["postBatchResumeToken"]),
+		}
+
+	case messages.GetMore:
+		docs, _ := convert.ConvertToBSONDocSlice(cursor["nextBatch"])
+		token := convert.ToBSONDoc(cursor["postBatchResumeToken"])
+		return messages.GetMoreResponse{
+			CursorID:             convert.ToInt64(cursor["id"]),
+			Database:             t.Database,
+			Collection:           t.Collection,
+			Documents:            docs,
+			ChangeStream:         token != nil,
+			PostBatchResumeToken: token,
+		}
+
+	case messages.Insert:
+		return insertResponse(replyMap)
+
+	case messages.Update:
+		return updateResponse(reply)
+
+	case messages.Delete:
+		return deleteResponse(replyMap)
+
+	case messages.KillCursors:
+		response := messages.KillCursorsResponse{}
+		response.CursorsKilled, _ = convert.ConvertToInt64Slice(replyMap["cursorsKilled"])
+		response.CursorsNotFound, _ = convert.ConvertToInt64Slice(replyMap["cursorsNotFound"])
+		response.CursorsAlive, _ = convert.ConvertToInt64Slice(replyMap["cursorsAlive"])
+		response.CursorsUnknown, _ = convert.ConvertToInt64Slice(replyMap["cursorsUnknown"])
+		return response
+	}
+
+	return messages.CommandResponse{Reply: replyMap}
+}
+
+// replyError returns the error of a failed reply, keeping its code, code name
+// and labels.
+func replyError(reply bson.D) *messages.ResponderError {
+	r := reply.Map()
+	labels, _ := convert.ConvertToStringSlice(r["errorLabels"])
+	return &messages.ResponderError{
+		ErrorCode: convert.ToInt32(r["code"]),
+		CodeName:  convert.ToString(r["codeName"]),
+		Message:   convert.ToString(r["errmsg"]),
+		Labels:    labels,
+	}
+}
@@ -0,0 +1,217 @@
+package mongod
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/WyattNielsen/mongoproxy/messages"
+	"github.com/WyattNielsen/mongoproxy/server"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// errConnectionLost is returned for the requests of a client connection whose
+// backend connection was lost after the client authenticated on it, since a new
+// connection wouldn't be authenticated as the client's user.
+var errConnectionLost = fmt.Errorf(
+	"the connection to the backend was lost, reconnect and authenticate again")
+
+// A pinnedConn is the backend connection of a client connection in auth
+// passthrough. The client's own authentication conversation runs on it, so that
+// the client's requests run as the client's user, with its privileges.
+type pinnedConn struct {
+	// mu serializes the requests of the connection, since a request and its
+	// reply can't be interleaved with another's.
+	mu sync.Mutex
+
+	// conn is nil once the connection is lost.
+	conn      net.Conn
+	requestID int32
+
+	// authenticated is true once a client authenticated on the connection,
+	// and user is the user, as "db.user", that it authenticates or
+	// authenticated as.
+	authenticated bool
+	user          string
+}
+
+// roundTrip sends a command on the connection and returns the backend's reply.
+// The connection is closed if sending or reading fails, since the position in
+// the stream of replies is lost.
+func (p *pinnedConn) roundTrip(ctx context.Context, command bson.D) (bson.D, error) {
+	if p.conn == nil {
+		return nil, errConnectionLost
+	}
+
+	p.requestID++
+	b, err := messages.EncodeMsgRequest(p.requestID, command)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline, _ := ctx.Deadline()
+	p.conn.SetDeadline(deadline)
+
+	_, err = p.conn.Write(b)
+	if err != nil {
+		p.close()
+		return nil, err
+	}
+	header, reply, err := messages.DecodeMsgReply(p.conn)
+	if err == nil && header.ResponseTo != p.requestID {
+		err = fmt.Errorf("reply to request %v, expected %v", header.ResponseTo, p.requestID)
+	}
+	if err != nil {
+		p.close()
+		return nil, err
+	}
+	return reply, nil
+}
+
+// close closes the connection.
+func (p *pinnedConn) close() {
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+}
+
+// A pinnedRegistry holds the backend connections of client connections in auth
+// passthrough, keyed by the IDs of the client connections. A backend connection
+// is closed when its client connection is.
+type pinnedRegistry struct {
+	mu    sync.Mutex
+	conns map[int64]*pinnedConn
+
+	// dial opens a new connection to the backend.
+	dial func() (net.Conn, error)
+}
+
+func newPinnedRegistry(dial func() (net.Conn, error)) *pinnedRegistry {
+	return &pinnedRegistry{
+		conns: make(map[int64]*pinnedConn),
+		dial:  dial,
+	}
+}
+
+// checkout returns the backend connection of a client connection, dialing one
+// if the client connection is new, or its backend connection was lost before
+// the client authenticated on it. The connection is locked until it is released.
+func (r *pinnedRegistry) checkout(ctx server.Context) (*pinnedConn, error) {
+	r.mu.Lock()
+	p, ok := r.conns[ctx.Conn.ID]
+	if !ok {
+		p = &pinnedConn{}
+		r.conns[ctx.Conn.ID] = p
+		forgetOnClose(ctx, r.forget)
+	}
+	r.mu.Unlock()
+
+	p.mu.Lock()
+	if p.conn == nil && !p.authenticated {
+		conn, err := r.dial()
+		if err != nil {
+			p.mu.Unlock()
+			return nil, err
+		}
+		p.conn = conn
+	}
+	return p, nil
+}
+
+// release unlocks a checked out connection.
+func (r *pinnedRegistry) release(p *pinnedConn) {
+	p.mu.Unlock()
+}
+
+// forget closes the backend connection of a client connection that was closed.
+func (r *pinnedRegistry) forget(id int64) {
+	r.mu.Lock()
+	p, ok := r.conns[id]
+	delete(r.conns, id)
+	r.mu.Unlock()
+
+	if ok {
+		// wait for a request still running on the connection
+		p.mu.Lock()
+		p.close()
+		p.mu.Unlock()
+	}
+}
+
+// close closes every backend connection, for the module to shut down.
+func (r *pinnedRegistry) close() {
+	r.mu.Lock()
+	ids := make([]int64, 0, len(r.conns))
+	for id := range r.conns {
+		ids = append(ids, id)
+	}
+	r.mu.Unlock()
+
+	for _, id := range ids {
+		r.forget(id)
+	}
+}
+
+// forgetOnClose calls forget with the ID of a client connection once the
+// connection is closed.
+func forgetOnClose(ctx server.Context, forget func(id int64)) {
+	if ctx.Done() == nil {
+		return
+	}
+	go func() {
+		<-ctx.Done()
+		forget(ctx.Conn.ID)
+	}()
+}
+
+// dialPinned opens a new connection for auth passthrough to the primary of the
+// module's own backend, as its client sees it, or else to its first address.
+func (m *MongodModule) dialPinned() (net.Conn, error) {
+	address := m.Addresses[0]
+	if client, err := m.connect(); err == nil {
+		reply := bson.M{}
+		err = client.Database("admin").RunCommand(context.Background(),
+			bson.D{{Key: "isMaster", Value: 1}}).Decode(&reply)
+		if primary, ok := reply["primary"].(string); err == nil && ok && primary != "" {
+			address = primary
+		}
+	}
+
+	tlsConfig, err := pinnedTLSConfig(m.ConnectionString, address)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: m.Timeout}
+	if tlsConfig != nil {
+		return tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+	}
+	return dialer.Dial("tcp", address)
+}
+
+// pinnedTLSConfig returns the TLS configuration of a pinned connection to the
+// given address, or nil if the backend isn't reached over TLS. It is the one
+// the driver's client gets from the connection string, with its CA file,
+// client certificate and tlsInsecure.
+func pinnedTLSConfig(connectionString string, address string) (*tls.Config, error) {
+	opts := options.Client().ApplyURI(connectionString)
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.TLSConfig == nil {
+		return nil, nil
+	}
+
+	config := opts.TLSConfig.Clone()
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		config.ServerName = host
+	}
+	return config, nil
+}
@@ -0,0 +1,54 @@
+package mongod
+
+import (
+	"fmt"
+
+	"github.com/WyattNielsen/mongoproxy/messages"
+	"github.com/WyattNielsen/mongoproxy/server"
+	log "github.com/sirupsen/logrus"
+)
+
+// notWritablePrimary is the code a secondary rejects writes with, which
+// read-only mode uses unless it is configured with another code.
+const notWritablePrimary = 10107
+
+// rejectWrite fails a write the module won't send to the backend because it is
+// read-only, and logs the attempt with the client connection that made it.
+func (m *MongodModule) rejectWrite(ctx server.Context, req messages.Requester,
+	res messages.Responder) {
+	commandName := req.Type()
+	if command, ok := req.(messages.Command); ok {
+		commandName = command.CommandName
+	}
+	database, collection := messages.NamespaceOf(req)
+	namespace := database
+	if collection != "" {
+		namespace += "." + collection
+	}
+
+	fields := log.Fields{
+		"command":    commandName,
+		"namespace":  namespace,
+		"connection": ctx.Conn.ID,
+	}
+	if ctx.Conn.RemoteAddr != nil {
+		fields["client"] = ctx.Conn.RemoteAddr.String()
+	}
+	if appName := ctx.Conn.AppName(); appName != "" {
+		fields["appName"] = appName
+	}
+	if user := ctx.Conn.User(); user != "" {
+		fields["user"] = user
+	}
+	if info := messages.SessionOf(req); info != nil {
+		fields["lsid"] = info.LSID
+	}
+	m.Logger.WithFields(fields).Warnf("Blocked %v on %v in read-only mode", commandName, namespace)
+
+	code := m.ReadOnlyCode
+	if code == 0 {
+		code = notWritablePrimary
+	}
+	res.Error(code, fmt.Sprintf("not primary: %v on %v is not allowed, the proxy is read-only",
+		commandName, namespace))
+}
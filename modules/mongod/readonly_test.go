@@ -0,0 +1,64 @@
+package mongod
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/WyattNielsen/mongoproxy/messages"
+	"github.com/WyattNielsen/mongoproxy/server"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestReadOnly(t *testing.T) {
+	Convey("Reject writes in read-only mode", t, func() {
+		output := &bytes.Buffer{}
+		logger := log.New()
+		logger.Out = output
+		logger.Formatter = &log.JSONFormatter{}
+
+		m := &MongodModule{Logger: logger, ReadOnly: true}
+		conn := server.NewConn(7, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 5), Port: 51234})
+		conn.SetAppName("reports")
+		conn.SetUser("admin.analyst")
+		ctx := server.NewContext(context.Background(), conn)
+
+		res := &messages.ModuleResponse{}
+		m.Process(ctx, messages.Insert{Database: "shop", Collection: "orders",
+			Documents: []bson.D{{{Key: "total", Value: 12}}}}, res,
+			func(server.Context, messages.Requester, messages.Responder) {})
+
+		Convey("with the not primary error", func() {
+			So(res.CommandError, ShouldNotBeNil)
+			So(res.CommandError.ErrorCode, ShouldEqual, notWritablePrimary)
+			So(res.Writer, ShouldBeNil)
+		})
+
+		Convey("and every command not known to be read-only", func() {
+			for _, name := range []string{"shutdown", "setParameter", "fsync", "replSetStepDown",
+				"killOp", "setFeatureCompatibilityVersion"} {
+				res := &messages.ModuleResponse{}
+				m.Process(ctx, messages.Command{CommandName: name, Database: "admin",
+					Args: bson.D{{Key: name, Value: 1}}}, res,
+					func(server.Context, messages.Requester, messages.Responder) {})
+				So(res.CommandError, ShouldNotBeNil)
+				So(res.CommandError.ErrorCode, ShouldEqual, notWritablePrimary)
+			}
+		})
+
+		Convey("logging the client that sent them", func() {
+			entry := map[string]interface{}{}
+			So(json.Unmarshal(output.Bytes(), &entry), ShouldBeNil)
+			So(entry["command"], ShouldEqual, messages.InsertType)
+			So(entry["namespace"], ShouldEqual, "shop.orders")
+			So(entry["connection"], ShouldEqual, 7)
+			So(entry["client"], ShouldEqual, "10.0.0.5:51234")
+			So(entry["appName"], ShouldEqual, "reports")
+			So(entry["user"], ShouldEqual, "admin.analyst")
+		})
+	})
+}
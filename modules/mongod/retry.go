@@ -0,0 +1,149 @@
+package mongod
+
+import (
+	"context"
+	"sync"
+
+	"github.com/WyattNielsen/mongoproxy/messages"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// retryableCodes are the codes of the errors after which a write can be retried,
+// for backends older than 4.4, which don't label them with RetryableWriteError.
+var retryableCodes = map[int32]bool{
+	6:     true, // HostUnreachable
+	7:     true, // HostNotFound
+	89:    true, // NetworkTimeout
+	91:    true, // ShutdownInProgress
+	189:   true, // PrimarySteppedDown
+	262:   true, // ExceededTimeLimit
+	9001:  true, // SocketException
+	10107: true, // NotWritablePrimary
+	11600: true, // InterruptedAtShutdown
+	11602: true, // InterruptedDueToReplStateChange
+	13435: true, // NotPrimaryNoSecondaryOk
+	13436: true, // NotPrimaryOrSecondary
+}
+
+// isRetryable returns true if a write that failed with err can be retried.
+func isRetryable(err error) bool {
+	cErr, ok := err.(mongo.CommandError)
+	if !ok {
+		return false
+	}
+	return cErr.HasErrorLabel("RetryableWriteError") || cErr.HasErrorLabel("NetworkError") ||
+		retryableCodes[cErr.Code]
+}
+
+// retryableWritesSupported returns true if a backend's reply to isMaster shows
+// that it supports retryable writes, which only replica set members and mongos
+// with logical sessions do. A standalone rejects writes with a txnNumber.
+func retryableWritesSupported(reply bson.M) bool {
+	if _, ok := reply["logicalSessionTimeoutMinutes"]; !ok {
+		return false
+	}
+	setName, _ := reply["setName"].(string)
+	msg, _ := reply["msg"].(string)
+	return setName != "" || msg == "isdbgrid"
+}
+
+// A retrySupport remembers which backends support retryable writes, keyed by
+// their clients, so that each backend is only asked once.
+type retrySupport struct {
+	mu        sync.Mutex
+	supported map[*mongo.Client]bool
+}
+
+// supports returns true if the backend of a client supports retryable writes.
+// If the backend can't be asked, the write is sent as it is, and the backend is
+// asked again for the next one.
+func (r *retrySupport) supports(ctx context.Context, client *mongo.Client) bool {
+	r.mu.Lock()
+	supported, ok := r.supported[client]
+	r.mu.Unlock()
+	if ok {
+		return supported
+	}
+
+	reply := bson.M{}
+	err := client.Database("admin").RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&reply)
+	if err != nil {
+		return false
+	}
+	supported = retryableWritesSupported(reply)
+
+	r.mu.Lock()
+	if r.supported == nil {
+		r.supported = make(map[*mongo.Client]bool)
+	}
+	r.supported[client] = supported
+	r.mu.Unlock()
+	return supported
+}
+
+// A writeSession is the session of the request a write comes from.
+type writeSession struct {
+	// info is the client's session, or nil if the request wasn't sent in one,
+	// and session is the backend session it is mapped to.
+	info    *messages.Session
+	session *proxySession
+}
+
+// runWrite runs a write command, and decodes its reply into reply.
+//
+// A retryable write runs with a txnNumber, so that the backend applies it only
+// once however many times it is sent, and is retried once if it fails with a
+// retryable error, such as a failover of the backend's primary. The retry goes
+// to the new primary. If the retry fails too, the error is labelled with
+// RetryableWriteError so that the client can retry it as well.
+//
+// A write the client sent with a txnNumber keeps it as its identity: sending
+// it again with the same txnNumber sends it again under the same backend
+// txnNumber. A write sent outside of a session gets a txnNumber from the proxy.
+// Writes in a transaction, and writes in a session without a txnNumber, which
+// the client chose not to retry, are sent once, as are writes to a backend that
+// doesn't support retryable writes, such as a standalone.
+func (m *MongodModule) runWrite(ctx context.Context, db *mongo.Database, command bson.D,
+	retryable bool, w writeSession, reply interface{}) error {
+
+	if !retryable || (w.info != nil && (w.info.Transaction || w.info.TxnNumber == 0)) ||
+		!m.retrySupport.supports(ctx, db.Client()) {
+		return db.RunCommand(ctx, command).Decode(reply)
+	}
+
+	var txnNumber int64
+	if w.info == nil {
+		// the proxy owns the retry, in a session of its own
+		session, err := db.Client().StartSession()
+		if err != nil {
+			return err
+		}
+		defer session.EndSession(ctx)
+		clientSession := session.(mongo.XSession).ClientSession()
+		clientSession.IncrementTxnNumber()
+		txnNumber = clientSession.TxnNumber
+		ctx = mongo.NewSessionContext(ctx, session)
+	} else {
+		var err error
+		txnNumber, err = w.session.writeTxnNumber(w.info.TxnNumber)
+		if err != nil {
+			return err
+		}
+	}
+
+	command = append(command[:len(command):len(command)], bson.E{Key: "txnNumber", Value: txnNumber})
+	err := db.RunCommand(ctx, command).Decode(reply)
+	if err == nil || !isRetryable(err) {
+		return err
+	}
+
+	m.Logger.Infof("Retrying %v after error: %v", command[0].Key, err)
+	err = db.RunCommand(ctx, command).Decode(reply)
+	if cErr, ok := err.(mongo.CommandError); ok && isRetryable(err) &&
+		!cErr.HasErrorLabel("RetryableWriteError") {
+		cErr.Labels = append(cErr.Labels, "RetryableWriteError")
+		return cErr
+	}
+	return err
+}
@@ -0,0 +1,29 @@
+package mongod
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestRetryableWritesSupported(t *testing.T) {
+	Convey("Only retry writes on backends that support retryable writes", t, func() {
+		cases := []struct {
+			name      string
+			reply     bson.M
+			supported bool
+		}{
+			{"a replica set member", bson.M{"setName": "rs0", "logicalSessionTimeoutMinutes": 30}, true},
+			{"a mongos", bson.M{"msg": "isdbgrid", "logicalSessionTimeoutMinutes": 30}, true},
+			{"a standalone", bson.M{"logicalSessionTimeoutMinutes": 30}, false},
+			{"a replica set member without sessions", bson.M{"setName": "rs0"}, false},
+			{"a mongos without sessions", bson.M{"msg": "isdbgrid"}, false},
+		}
+		for _, c := range cases {
+			Convey("for "+c.name, func() {
+				So(retryableWritesSupported(c.reply), ShouldEqual, c.supported)
+			})
+		}
+	})
+}
@@ -0,0 +1,373 @@
+package mongod
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/WyattNielsen/mongoproxy/convert"
+	"github.com/WyattNielsen/mongoproxy/messages"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// defaultBackend is the name routes use for the module's own backend, which
+// gets the namespaces that no route matches.
+const defaultBackend = "default"
+
+// A backend is a database that routes send namespaces to, with a client of its
+// own, so that it has its own connection pool, credentials and timeouts.
+type backend struct {
+	name             string
+	connectionString string
+	compressors      []string
+	timeout          time.Duration
+
+	mu     sync.Mutex
+	client *mongo.Client
+}
+
+func newBackend(config BackendConfig) *backend {
+	return &backend{
+		name:             config.Name,
+		connectionString: config.AsConnectionString(),
+		compressors:      config.Compressors,
+		timeout:          config.Timeout,
+	}
+}
+
+// connect returns the backend's client, connecting it if it isn't connected yet.
+// If connecting fails, the next request tries again.
+func (b *backend) connect() (*mongo.Client, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.client != nil {
+		return b.client, nil
+	}
+	client, err := dial(b.connectionString, b.compressors, b.timeout)
+	if err != nil {
+		return nil, err
+	}
+	b.client = client
+	return client, nil
+}
+
+// disconnect disconnects the backend's client, if it is connected.
+func (b *backend) disconnect(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.client == nil {
+		return nil
+	}
+	return b.client.Disconnect(ctx)
+}
+
+// dial connects a new client to a backend.
+func dial(connectionString string, compressors []string, timeout time.Duration) (*mongo.Client, error) {
+	opts := options.Client().ApplyURI(connectionString)
+	if len(compressors) > 0 {
+		opts.SetCompressors(compressors)
+	}
+	if timeout > 0 {
+		opts.SetConnectTimeout(timeout)
+	}
+	return mongo.Connect(context.TODO(), opts)
+}
+
+// A namespacePattern matches namespaces by their database and collection, each
+// of which is a name or a glob.
+type namespacePattern struct {
+	database   string
+	collection string
+}
+
+// matches returns true if the pattern matches the namespace database.collection.
+// Requests on a whole database, which have no collection, match the patterns
+// for every collection of the database.
+func (p namespacePattern) matches(database string, collection string) bool {
+	if !p.matchesDatabase(database) {
+		return false
+	}
+	ok, _ := path.Match(p.collection, collection)
+	return ok || (collection == "" && p.collection == "*")
+}
+
+// matchesDatabase returns true if the pattern matches some namespaces of database.
+func (p namespacePattern) matchesDatabase(database string) bool {
+	ok, _ := path.Match(p.database, database)
+	return ok
+}
+
+// A route sends the namespaces that match its pattern to a backend.
+type route struct {
+	namespacePattern
+	backend string
+}
+
+// A readPolicy sets the read preference of reads on the namespaces that match
+// its pattern, such as to send analytics to secondaries.
+type readPolicy struct {
+	namespacePattern
+	preference *messages.ReadPreference
+}
+
+// readPreferenceFor returns the read preference for a read, which is that of the
+// first policy that matches its namespace, or else the client's own. Reads in a
+// transaction keep the client's, since a transaction runs on the primary.
+func (m *MongodModule) readPreferenceFor(req messages.Requester) *messages.ReadPreference {
+	if info := messages.SessionOf(req); info == nil || !info.Transaction {
+		database, collection := messages.NamespaceOf(req)
+		for _, p := range m.readPolicies {
+			if p.matches(database, collection) {
+				return p.preference
+			}
+		}
+	}
+	return messages.ReadPreferenceOf(req)
+}
+
+// routeFor returns the name of the backend for a namespace, which is the
+// backend of the first route that matches it.
+func (m *MongodModule) routeFor(database string, collection string) string {
+	for _, r := range m.routes {
+		if r.matches(database, collection) {
+			return r.backend
+		}
+	}
+	return defaultBackend
+}
+
+// clientFor returns the client of the backend for a namespace.
+func (m *MongodModule) clientFor(database string, collection string) (*mongo.Client, error) {
+	return m.backendClient(m.routeFor(database, collection))
+}
+
+// backendClient returns the client of the named backend.
+func (m *MongodModule) backendClient(name string) (*mongo.Client, error) {
+	if name == defaultBackend {
+		return m.connect()
+	}
+	return m.backends[name].connect()
+}
+
+// transactionClient returns the client of the backend a request in a
+// transaction runs on, given the client of the backend it is routed to. A
+// transaction runs on the backend of its first command, where
+// commitTransaction and abortTransaction go as well, and a command of the
+// transaction that is routed to another backend fails, since a transaction
+// can't span backends.
+func (m *MongodModule) transactionClient(client *mongo.Client, req messages.Requester,
+	info *messages.Session) (*mongo.Client, error) {
+	if info.StartTransaction {
+		return client, m.sessions.startTransaction(info.LSID, info.TxnNumber, client)
+	}
+
+	txnClient := m.sessions.transactionClient(info.LSID, info.TxnNumber)
+	if txnClient == nil {
+		// the backend session fails the request for the unknown transaction
+		return client, nil
+	}
+	if command, ok := req.(messages.Command); ok {
+		switch command.CommandName {
+		case "commitTransaction", "abortTransaction":
+			return txnClient, nil
+		}
+	}
+	if client != txnClient {
+		database, collection := messages.NamespaceOf(req)
+		return nil, mongo.CommandError{
+			Code: operationNotSupportedInTransaction,
+			Name: "OperationNotSupportedInTransaction",
+			Message: fmt.Sprintf("%v.%v is on another backend than the rest of transaction %v",
+				database, collection, info.TxnNumber),
+		}
+	}
+	return client, nil
+}
+
+// serves returns true if a database on the named backend is visible through the
+// proxy. A database on the default backend is hidden if a route sends the whole
+// of it elsewhere, and a database on any other backend is hidden unless a route
+// sends some of it there.
+func (m *MongodModule) serves(name string, database string) bool {
+	for _, r := range m.routes {
+		if r.backend == name && r.matchesDatabase(database) {
+			return true
+		}
+	}
+	if name != defaultBackend {
+		return false
+	}
+	for _, r := range m.routes {
+		if r.collection == "*" && r.matchesDatabase(database) {
+			return false
+		}
+	}
+	return true
+}
+
+// backendNames returns the names of the module's backends, starting with its
+// own.
+func (m *MongodModule) backendNames() []string {
+	names := make([]string, 0, len(m.backends))
+	for name := range m.backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return append([]string{defaultBackend}, names...)
+}
+
+// splitsDatabase returns true if a route sends some of the collections of a
+// database to a backend other than the module's own, so that commands on the
+// whole database have to run on several backends.
+func (m *MongodModule) splitsDatabase(database string) bool {
+	for _, r := range m.routes {
+		if r.backend != defaultBackend && r.matchesDatabase(database) {
+			return true
+		}
+	}
+	return false
+}
+
+// listDatabases runs listDatabases on every backend, and writes the databases
+// they serve to the response.
+func (m *MongodModule) listDatabases(ctx context.Context, command messages.Command,
+	res messages.Responder) {
+
+	names := m.backendNames()
+	replies := make(map[string]bson.M)
+	for _, name := range names {
+		client, err := m.backendClient(name)
+		reply := bson.M{}
+		if err == nil {
+			err = client.Database("admin").RunCommand(ctx, command.ToBSON()).Decode(&reply)
+		}
+		if err != nil {
+			m.Logger.Warnf("Error running command listDatabases on backend %v: %v", name, err)
+			writeError(res, err)
+			return
+		}
+		replies[name] = reply
+	}
+
+	reply := m.mergeDatabases(names, replies, convert.ToBool(command.GetArg("nameOnly")))
+	res.Write(messages.CommandResponse{Reply: reply})
+}
+
+// mergeDatabases merges the listDatabases replies of the named backends into
+// one, with the databases each of them serves. A database that is split between
+// backends is listed once, with its size summed.
+func (m *MongodModule) mergeDatabases(names []string, replies map[string]bson.M,
+	nameOnly bool) bson.M {
+
+	merged := make(map[string]bson.M)
+	for _, name := range names {
+		databases, _ := convert.ConvertToBSONMapSlice(replies[name]["databases"])
+		for _, database := range databases {
+			dbName := convert.ToString(database["name"])
+			if !m.serves(name, dbName) {
+				continue
+			}
+			existing, ok := merged[dbName]
+			if !ok {
+				merged[dbName] = database
+				continue
+			}
+			if size, ok := database["sizeOnDisk"]; ok {
+				existing["sizeOnDisk"] = convert.ToInt64(existing["sizeOnDisk"]) +
+					convert.ToInt64(size)
+			}
+			if empty, ok := database["empty"]; ok {
+				existing["empty"] = convert.ToBool(existing["empty"]) && convert.ToBool(empty)
+			}
+		}
+	}
+
+	dbNames := make([]string, 0, len(merged))
+	for dbName := range merged {
+		dbNames = append(dbNames, dbName)
+	}
+	sort.Strings(dbNames)
+
+	databases := make([]bson.M, len(dbNames))
+	totalSize := int64(0)
+	for i, dbName := range dbNames {
+		databases[i] = merged[dbName]
+		totalSize += convert.ToInt64(merged[dbName]["sizeOnDisk"])
+	}
+
+	reply := bson.M{"databases": databases}
+	if !nameOnly {
+		reply["totalSize"] = totalSize
+	}
+	return reply
+}
+
+// listCollections runs listCollections on every backend that serves some of a
+// database split between backends, and writes the collections that routes send
+// to each of them to the response, in a single batch.
+func (m *MongodModule) listCollections(ctx context.Context, command messages.Command,
+	res messages.Responder) {
+
+	filter := command.GetArg("filter")
+	if filter == nil {
+		filter = bson.D{}
+	}
+	opts := options.ListCollections()
+	if convert.ToBool(command.GetArg("nameOnly")) {
+		opts.SetNameOnly(true)
+	}
+
+	collections := make([]bson.M, 0)
+	for _, name := range m.backendNames() {
+		if !m.serves(name, command.Database) {
+			continue
+		}
+		client, err := m.backendClient(name)
+		var batch []bson.M
+		if err == nil {
+			var cursor *mongo.Cursor
+			cursor, err = client.Database(command.Database).ListCollections(ctx, filter, opts)
+			if err == nil {
+				err = cursor.All(ctx, &batch)
+			}
+		}
+		if err != nil {
+			m.Logger.Warnf("Error running command listCollections on backend %v: %v", name, err)
+			writeError(res, err)
+			return
+		}
+		collections = append(collections, m.routedCollections(name, command.Database, batch)...)
+	}
+
+	sort.Slice(collections, func(i, j int) bool {
+		return convert.ToString(collections[i]["name"]) < convert.ToString(collections[j]["name"])
+	})
+	res.Write(messages.CommandResponse{Reply: bson.M{
+		"cursor": bson.M{
+			"id":         int64(0),
+			"ns":         command.Database + ".$cmd.listCollections",
+			"firstBatch": collections,
+		},
+	}})
+}
+
+// routedCollections returns the collections of a database, as listed by the
+// named backend, that routes send to that backend.
+func (m *MongodModule) routedCollections(name string, database string,
+	collections []bson.M) []bson.M {
+
+	routed := make([]bson.M, 0, len(collections))
+	for _, c := range collections {
+		if m.routeFor(database, convert.ToString(c["name"])) == name {
+			routed = append(routed, c)
+		}
+	}
+	return routed
+}
@@ -0,0 +1,211 @@
+package mongod
+
+import (
+	"context"
+	"testing"
+
+	"github.com/WyattNielsen/mongoproxy/messages"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestReadPreferenceFor(t *testing.T) {
+	Convey("Read with the read preference the client sent to the proxy", t, func() {
+		m := &MongodModule{}
+		req := messages.Find{Database: "shop", Collection: "orders",
+			ReadPreference: &messages.ReadPreference{Mode: "secondary"}}
+
+		pref := m.readPreferenceFor(req)
+		So(pref, ShouldNotBeNil)
+		So(pref.Mode, ShouldEqual, "secondary")
+
+		Convey("unless a policy overrides it", func() {
+			m.readPolicies = []readPolicy{{namespacePattern{"shop", "*"},
+				&messages.ReadPreference{Mode: "nearest"}}}
+			So(m.readPreferenceFor(req).Mode, ShouldEqual, "nearest")
+		})
+	})
+}
+
+// routedModule returns a module that sends shop.orders and all of archive to
+// the "archive" backend, and analytics.events_* to the "events" backend.
+func routedModule() *MongodModule {
+	return &MongodModule{
+		backends: map[string]*backend{
+			"archive": {name: "archive"},
+			"events":  {name: "events"},
+		},
+		routes: []route{
+			{namespacePattern{"shop", "orders"}, "archive"},
+			{namespacePattern{"archive", "*"}, "archive"},
+			{namespacePattern{"analytics", "events_*"}, "events"},
+		},
+	}
+}
+
+func TestNamespacePattern(t *testing.T) {
+	Convey("Match namespaces against patterns", t, func() {
+		cases := []struct {
+			pattern    namespacePattern
+			database   string
+			collection string
+			matches    bool
+		}{
+			{namespacePattern{"shop", "orders"}, "shop", "orders", true},
+			{namespacePattern{"shop", "orders"}, "shop", "carts", false},
+			{namespacePattern{"shop", "orders"}, "shop", "", false},
+			{namespacePattern{"shop", "*"}, "shop", "carts", true},
+			{namespacePattern{"shop", "*"}, "shop", "", true},
+			{namespacePattern{"shop", "*"}, "store", "carts", false},
+			{namespacePattern{"logs_*", "*"}, "logs_2024", "app", true},
+			{namespacePattern{"analytics", "events_*"}, "analytics", "events_click", true},
+			{namespacePattern{"analytics", "events_*"}, "analytics", "", false},
+		}
+		for _, c := range cases {
+			So(c.pattern.matches(c.database, c.collection), ShouldEqual, c.matches)
+		}
+	})
+}
+
+func TestRouting(t *testing.T) {
+	Convey("Route namespaces to backends", t, func() {
+		m := routedModule()
+
+		Convey("with the first route that matches", func() {
+			cases := []struct {
+				database   string
+				collection string
+				backend    string
+			}{
+				{"shop", "orders", "archive"},
+				{"shop", "carts", defaultBackend},
+				{"shop", "", defaultBackend},
+				{"archive", "orders", "archive"},
+				{"archive", "", "archive"},
+				{"analytics", "events_click", "events"},
+				{"analytics", "sessions", defaultBackend},
+			}
+			for _, c := range cases {
+				So(m.routeFor(c.database, c.collection), ShouldEqual, c.backend)
+			}
+		})
+
+		Convey("showing each database on the backends that hold some of it", func() {
+			cases := []struct {
+				backend  string
+				database string
+				serves   bool
+			}{
+				{defaultBackend, "shop", true},
+				{"archive", "shop", true},
+				{"events", "shop", false},
+				{defaultBackend, "archive", false},
+				{"archive", "archive", true},
+				{"events", "analytics", true},
+				{"archive", "analytics", false},
+			}
+			for _, c := range cases {
+				So(m.serves(c.backend, c.database), ShouldEqual, c.serves)
+			}
+			So(m.splitsDatabase("shop"), ShouldBeTrue)
+			So(m.splitsDatabase("analytics"), ShouldBeTrue)
+			So(m.splitsDatabase("local"), ShouldBeFalse)
+		})
+
+		Convey("merging their lists of databases", func() {
+			replies := map[string]bson.M{
+				defaultBackend: {"databases": bson.A{
+					bson.M{"name": "shop", "sizeOnDisk": int64(100), "empty": false},
+					bson.M{"name": "archive", "sizeOnDisk": int64(5), "empty": false},
+					bson.M{"name": "analytics", "sizeOnDisk": int64(10), "empty": false},
+				}},
+				"archive": {"databases": bson.A{
+					bson.M{"name": "shop", "sizeOnDisk": int64(50), "empty": false},
+					bson.M{"name": "archive", "sizeOnDisk": int64(500), "empty": false},
+					bson.M{"name": "internal", "sizeOnDisk": int64(1), "empty": false},
+				}},
+				"events": {"databases": bson.A{
+					bson.M{"name": "analytics", "sizeOnDisk": int64(1000), "empty": true},
+				}},
+			}
+
+			reply := m.mergeDatabases(m.backendNames(), replies, false)
+			databases := reply["databases"].([]bson.M)
+			names := []string{}
+			for _, d := range databases {
+				names = append(names, d["name"].(string))
+			}
+			So(names, ShouldResemble, []string{"analytics", "archive", "shop"})
+			So(databases[0]["sizeOnDisk"], ShouldEqual, 1010)
+			So(databases[0]["empty"], ShouldBeFalse)
+			So(databases[1]["sizeOnDisk"], ShouldEqual, 500)
+			So(databases[2]["sizeOnDisk"], ShouldEqual, 150)
+			So(reply["totalSize"], ShouldEqual, 1660)
+
+			reply = m.mergeDatabases(m.backendNames(), replies, true)
+			So(reply, ShouldNotContainKey, "totalSize")
+		})
+
+		Convey("and their lists of collections", func() {
+			listed := []bson.M{{"name": "orders"}, {"name": "carts"}}
+			So(m.routedCollections(defaultBackend, "shop", listed),
+				ShouldResemble, []bson.M{{"name": "carts"}})
+			So(m.routedCollections("archive", "shop", listed),
+				ShouldResemble, []bson.M{{"name": "orders"}})
+		})
+	})
+}
+
+func TestTransactionRouting(t *testing.T) {
+	Convey("Keep a transaction on the backend it started on", t, func() {
+		m := &MongodModule{sessions: newSessionRegistry(0)}
+		shop, err := mongo.NewClient(options.Client())
+		So(err, ShouldBeNil)
+		archive, err := mongo.NewClient(options.Client())
+		So(err, ShouldBeNil)
+
+		lsid := bson.D{{Key: "id", Value: "abc"}}
+		inTransaction := func(start bool) *messages.Session {
+			return &messages.Session{LSID: lsid, TxnNumber: 4, Transaction: true,
+				StartTransaction: start}
+		}
+
+		client, err := m.transactionClient(shop,
+			messages.Find{Database: "shop", Collection: "carts"}, inTransaction(true))
+		So(err, ShouldBeNil)
+		So(client, ShouldEqual, shop)
+
+		Convey("running its commands there", func() {
+			client, err := m.transactionClient(shop,
+				messages.Insert{Database: "shop", Collection: "carts"}, inTransaction(false))
+			So(err, ShouldBeNil)
+			So(client, ShouldEqual, shop)
+		})
+
+		Convey("committing and aborting it there", func() {
+			for _, name := range []string{"commitTransaction", "abortTransaction"} {
+				client, err := m.transactionClient(archive,
+					messages.Command{CommandName: name, Database: "admin"}, inTransaction(false))
+				So(err, ShouldBeNil)
+				So(client, ShouldEqual, shop)
+			}
+		})
+
+		Convey("rejecting commands routed to another backend", func() {
+			_, err := m.transactionClient(archive,
+				messages.Find{Database: "archive", Collection: "orders"}, inTransaction(false))
+			So(err, ShouldNotBeNil)
+			So(err.(mongo.CommandError).Code, ShouldEqual, operationNotSupportedInTransaction)
+		})
+
+		Convey("forgetting it when the session ends", func() {
+			m.sessions.end(context.Background(), []bson.D{lsid})
+			client, err := m.transactionClient(archive,
+				messages.Command{CommandName: "commitTransaction", Database: "admin"}, inTransaction(false))
+			So(err, ShouldBeNil)
+			So(client, ShouldEqual, archive)
+		})
+	})
+}
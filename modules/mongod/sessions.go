@@ -0,0 +1,348 @@
+package mongod
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/WyattNielsen/mongoproxy/messages"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	driversession "go.mongodb.org/mongo-driver/x/mongo/driver/session"
+)
+
+// DefaultSessionTimeout is how long a client's session can sit idle before its
+// backend session is ended, matching the default logical session timeout of mongod.
+const DefaultSessionTimeout = 30 * time.Minute
+
+// A proxySession is the backend session a client's logical session is mapped to.
+// Every request the client sends in its session runs in the backend session, so
+// that the backend sees the transactions of the client.
+type proxySession struct {
+	// mu serializes the requests of the session, since a backend session can
+	// only run one request at a time.
+	mu sync.Mutex
+
+	session mongo.Session
+
+	// txnNumber is the client's number for the session's current or last
+	// transaction or retryable write, and active is true while a transaction
+	// is in progress.
+	txnNumber int64
+	active    bool
+
+	lastUsed time.Time
+}
+
+// begin prepares the backend session for a request in the client's session, and
+// returns the context to run the request in. The first command of a transaction
+// starts it. A command for a transaction that isn't the session's current one
+// fails with NoSuchTransaction.
+func (s *proxySession) begin(ctx context.Context, info *messages.Session) (context.Context, error) {
+	if info.StartTransaction {
+		if s.active {
+			// the client moved on from a transaction it didn't finish
+			s.session.AbortTransaction(ctx)
+			s.active = false
+		}
+		opts := options.Transaction()
+		if readConcern := toReadConcern(info.ReadConcern); readConcern != nil {
+			opts.SetReadConcern(readConcern)
+		}
+		if err := s.session.StartTransaction(opts); err != nil {
+			return nil, err
+		}
+		s.txnNumber = info.TxnNumber
+		s.active = true
+	} else if info.Transaction && info.TxnNumber != s.txnNumber {
+		return nil, noSuchTransactionError(
+			fmt.Sprintf("Transaction %v has not been started", info.TxnNumber))
+	}
+
+	return mongo.NewSessionContext(ctx, s.session), nil
+}
+
+// writeTxnNumber returns the backend's txnNumber for a retryable write the
+// client sent with the given txnNumber. The backend session numbers its writes
+// itself, since it may have been used by other clients before, so a new
+// txnNumber of the client gets the backend session's next one, and a write the
+// client sends again gets the same one as before.
+func (s *proxySession) writeTxnNumber(txnNumber int64) (int64, error) {
+	clientSession := s.session.(mongo.XSession).ClientSession()
+	switch {
+	case txnNumber < s.txnNumber:
+		return 0, mongo.CommandError{
+			Code:    transactionTooOld,
+			Name:    "TransactionTooOld",
+			Message: fmt.Sprintf("txnNumber %v is older than %v", txnNumber, s.txnNumber),
+		}
+	case txnNumber > s.txnNumber:
+		clientSession.IncrementTxnNumber()
+		s.txnNumber = txnNumber
+	}
+	return clientSession.TxnNumber, nil
+}
+
+// commit commits the session's transaction. Committing a transaction again,
+// which clients do when they don't know whether it was committed, commits it
+// again at the backend.
+func (s *proxySession) commit(ctx context.Context) error {
+	err := s.session.CommitTransaction(ctx)
+	if err == driversession.ErrNoTransactStarted {
+		return noSuchTransactionError(
+			fmt.Sprintf("Transaction %v has not been started", s.txnNumber))
+	}
+	if err == nil {
+		s.active = false
+	}
+	return err
+}
+
+// abort aborts the session's transaction.
+func (s *proxySession) abort(ctx context.Context) error {
+	err := s.session.AbortTransaction(ctx)
+	switch err {
+	case driversession.ErrNoTransactStarted, driversession.ErrAbortTwice:
+		return noSuchTransactionError(
+			fmt.Sprintf("Transaction %v has been aborted", s.txnNumber))
+	case driversession.ErrAbortAfterCommit:
+		return mongo.CommandError{
+			Code:    transactionCommitted,
+			Name:    "TransactionCommitted",
+			Message: fmt.Sprintf("Transaction %v has been committed", s.txnNumber),
+		}
+	}
+	s.active = false
+	return err
+}
+
+// end aborts the session's transaction, if one is in progress, and ends the
+// backend session.
+func (s *proxySession) end(ctx context.Context) {
+	if s.active {
+		s.session.AbortTransaction(ctx)
+		s.active = false
+	}
+	s.session.EndSession(ctx)
+}
+
+// noSuchTransactionError returns an error like the one the backend returns for a
+// transaction it doesn't know, which clients retry the whole transaction on.
+func noSuchTransactionError(message string) error {
+	return mongo.CommandError{
+		Code:    noSuchTransaction,
+		Name:    "NoSuchTransaction",
+		Message: message,
+		Labels:  []string{"TransientTransactionError"},
+	}
+}
+
+// A sessionRegistry maps the logical sessions of clients onto backend sessions,
+// keyed by their lsid and the backend's client.
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[sessionID]*proxySession
+
+	// transactions holds the backend of the current or last transaction of
+	// each client session, keyed by its lsid.
+	transactions map[string]transaction
+
+	timeout time.Duration
+	stop    chan struct{}
+}
+
+// A transaction is a client's transaction, and the client of the backend it
+// runs on.
+type transaction struct {
+	txnNumber int64
+	client    *mongo.Client
+}
+
+func newSessionRegistry(timeout time.Duration) *sessionRegistry {
+	if timeout <= 0 {
+		timeout = DefaultSessionTimeout
+	}
+	return &sessionRegistry{
+		sessions:     make(map[sessionID]*proxySession),
+		transactions: make(map[string]transaction),
+		timeout:      timeout,
+		stop:         make(chan struct{}),
+	}
+}
+
+// sessionKey returns the key of a client's session in the registry.
+func sessionKey(lsid bson.D) (string, error) {
+	b, err := bson.Marshal(lsid)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// A sessionID identifies the backend session of a client's session on a backend.
+type sessionID struct {
+	lsid   string
+	client *mongo.Client
+}
+
+// checkout returns the backend session of a client's session on the backend of
+// the given client, starting one if the client's session is new to the backend.
+// The session is locked until it is released.
+func (r *sessionRegistry) checkout(client *mongo.Client, lsid bson.D) (*proxySession, error) {
+	key, err := sessionKey(lsid)
+	if err != nil {
+		return nil, err
+	}
+	id := sessionID{lsid: key, client: client}
+
+	r.mu.Lock()
+	s, ok := r.sessions[id]
+	if !ok {
+		session, err := client.StartSession()
+		if err != nil {
+			r.mu.Unlock()
+			return nil, err
+		}
+		s = &proxySession{session: session}
+		r.sessions[id] = s
+	}
+	s.lastUsed = time.Now()
+	r.mu.Unlock()
+
+	s.mu.Lock()
+	return s, nil
+}
+
+// startTransaction records that a client's session starts the transaction with
+// the given number on the backend of client.
+func (r *sessionRegistry) startTransaction(lsid bson.D, txnNumber int64,
+	client *mongo.Client) error {
+	key, err := sessionKey(lsid)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.transactions[key] = transaction{txnNumber: txnNumber, client: client}
+	return nil
+}
+
+// transactionClient returns the client of the backend a client's session runs
+// the transaction with the given number on, or nil if it doesn't know of it.
+func (r *sessionRegistry) transactionClient(lsid bson.D, txnNumber int64) *mongo.Client {
+	key, err := sessionKey(lsid)
+	if err != nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t, ok := r.transactions[key]
+	if !ok || t.txnNumber != txnNumber {
+		return nil
+	}
+	return t.client
+}
+
+// release unlocks a checked out session.
+func (r *sessionRegistry) release(s *proxySession) {
+	r.mu.Lock()
+	s.lastUsed = time.Now()
+	r.mu.Unlock()
+
+	s.mu.Unlock()
+}
+
+// end ends the backend sessions of the given client sessions on every backend,
+// for endSessions.
+func (r *sessionRegistry) end(ctx context.Context, lsids []bson.D) {
+	keys := make(map[string]bool)
+	for _, lsid := range lsids {
+		if key, err := sessionKey(lsid); err == nil {
+			keys[key] = true
+		}
+	}
+	ending := make([]*proxySession, 0)
+
+	r.mu.Lock()
+	for id, s := range r.sessions {
+		if keys[id.lsid] {
+			delete(r.sessions, id)
+			ending = append(ending, s)
+		}
+	}
+	for key := range keys {
+		delete(r.transactions, key)
+	}
+	r.mu.Unlock()
+
+	for _, s := range ending {
+		// wait for a request still running in the session
+		s.mu.Lock()
+		s.end(ctx)
+		s.mu.Unlock()
+	}
+}
+
+// reap ends the backend sessions of client sessions that have been idle for
+// longer than the timeout.
+func (r *sessionRegistry) reap(ctx context.Context, now time.Time) {
+	expired := make([]*proxySession, 0)
+
+	r.mu.Lock()
+	for id, s := range r.sessions {
+		if now.Sub(s.lastUsed) > r.timeout {
+			delete(r.sessions, id)
+			expired = append(expired, s)
+			if t, ok := r.transactions[id.lsid]; ok && t.client == id.client {
+				delete(r.transactions, id.lsid)
+			}
+		}
+	}
+	r.mu.Unlock()
+
+	for _, s := range expired {
+		s.mu.Lock()
+		s.end(ctx)
+		s.mu.Unlock()
+	}
+}
+
+// close stops reaping sessions and ends every backend session, for the module
+// to shut down.
+func (r *sessionRegistry) close(ctx context.Context) {
+	close(r.stop)
+
+	r.mu.Lock()
+	ending := make([]*proxySession, 0, len(r.sessions))
+	for id, s := range r.sessions {
+		delete(r.sessions, id)
+		ending = append(ending, s)
+	}
+	r.transactions = make(map[string]transaction)
+	r.mu.Unlock()
+
+	for _, s := range ending {
+		s.mu.Lock()
+		s.end(ctx)
+		s.mu.Unlock()
+	}
+}
+
+// run reaps idle sessions periodically until the registry is closed.
+func (r *sessionRegistry) run() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			r.reap(context.Background(), now)
+		case <-r.stop:
+			return
+		}
+	}
+}
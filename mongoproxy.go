@@ -1,20 +1,28 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
 
-	"github.com/WyattNielsen/mongoproxy/modules/mongod"
+	"github.com/WyattNielsen/mongoproxy/messages"
 	"github.com/WyattNielsen/mongoproxy/proxy"
 	"github.com/WyattNielsen/mongoproxy/server"
+	log "github.com/sirupsen/logrus"
+
+	// modules publish themselves to the registry when imported
+	_ "github.com/WyattNielsen/mongoproxy/modules/bi"
+	_ "github.com/WyattNielsen/mongoproxy/modules/mockule"
+	_ "github.com/WyattNielsen/mongoproxy/modules/mongod"
 )
 
 var (
-	port            int
-	logLevel        int
-	mongoURI        string
-	configNamespace string
-	configFilename  string
+	port           int
+	logLevel       int
+	configFilename string
 )
 
 func parseFlags() {
@@ -27,24 +35,68 @@ func parseFlags() {
 
 func main() {
 	parseFlags()
-	var c server.Config
 
-	var err error
-	// var result bson.M
-	var chain *server.ModuleChain
+	// without a configuration file, the pipeline is a mongod module configured
+	// from the environment
+	config := server.DefaultConfig()
 	if len(configFilename) > 0 {
-		err = c.ParseConfigFromFile(configFilename)
+		var err error
+		config, err = server.ParseConfigFromFile(configFilename)
 		if err != nil {
 			fmt.Printf("config error: %v\n", err)
+			os.Exit(1)
 		}
-	} else {
-		c.FromEnv()
 	}
 
-	module := mongod.MongodModule{}
-	module.Configure(c)
-	chain = server.CreateChain()
-	chain.AddModule(&module)
+	// flags that are set explicitly override the configuration
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			config.Port = port
+		case "logLevel":
+			config.LogLevel = logLevel
+		}
+	})
+	log.SetLevel(config.LogrusLevel())
+
+	chain, err := server.BuildChain(config.Modules)
+	if err != nil {
+		fmt.Printf("config error: %v\n", err)
+		os.Exit(1)
+	}
+
+	topology := messages.Topology{
+		Address:    config.Address,
+		ReplicaSet: config.ReplicaSet,
+	}
+	s := proxy.NewServer(topology, chain)
+
+	// on SIGTERM, as when a pod is stopped, the requests in flight finish before
+	// the proxy exits
+	shutdown := make(chan error, 1)
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-signals
+		log.Infof("Received %v, shutting down", sig)
+
+		ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+		defer cancel()
+		shutdown <- s.Shutdown(ctx)
+	}()
 
-	proxy.Start(port, chain)
+	if config.TLS.Enabled() {
+		err = s.ListenAndServeTLS(config.Port, config.TLS.CertFile, config.TLS.KeyFile)
+	} else {
+		err = s.ListenAndServe(config.Port)
+	}
+	if err != proxy.ErrServerClosed {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	if err := <-shutdown; err != nil {
+		log.Errorf("Error shutting down: %v", err)
+		os.Exit(1)
+	}
 }
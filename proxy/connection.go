@@ -0,0 +1,272 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/WyattNielsen/mongoproxy/messages"
+	"github.com/WyattNielsen/mongoproxy/server"
+	log "github.com/sirupsen/logrus"
+)
+
+// queuedRequests is how many requests of a connection are read ahead of the one
+// being processed.
+const queuedRequests = 16
+
+// A request is a message read from a client connection, with how it was framed.
+type request struct {
+	message messages.Requester
+	header  messages.MsgHeader
+	info    messages.MsgInfo
+}
+
+// expectsReply returns true if the client waits for a reply to the request.
+// OP_MSG requests with moreToCome don't, and neither do legacy writes, whose
+// result is asked for with a getLastError, nor OP_KILL_CURSORS.
+func (r request) expectsReply() bool {
+	switch r.header.OpCode {
+	case messages.OP_INSERT, messages.OP_UPDATE, messages.OP_DELETE, messages.OP_KILL_CURSORS:
+		return false
+	}
+	return !r.info.MoreToCome()
+}
+
+// A connection is a client connection being served.
+type connection struct {
+	conn     net.Conn
+	client   *server.Conn
+	pipeline server.PipelineFunc
+	topology messages.Topology
+
+	// replyID numbers the replies sent to the client.
+	replyID int32
+
+	// lastWrite is the response to the last legacy write, for the getLastError
+	// that follows it. It is cleared by any other request.
+	lastWrite *messages.ModuleResponse
+
+	// ctx is cancelled once the connection is done with, and with it the
+	// requests still running.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// mu guards pending, the number of requests read and not yet handled, and
+	// closed, which is set once the server closes the connection as it shuts
+	// down.
+	mu      sync.Mutex
+	pending int
+	closed  bool
+}
+
+// newConnection returns a client connection to serve with the pipeline.
+func newConnection(conn net.Conn, client *server.Conn, pipeline server.PipelineFunc,
+	topology messages.Topology) *connection {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &connection{
+		conn:     conn,
+		client:   client,
+		pipeline: pipeline,
+		topology: topology,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// serve runs the requests of the connection through the pipeline, one at a time
+// and in the order they were sent, while the next ones are read. Requests the
+// client waits for run in a context that is cancelled as soon as the client
+// closes the connection, since no one is left to reply to. Those it doesn't wait
+// for, such as fire-and-forget writes, still run once it is closed, as they do
+// on a mongod, and their context is only cancelled when they are done.
+func (c *connection) serve() {
+	defer c.cancel()
+	defer c.conn.Close()
+	clientCtx, clientClosed := context.WithCancel(c.ctx)
+
+	requests := make(chan request, queuedRequests)
+	go c.read(requests, c.ctx.Done(), clientClosed)
+
+	for r := range requests {
+		ctx := server.NewContext(clientCtx, c.client)
+		if !r.expectsReply() {
+			ctx = server.NewContext(c.ctx, c.client)
+		} else if clientCtx.Err() != nil {
+			c.done()
+			continue
+		}
+		err := c.handle(ctx, r)
+		c.done()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// read decodes the messages of the connection into requests, until the client
+// closes the connection or sends a message that can't be decoded, and then
+// calls closed. It gives up on the connection once done is closed.
+func (c *connection) read(requests chan<- request, done <-chan struct{}, closed func()) {
+	defer close(requests)
+	defer closed()
+
+	for {
+		message, msgHeader, msgInfo, err := messages.DecodeWithInfo(c.conn)
+		if err != nil {
+			if err != io.EOF && !c.isClosed() {
+				log.Errorf("Decoding error: %v", err)
+			}
+			return
+		}
+
+		// a request that comes in as the server closes the connection is
+		// dropped, as if it had come after
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return
+		}
+		c.pending++
+		c.mu.Unlock()
+
+		select {
+		case requests <- request{message: message, header: msgHeader, info: msgInfo}:
+		case <-done:
+			return
+		}
+	}
+}
+
+// done marks a request as handled.
+func (c *connection) done() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending--
+}
+
+// closeIfIdle closes the connection if it has no requests in flight, for the
+// server to shut down.
+func (c *connection) closeIfIdle() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.pending == 0 && !c.closed {
+		c.closed = true
+		c.conn.Close()
+	}
+}
+
+// close closes the connection and cancels its requests, for the server to shut
+// down without waiting for them.
+func (c *connection) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.cancel()
+	c.closed = true
+	c.conn.Close()
+}
+
+func (c *connection) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// handle runs a request through the pipeline and replies to it, if the client
+// waits for a reply. An error is returned if the connection can't be replied
+// on anymore.
+func (c *connection) handle(ctx server.Context, r request) error {
+	log.Debugf("Request: %#v", r.message)
+
+	recordAppName(r.message, c.client)
+
+	// the result of a legacy write is known to the proxy, and the getLastError
+	// that asks for it doesn't go through the pipeline
+	if messages.IsGetLastError(r.message) {
+		res := messages.ModuleResponse{}
+		res.Write(messages.CommandResponse{Reply: messages.LastErrorReply(c.lastWrite)})
+		_, err := c.reply(r, r.header, res, false)
+		return err
+	}
+
+	res := &messages.ModuleResponse{}
+	c.pipeline(ctx, r.message, res)
+
+	c.lastWrite = nil
+	switch r.header.OpCode {
+	case messages.OP_INSERT, messages.OP_UPDATE, messages.OP_DELETE:
+		c.lastWrite = res
+	}
+	if !r.expectsReply() {
+		return nil
+	}
+
+	rewriteHandshake(r.message, res, c.topology)
+
+	if messages.IsExhaust(r.message, r.info) {
+		return c.stream(ctx, r, res)
+	}
+	_, err := c.reply(r, r.header, *res, false)
+	return err
+}
+
+// stream replies to an exhaust request with every batch of its cursor, running
+// the getMores for them without the client sending any, until the cursor is
+// exhausted, a getMore fails or the client goes away. Each reply responds to the
+// one before it.
+func (c *connection) stream(ctx server.Context, r request, res *messages.ModuleResponse) error {
+	req, header := r.message, r.header
+	for {
+		next, more := messages.NextGetMore(req, *res)
+		more = more && ctx.Err() == nil
+
+		replyID, err := c.reply(r, header, *res, more)
+		if err != nil || !more {
+			return err
+		}
+
+		req = next
+		header = messages.MsgHeader{RequestID: replyID, OpCode: messages.OP_GET_MORE}
+		if r.header.OpCode == messages.OP_MSG {
+			header.OpCode = messages.OP_MSG
+		}
+		res = &messages.ModuleResponse{}
+		c.pipeline(ctx, req, res)
+	}
+}
+
+// reply encodes a response as a reply to the request with the given header, and
+// writes it with the same compressor the client used for request r. moreToCome
+// tells an OP_MSG client that another reply follows. The ID of the reply is
+// returned.
+func (c *connection) reply(r request, header messages.MsgHeader, res messages.ModuleResponse,
+	moreToCome bool) (int32, error) {
+
+	bytes, err := messages.Encode(header, res)
+	if err != nil {
+		log.Errorf("Encoding error: %v", err)
+		return 0, err
+	}
+
+	c.replyID++
+	messages.SetRequestID(bytes, c.replyID)
+	if moreToCome {
+		messages.SetMoreToCome(bytes)
+	}
+
+	if r.info.Compressed {
+		bytes, err = messages.CompressMessage(bytes, r.info.Compressor)
+		if err != nil {
+			log.Errorf("Compression error: %v", err)
+			return 0, err
+		}
+	}
+	_, err = c.conn.Write(bytes)
+	if err != nil {
+		log.Errorf("Error writing to connection: %v", err)
+		return 0, err
+	}
+	return c.replyID, nil
+}
@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/WyattNielsen/mongoproxy/buffer"
+	"github.com/WyattNielsen/mongoproxy/convert"
+	"github.com/WyattNielsen/mongoproxy/messages"
+	"github.com/WyattNielsen/mongoproxy/server"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// stubPipeline answers requests without a backend, and records the ones it is
+// given. Cursors count down: a find opens cursor 2, and a getMore on cursor n
+// returns cursor n-1, until the cursor is exhausted at 0.
+type stubPipeline struct {
+	mu       sync.Mutex
+	requests []messages.Requester
+}
+
+func (p *stubPipeline) process(ctx server.Context, req messages.Requester, res messages.Responder) {
+	p.mu.Lock()
+	p.requests = append(p.requests, req)
+	p.mu.Unlock()
+
+	switch r := req.(type) {
+	case messages.Insert:
+		res.Write(messages.InsertResponse{WriteErrors: []messages.WriteError{
+			{Index: 0, Code: 11000, Message: "E11000 duplicate key error"}}})
+	case messages.Find:
+		res.Write(messages.FindResponse{CursorID: 2, Database: r.Database,
+			Collection: r.Collection, Documents: []bson.D{{{Key: "batch", Value: 0}}}})
+	case messages.GetMore:
+		res.Write(messages.GetMoreResponse{CursorID: r.CursorID - 1, Database: r.Database,
+			Collection: r.Collection, Documents: []bson.D{{{Key: "batch", Value: r.CursorID}}}})
+	default:
+		res.Write(messages.CommandResponse{Reply: bson.M{}})
+	}
+}
+
+func (p *stubPipeline) types() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	types := make([]string, len(p.requests))
+	for i, req := range p.requests {
+		types[i] = req.Type()
+	}
+	return types
+}
+
+// legacyMessage encodes a message of a legacy opcode from the fields after its
+// header.
+func legacyMessage(requestID int32, opCode int32, fields ...interface{}) []byte {
+	buf := &bytes.Buffer{}
+	header := messages.MsgHeader{RequestID: requestID, OpCode: opCode}
+	buffer.WriteToBuf(buf, append([]interface{}{header}, fields...)...)
+	b := buf.Bytes()
+	binary.LittleEndian.PutUint32(b[0:4], uint32(len(b)))
+	return b
+}
+
+// msgRequest encodes a command in an OP_MSG with the given flags.
+func msgRequest(requestID int32, flags int32, command bson.D) []byte {
+	b, err := messages.EncodeMsgRequest(requestID, command)
+	So(err, ShouldBeNil)
+	binary.LittleEndian.PutUint32(b[16:20], uint32(flags))
+	return b
+}
+
+// A reply is a message the proxy sent to the client.
+type reply struct {
+	requestID  int32
+	responseTo int32
+	opCode     int32
+	flags      int32
+	cursorID   int64
+	document   bson.M
+}
+
+// readReply reads a single OP_REPLY, or an OP_MSG with a body section.
+func readReply(conn net.Conn) reply {
+	size := make([]byte, 4)
+	_, err := io.ReadFull(conn, size)
+	So(err, ShouldBeNil)
+	msg := make([]byte, convert.ConvertToInt32LE(size))
+	copy(msg, size)
+	_, err = io.ReadFull(conn, msg[4:])
+	So(err, ShouldBeNil)
+
+	r := reply{
+		requestID:  convert.ConvertToInt32LE(msg[4:8]),
+		responseTo: convert.ConvertToInt32LE(msg[8:12]),
+		opCode:     convert.ConvertToInt32LE(msg[12:16]),
+		flags:      convert.ConvertToInt32LE(msg[16:20]),
+		document:   bson.M{},
+	}
+	body := msg[21:]
+	if r.opCode != messages.OP_MSG {
+		r.cursorID = convert.ConvertToInt64LE(msg[20:28])
+		body = msg[36:]
+	}
+	So(bson.Unmarshal(body, &r.document), ShouldBeNil)
+
+	// the cursor of an OP_MSG reply is in its body
+	if cursor, ok := r.document["cursor"].(bson.M); ok {
+		r.cursorID = convert.ToInt64(cursor["id"])
+	}
+	return r
+}
+
+func TestConnection(t *testing.T) {
+	Convey("Serve a client connection", t, func() {
+		pipeline := &stubPipeline{}
+		client, proxied := net.Pipe()
+		c := newConnection(proxied, server.NewConn(1, nil), pipeline.process,
+			messages.Topology{Address: "proxy:8124"})
+		served := make(chan struct{})
+		go func() {
+			c.serve()
+			close(served)
+		}()
+		Reset(func() {
+			client.Close()
+			<-served
+		})
+
+		write := func(b []byte) {
+			_, err := client.Write(b)
+			So(err, ShouldBeNil)
+		}
+
+		Convey("without replying to a request with moreToCome", func() {
+			write(msgRequest(1, messages.MsgMoreToCome, bson.D{{Key: "insert", Value: "orders"},
+				{Key: "documents", Value: bson.A{bson.D{{Key: "total", Value: 12}}}}, {Key: "$db", Value: "shop"}}))
+			write(msgRequest(2, 0, bson.D{{Key: "ping", Value: 1}, {Key: "$db", Value: "admin"}}))
+
+			r := readReply(client)
+			So(r.responseTo, ShouldEqual, 2)
+			So(r.document["ok"], ShouldEqual, 1)
+			So(pipeline.types(), ShouldResemble, []string{messages.InsertType, messages.CommandType})
+		})
+
+		Convey("streaming an exhaust cursor", func() {
+			Convey("to a legacy query", func() {
+				query, err := bson.Marshal(bson.D{{Key: "total", Value: bson.D{{Key: "$gt", Value: 10}}}})
+				So(err, ShouldBeNil)
+				write(legacyMessage(7, messages.OP_QUERY, int32(64), []byte("shop.orders\x00"),
+					int32(0), int32(1), query))
+
+				responseTo := int32(7)
+				for _, cursorID := range []int64{2, 1, 0} {
+					r := readReply(client)
+					So(r.opCode, ShouldEqual, 1)
+					So(r.responseTo, ShouldEqual, responseTo)
+					So(r.cursorID, ShouldEqual, cursorID)
+					responseTo = r.requestID
+				}
+				So(pipeline.types(), ShouldResemble, []string{messages.FindType,
+					messages.GetMoreType, messages.GetMoreType})
+			})
+
+			Convey("to a getMore that allows exhaust", func() {
+				write(msgRequest(9, messages.MsgExhaustAllowed, bson.D{{Key: "getMore", Value: int64(3)},
+					{Key: "collection", Value: "orders"}, {Key: "$db", Value: "shop"}}))
+
+				responseTo := int32(9)
+				for _, cursorID := range []int64{2, 1, 0} {
+					r := readReply(client)
+					So(r.opCode, ShouldEqual, messages.OP_MSG)
+					So(r.responseTo, ShouldEqual, responseTo)
+					So(r.cursorID, ShouldEqual, cursorID)
+					So(r.flags&messages.MsgMoreToCome != 0, ShouldEqual, cursorID != 0)
+					responseTo = r.requestID
+				}
+			})
+		})
+
+		Convey("answering a getLastError with the legacy write before it", func() {
+			document, err := bson.Marshal(bson.D{{Key: "total", Value: 12}})
+			So(err, ShouldBeNil)
+			write(legacyMessage(3, messages.OP_INSERT, int32(0), []byte("shop.orders\x00"), document))
+
+			getLastError, err := bson.Marshal(bson.D{{Key: "getLastError", Value: 1}})
+			So(err, ShouldBeNil)
+			write(legacyMessage(4, messages.OP_QUERY, int32(0), []byte("shop.$cmd\x00"),
+				int32(0), int32(-1), getLastError))
+
+			r := readReply(client)
+			So(r.responseTo, ShouldEqual, 4)
+			So(r.document["code"], ShouldEqual, 11000)
+			So(r.document["err"], ShouldEqual, "E11000 duplicate key error")
+			So(r.document["ok"], ShouldEqual, 1)
+			So(pipeline.types(), ShouldResemble, []string{messages.InsertType})
+		})
+	})
+}
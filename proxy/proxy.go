@@ -1,77 +1,299 @@
 package proxy
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"io"
 	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	log "github.com/sirupsen/logrus"
+	"github.com/WyattNielsen/mongoproxy/convert"
 	"github.com/WyattNielsen/mongoproxy/messages"
 	"github.com/WyattNielsen/mongoproxy/server"
+	log "github.com/sirupsen/logrus"
 )
 
-// Start starts the server at the provided port and with the given module chain.
-func Start(port int, chain *server.ModuleChain) {
+// ErrServerClosed is returned by Serve once the server is shut down.
+var ErrServerClosed = errors.New("proxy: server closed")
+
+// shutdownPollInterval is how often Shutdown looks for connections that went
+// idle, to close them.
+const shutdownPollInterval = 100 * time.Millisecond
+
+// moduleCloseTimeout is how long Shutdown gives the modules to close, once every
+// request is done.
+const moduleCloseTimeout = 5 * time.Second
+
+// A Server serves clients with the pipeline built from a module chain,
+// presenting itself to them as a topology, until it is shut down.
+type Server struct {
+	topology messages.Topology
+	chain    *server.ModuleChain
+	pipeline server.PipelineFunc
+
+	mu           sync.Mutex
+	listeners    map[net.Listener]struct{}
+	conns        map[*connection]struct{}
+	shuttingDown bool
+
+	// serving counts the goroutines serving connections, which are done once
+	// their last request has left the pipeline.
+	serving sync.WaitGroup
+}
+
+// NewServer returns a server with the given module chain, presenting itself to
+// clients as the given topology.
+func NewServer(topology messages.Topology, chain *server.ModuleChain) *Server {
+	return &Server{
+		topology:  topology,
+		chain:     chain,
+		pipeline:  server.BuildPipeline(chain),
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[*connection]struct{}),
+	}
+}
 
+// ListenAndServe listens on the given port and serves the connections it
+// accepts. It returns ErrServerClosed once the server is shut down.
+func (s *Server) ListenAndServe(port int) error {
 	ln, err := net.Listen("tcp", fmt.Sprintf(":%v", port))
 	if err != nil {
-		log.Errorf("Error listening on port %v: %v", port, err)
-		return
+		return fmt.Errorf("Error listening on port %v: %v", port, err)
+	}
+	return s.Serve(ln)
+}
+
+// ListenAndServeTLS is like ListenAndServe, but only accepts TLS connections,
+// with the certificate and key in the given files.
+func (s *Server) ListenAndServeTLS(port int, certFile string, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("Error loading TLS certificate: %v", err)
+	}
+
+	ln, err := tls.Listen("tcp", fmt.Sprintf(":%v", port),
+		&tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		return fmt.Errorf("Error listening on port %v: %v", port, err)
+	}
+	return s.Serve(ln)
+}
+
+// connectionIDs issues the IDs of client connections, from 1, so that modules
+// can tell the requests of different connections apart.
+var connectionIDs int64
+
+// Serve accepts connections on the listener and serves each of them in a
+// goroutine of its own. It returns ErrServerClosed once the server is shut
+// down, or the error of the listener if it fails.
+func (s *Server) Serve(ln net.Listener) error {
+	if !s.trackListener(ln, true) {
+		ln.Close()
+		return ErrServerClosed
+	}
+	defer s.trackListener(ln, false)
+
+	topology := s.topology
+	if topology.Address == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			host = "localhost"
+		}
+		_, port, _ := net.SplitHostPort(ln.Addr().String())
+		topology.Address = net.JoinHostPort(host, port)
 	}
 
-	pipeline := server.BuildPipeline(chain)
-	log.Infof("Server running on port %v", port)
+	log.Infof("Server running on %v", ln.Addr())
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			log.Errorf("error accepting connection: %v", err)
-			continue
+			if s.isShuttingDown() {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Errorf("error accepting connection: %v", err)
+				continue
+			}
+			return err
 		}
 
 		log.Infof("accepted connection from: %v", conn.RemoteAddr())
-		go handleConnection(conn, pipeline)
+		id := atomic.AddInt64(&connectionIDs, 1)
+		c := newConnection(conn, server.NewConn(id, conn.RemoteAddr()), s.pipeline, topology)
+		if !s.trackConn(c, true) {
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer s.serving.Done()
+			c.serve()
+			s.trackConn(c, false)
+		}()
 	}
-
 }
 
-func handleConnection(conn net.Conn, pipeline server.PipelineFunc) {
-	for {
+// Shutdown shuts the server down gracefully. It stops accepting connections,
+// and closes each connection once no request of it is in flight, waiting for
+// those that are to finish. Once ctx is done, it stops waiting and closes the
+// remaining connections, cancelling their requests, and returns the context's
+// error. The modules of the chain are closed last, once every request has left
+// the pipeline, with a timeout of their own. If requests that don't heed the
+// cancellation are still in the pipeline when ctx is done, Shutdown returns
+// without waiting for them, and the modules are closed once they leave it.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.shuttingDown = true
+	for ln := range s.listeners {
+		ln.Close()
+	}
+	s.mu.Unlock()
 
-		message, msgHeader, err := messages.Decode(conn)
+	err := s.drain(ctx)
 
-		if err != nil {
-			if err != io.EOF {
-				log.Errorf("Decoding error: %v", err)
+	served := make(chan struct{})
+	go func() {
+		s.serving.Wait()
+		close(served)
+	}()
+	select {
+	case <-served:
+	case <-ctx.Done():
+		go func() {
+			<-served
+			if err := s.closeModules(); err != nil {
+				log.Errorf("Error closing modules: %v", err)
 			}
-			conn.Close()
-			return
-		}
+		}()
+		return ctx.Err()
+	}
 
-		log.Debugf("Request: %#v", message)
+	if closeErr := s.closeModules(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return err
+}
 
-		res := &messages.ModuleResponse{}
-		pipeline(message, res)
+// closeModules closes the modules of the chain, giving them moduleCloseTimeout.
+func (s *Server) closeModules() error {
+	ctx, cancel := context.WithTimeout(context.Background(), moduleCloseTimeout)
+	defer cancel()
+	return s.chain.Close(ctx)
+}
 
-		bytes, err := messages.Encode(msgHeader, *res)
+// drain closes the connections as they go idle, until none are left or ctx is
+// done, in which case the rest are closed as they are, and their requests
+// cancelled.
+func (s *Server) drain(ctx context.Context) error {
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
 
-		// update, delete, and insert messages do not have a response, so we continue and write the
-		// response on the getLastError that will be called immediately after. Kind of a hack.
-		if msgHeader.OpCode == messages.OP_UPDATE || msgHeader.OpCode == messages.OP_INSERT ||
-			msgHeader.OpCode == messages.OP_DELETE {
-			log.Infof("Continuing on OpCode: %v", msgHeader.OpCode)
-			continue
-		}
-		if err != nil {
-			log.Errorf("Encoding error: %v", err)
-			conn.Close()
-			return
+	for {
+		if s.closeIdleConns() {
+			return nil
 		}
-		_, err = conn.Write(bytes)
-		if err != nil {
-			log.Errorf("Error writing to connection: %v", err)
-			conn.Close()
-			return
+		select {
+		case <-ctx.Done():
+			s.mu.Lock()
+			for c := range s.conns {
+				c.close()
+			}
+			s.mu.Unlock()
+			return ctx.Err()
+		case <-ticker.C:
 		}
+	}
+}
+
+// closeIdleConns closes the connections that have no request in flight, and
+// returns true if no connection is left open.
+func (s *Server) closeIdleConns() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for c := range s.conns {
+		c.closeIfIdle()
+	}
+	return len(s.conns) == 0
+}
+
+func (s *Server) isShuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.shuttingDown
+}
+
+// trackListener adds a listener to the server's, or removes it. A listener
+// can't be added once the server is shutting down.
+func (s *Server) trackListener(ln net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
+	if !add {
+		delete(s.listeners, ln)
+		return true
+	}
+	if s.shuttingDown {
+		return false
+	}
+	s.listeners[ln] = struct{}{}
+	return true
+}
+
+// trackConn adds a connection to the server's, or removes it once it is
+// closed. A connection can't be added once the server is shutting down.
+func (s *Server) trackConn(c *connection, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !add {
+		delete(s.conns, c)
+		return true
+	}
+	if s.shuttingDown {
+		return false
+	}
+	s.conns[c] = struct{}{}
+	s.serving.Add(1)
+	return true
+}
+
+// rewriteHandshake replaces the backend's reply to a handshake with the proxy's
+// own, so that clients see the proxy as the whole topology and keep sending
+// their requests to it rather than to the backend's servers.
+func rewriteHandshake(req messages.Requester, res *messages.ModuleResponse,
+	topology messages.Topology) {
+	command, ok := req.(messages.Command)
+	if !ok || !messages.IsHandshake(command.CommandName) {
+		return
+	}
+	reply, ok := res.Writer.(messages.CommandResponse)
+	if !ok || reply.Reply == nil {
+		return
+	}
+
+	// it is the proxy and not the backend that decompresses the client's messages
+	offered, _ := convert.ConvertToStringSlice(command.GetArg("compression"))
+	reply.Reply = messages.HandshakeReply(command.CommandName, reply.Reply, offered, topology)
+	res.Writer = reply
+}
+
+// recordAppName records the application name a client gives in the metadata of
+// its handshake.
+func recordAppName(req messages.Requester, client *server.Conn) {
+	command, ok := req.(messages.Command)
+	if !ok || !messages.IsHandshake(command.CommandName) {
+		return
+	}
+	metadata := convert.ToBSONMap(command.GetArg("client"))
+	if metadata == nil {
+		return
+	}
+	application := convert.ToBSONMap(metadata["application"])
+	if name := convert.ToString(application["name"]); name != "" {
+		client.SetAppName(name)
 	}
 }
@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/WyattNielsen/mongoproxy/messages"
+	"github.com/WyattNielsen/mongoproxy/server"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// slowModule takes delay to answer each request, unless its context is done
+// first or it is stuck, and records how it was closed. closing is closed once
+// it is.
+type slowModule struct {
+	delay   time.Duration
+	stuck   bool
+	running int32
+
+	closing            chan struct{}
+	closedWhileRunning bool
+	closeCtxErr        error
+}
+
+func (s *slowModule) Name() string {
+	return "slow"
+}
+
+func (s *slowModule) Configure(config bson.M) error {
+	return nil
+}
+
+func (s *slowModule) Process(ctx server.Context, req messages.Requester, res messages.Responder,
+	next server.PipelineFunc) {
+	atomic.AddInt32(&s.running, 1)
+	defer atomic.AddInt32(&s.running, -1)
+
+	if s.stuck {
+		// like a backend call that doesn't heed the cancellation
+		time.Sleep(s.delay)
+	} else {
+		select {
+		case <-time.After(s.delay):
+		case <-ctx.Done():
+			// a module that takes a moment to give up
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	res.Write(messages.CommandResponse{Reply: bson.M{"ok": 1}})
+}
+
+func (s *slowModule) New() server.Module {
+	return &slowModule{}
+}
+
+func (s *slowModule) Close(ctx context.Context) error {
+	s.closedWhileRunning = atomic.LoadInt32(&s.running) > 0
+	s.closeCtxErr = ctx.Err()
+	close(s.closing)
+	return nil
+}
+
+// shouldBeClosed checks that a channel is closed, without waiting for it.
+func shouldBeClosed(actual interface{}, expected ...interface{}) string {
+	select {
+	case <-actual.(chan struct{}):
+		return ""
+	default:
+		return "Expected the channel to be closed"
+	}
+}
+
+// shouldNotBeClosed checks that a channel isn't closed, without waiting for it.
+func shouldNotBeClosed(actual interface{}, expected ...interface{}) string {
+	if shouldBeClosed(actual) == "" {
+		return "Expected the channel not to be closed"
+	}
+	return ""
+}
+
+func TestShutdown(t *testing.T) {
+	Convey("Shut the server down gracefully", t, func() {
+		module := &slowModule{closing: make(chan struct{})}
+		s := NewServer(messages.Topology{}, server.CreateChain().AddModule(module))
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		served := make(chan error, 1)
+		go func() {
+			served <- s.Serve(ln)
+		}()
+
+		busy, err := net.Dial("tcp", ln.Addr().String())
+		So(err, ShouldBeNil)
+		idle, err := net.Dial("tcp", ln.Addr().String())
+		So(err, ShouldBeNil)
+		Reset(func() {
+			busy.Close()
+			idle.Close()
+		})
+
+		// sends a ping on the busy connection, and waits for it to reach the
+		// pipeline
+		ping := func() {
+			b, err := messages.EncodeMsgRequest(1, bson.D{{Key: "ping", Value: 1}, {Key: "$db", Value: "admin"}})
+			So(err, ShouldBeNil)
+			_, err = busy.Write(b)
+			So(err, ShouldBeNil)
+			for atomic.LoadInt32(&module.running) == 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+
+		shutdown := func(timeout time.Duration) chan error {
+			done := make(chan error, 1)
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), timeout)
+				defer cancel()
+				done <- s.Shutdown(ctx)
+			}()
+			return done
+		}
+
+		Convey("letting requests in flight finish", func() {
+			module.delay = 200 * time.Millisecond
+			ping()
+			done := shutdown(5 * time.Second)
+
+			_, reply, err := messages.DecodeMsgReply(busy)
+			So(err, ShouldBeNil)
+			So(reply, ShouldResemble, bson.D{{Key: "ok", Value: int32(1)}})
+
+			_, err = idle.Read(make([]byte, 1))
+			So(err, ShouldEqual, io.EOF)
+			_, err = busy.Read(make([]byte, 1))
+			So(err, ShouldEqual, io.EOF)
+
+			So(<-done, ShouldBeNil)
+			So(<-served, ShouldEqual, ErrServerClosed)
+			So(module.closing, shouldBeClosed)
+			So(module.closedWhileRunning, ShouldBeFalse)
+			So(module.closeCtxErr, ShouldBeNil)
+
+			_, err = net.Dial("tcp", ln.Addr().String())
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("until the deadline, when requests still in flight are cancelled", func() {
+			module.delay = time.Minute
+			ping()
+			done := shutdown(100 * time.Millisecond)
+
+			_, _, err := messages.DecodeMsgReply(busy)
+			So(err, ShouldNotBeNil)
+			_, err = idle.Read(make([]byte, 1))
+			So(err, ShouldEqual, io.EOF)
+
+			So(<-done, ShouldResemble, context.DeadlineExceeded)
+			So(<-served, ShouldEqual, ErrServerClosed)
+			<-module.closing
+			So(module.closedWhileRunning, ShouldBeFalse)
+			So(module.closeCtxErr, ShouldBeNil)
+		})
+
+		Convey("returning at the deadline even if requests don't heed the cancellation", func() {
+			module.delay = 500 * time.Millisecond
+			module.stuck = true
+			ping()
+			start := time.Now()
+			done := shutdown(100 * time.Millisecond)
+
+			So(<-done, ShouldResemble, context.DeadlineExceeded)
+			So(time.Since(start), ShouldBeLessThan, module.delay)
+			So(module.closing, shouldNotBeClosed)
+
+			// the modules are closed once the request leaves the pipeline
+			<-module.closing
+			So(module.closedWhileRunning, ShouldBeFalse)
+			So(<-served, ShouldEqual, ErrServerClosed)
+		})
+	})
+}
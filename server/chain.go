@@ -1,12 +1,15 @@
 package server
 
 import (
+	"context"
+	"fmt"
+
 	"github.com/WyattNielsen/mongoproxy/messages"
 )
 
 // PipelineFunc is the function type for the built pipeline, and is called
 // to begin the pipeline.
-type PipelineFunc func(messages.Requester, messages.Responder)
+type PipelineFunc func(Context, messages.Requester, messages.Responder)
 
 // A ChainFunc is a closure that wraps a module so that they can accept
 // other modules as inputs and outputs for module chaining.
@@ -24,20 +27,37 @@ func (m *ModuleChain) AddModule(mod Module) *ModuleChain {
 	return m
 }
 
+// Close closes the modules of the chain that are Closers, in order, once the
+// proxy is done with the pipeline. Every module is closed even if another fails
+// to, and the first error is returned.
+func (m *ModuleChain) Close(ctx context.Context) error {
+	var first error
+	for _, mod := range m.chain {
+		closer, ok := mod.(Closer)
+		if !ok {
+			continue
+		}
+		if err := closer.Close(ctx); err != nil && first == nil {
+			first = fmt.Errorf("closing %v: %v", mod.Name(), err)
+		}
+	}
+	return first
+}
+
 // wrapModule returns a closure ChainFunc that wraps over the module m, which
 // can input and output PipelineFuncs to help with chaining.
 func wrapModule(m Module) ChainFunc {
 
 	return ChainFunc(func(next PipelineFunc) PipelineFunc {
-		return PipelineFunc(func(r messages.Requester, w messages.Responder) {
+		return PipelineFunc(func(ctx Context, r messages.Requester, w messages.Responder) {
 
 			// if there is no next module in the pipeline, the pipeline terminates
 			if next == nil {
-				next = PipelineFunc(func(r messages.Requester, w messages.Responder) {
+				next = PipelineFunc(func(ctx Context, r messages.Requester, w messages.Responder) {
 					return
 				})
 			}
-			m.Process(r, w, next)
+			m.Process(ctx, r, w, next)
 		})
 	})
 }
@@ -48,6 +68,25 @@ func CreateChain() *ModuleChain {
 	return &ModuleChain{}
 }
 
+// BuildChain creates a module chain from module configurations, creating a new
+// instance of each named module from the registry and configuring it, in order.
+// Returns an error if a module isn't published or fails to configure.
+func BuildChain(configs []ModuleConfig) (*ModuleChain, error) {
+	chain := CreateChain()
+	for i, c := range configs {
+		mod, err := NewModule(c.Name)
+		if err != nil {
+			return nil, fmt.Errorf("modules[%v]: %v", i, err)
+		}
+		err = mod.Configure(c.Config)
+		if err != nil {
+			return nil, fmt.Errorf("modules[%v].config (%v): %v", i, c.Name, err)
+		}
+		chain.AddModule(mod)
+	}
+	return chain, nil
+}
+
 // BuildPipeline takes a module chain and creates a pipeline, returning
 // a PipelineFunc that starts the pipeline when called.
 // The proxy core manages the pipeline order by setting the PipelineFuncs of each
@@ -56,7 +95,7 @@ func CreateChain() *ModuleChain {
 func BuildPipeline(m *ModuleChain) PipelineFunc {
 
 	if len(m.chain) == 0 {
-		return PipelineFunc(func(r messages.Requester, w messages.Responder) {
+		return PipelineFunc(func(ctx Context, r messages.Requester, w messages.Responder) {
 			return
 		})
 	}
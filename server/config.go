@@ -6,128 +6,137 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"os"
-	"strconv"
 	"time"
 
 	"github.com/WyattNielsen/mongoproxy/convert"
+	log "github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson"
 )
 
-//Config describe parameters need to make a connection to a Mongo database
+// Config holds the settings of the proxy itself, and the modules in its pipeline.
+// Each module's settings are kept as a raw document, which the module decodes
+// in its Configure function.
 type Config struct {
-	Scheme    string        `json:"scheme"`
-	Hosts     string        `json:"hosts"`
-	TLS       bool          `json:"tls"`
-	Database  string        `json:"database"`
-	Username  string        `json:"-"`
-	Password  string        `json:"-"`
-	Timeout   time.Duration `json:"timeout"`
-	OptParams string        `json:"optParams"`
-	ReadOnly  bool          `json:"readOnly"`
-	Port      int           `json:"port"`
+	// Port is the port the proxy listens on.
+	Port int `config:"port" default:"8124"`
+
+	// Address is the host:port clients reach the proxy at, which it presents as
+	// its own address in handshakes. It defaults to the host name and the port.
+	Address string `config:"address"`
+
+	// ReplicaSet, if set, makes the proxy present itself to clients as the only
+	// member of a replica set of that name, rather than as a standalone.
+	ReplicaSet string `config:"replicaSet"`
+
+	// LogLevel sets the verbosity of the logs from 1 to 5, with 1 being the least
+	// verbose and 5 the most.
+	LogLevel int `config:"logLevel" default:"3"`
+
+	// ShutdownTimeout is how long the proxy waits for the requests in flight to
+	// finish when it is told to shut down, before it closes their connections.
+	ShutdownTimeout time.Duration `config:"shutdownTimeout" default:"20s"`
+
+	// TLS configures the proxy to accept TLS connections from clients.
+	TLS TLSConfig `config:"tls"`
+
+	// Modules are the modules of the pipeline, in order.
+	Modules []ModuleConfig `config:"modules"`
 }
 
-// FromEnv populates Config from the environment
-func (c *Config) FromEnv() {
-	c.Scheme = os.Getenv("MONGO_SCHEME")
-	c.Hosts = os.Getenv("MONGO_ADDRESSES")
-	c.Username = os.Getenv("MONGO_USERNAME")
-	c.Password = os.Getenv("MONGO_PASSWORD")
-	c.Database = os.Getenv("MONGO_DATABASE")
-	c.OptParams = os.Getenv("MONGO_OPT_PARAMS")
-	c.TLS = os.Getenv("MONGO_TLS") == "true"
-	timeoutStr := os.Getenv("MONGOPROXY_TIMEOUT")
-	timeout, err := strconv.Atoi(timeoutStr)
-	if (timeoutStr == "") || (err != nil) {
-		c.Timeout = time.Duration(20 * time.Second)
-	} else {
-		c.Timeout = time.Duration(timeout) * time.Second
-	}
-	portStr := os.Getenv("MONGOPROXY_PORT")
-	port, err := strconv.Atoi(portStr)
-	if (portStr == "") || (err != nil) {
-		c.Port = 27017
-	} else {
-		c.Port = port
-	}
-	c.ReadOnly = os.Getenv("MONGOPROXY_READONLY") == "true"
+// TLSConfig holds the certificate the proxy presents to clients. TLS is enabled
+// when both files are set.
+type TLSConfig struct {
+	CertFile string `config:"certFile"`
+	KeyFile  string `config:"keyFile"`
 }
 
-// AsConnectionString constructs a MongoDB connection string from a Config
-func (c *Config) AsConnectionString() string {
-	var url string
-	if c.Scheme != "" {
-		url += c.Scheme + "://"
-	} else {
-		url += "mongodb://"
-	}
+// Enabled returns true if the proxy should accept TLS connections.
+func (t TLSConfig) Enabled() bool {
+	return t.CertFile != "" && t.KeyFile != ""
+}
 
-	if c.Username != "" {
-		url += c.Username
-		if c.Password != "" {
-			url += ":"
-			url += c.Password
-		}
-		url += "@"
-	}
-	url += c.Hosts
-	url += "/"
-	url += c.Database
-	if c.OptParams != "" {
-		url += "?" + c.OptParams
-	}
+// A ModuleConfig names a module to add to the pipeline, and holds the
+// configuration it is given.
+type ModuleConfig struct {
+	Name   string `config:"name,required"`
+	Config bson.M `config:"config"`
+}
+
+// DefaultConfig returns the configuration used without a configuration file,
+// which runs a single mongod module configured from the environment.
+func DefaultConfig() Config {
+	var c Config
+	// the defaults of an empty document always decode
+	DecodeConfig(bson.M{}, &c)
+	c.Modules = []ModuleConfig{{Name: "mongod"}}
+	return c
+}
 
-	return url
+// LogrusLevel returns the logrus level for the configured log level.
+func (c *Config) LogrusLevel() log.Level {
+	switch {
+	case c.LogLevel <= 1:
+		return log.ErrorLevel
+	case c.LogLevel == 2:
+		return log.WarnLevel
+	case c.LogLevel == 3:
+		return log.InfoLevel
+	case c.LogLevel == 4:
+		return log.DebugLevel
+	default:
+		return log.TraceLevel
+	}
 }
 
-// ParseConfigFromFile takes a filename for a JSON file, and returns a configuration
-// object from the file, and an error if there was an error reading or unmarshalling the file.
-func (c *Config) ParseConfigFromFile(configFilename string) error {
+// ParseConfigFromFile takes a filename for a JSON file, and returns the configuration
+// from the file, and an error if the file can't be read or the configuration is invalid.
+// A file with only a "mongod" element, and no "modules", configures a single mongod module.
+func ParseConfigFromFile(configFilename string) (Config, error) {
+	var c Config
 	var result bson.M
 
 	file, err := ioutil.ReadFile(configFilename)
 	if err != nil {
-		return fmt.Errorf("Error reading configuration file: %v", err)
+		return c, fmt.Errorf("Error reading configuration file: %v", err)
 	}
 
 	err = json.Unmarshal(file, &result)
 	if err != nil {
-		return fmt.Errorf("Invalid JSON Configuration: %v", err)
+		return c, fmt.Errorf("Invalid JSON Configuration: %v", err)
 	}
 
-	serverConfig, ok := result["mongod"]
-	if ok {
-		mongodConfig := convert.ToBSONMap(serverConfig)
-		c.Scheme = mongodConfig["scheme"].(string)
-		c.Hosts = mongodConfig["addresses"].(string)
-		c.Username = mongodConfig["username"].(string)
-		c.Password = mongodConfig["password"].(string)
-		c.Database = mongodConfig["database"].(string)
-		c.OptParams = mongodConfig["optParams"].(string)
-		c.TLS = mongodConfig["tls"].(string) == "true"
-
-		timeoutStr := mongodConfig["timeout"].(string)
-		timeout, err := strconv.Atoi(timeoutStr)
-		if (timeoutStr == "") || (err != nil) {
-			c.Timeout = time.Duration(20 * time.Second)
-		} else {
-			c.Timeout = time.Duration(timeout) * time.Second
+	if mongodConfig, ok := result["mongod"]; ok {
+		if _, ok := result["modules"]; ok {
+			return c, &ConfigError{Path: "mongod", Message: "cannot be used with modules"}
 		}
-
-		portStr := mongodConfig["port"].(string)
-		port, err := strconv.Atoi(portStr)
-		if (portStr == "") || (err != nil) {
-			c.Port = 27017
-		} else {
-			c.Port = port
+		mongodMap := convert.ToBSONMap(mongodConfig)
+		if mongodMap == nil {
+			return c, &ConfigError{Path: "mongod", Message: "expected an object"}
 		}
 
-		c.ReadOnly = mongodConfig["readonly"].(string) == "true"
-
-	} else {
-		return fmt.Errorf("missing expected config element 'mongod'")
+		// the port in old mongod elements was the port of the proxy
+		if port, ok := mongodMap["port"]; ok {
+			if _, ok := result["port"]; !ok {
+				result["port"] = port
+			}
+			delete(mongodMap, "port")
+		}
+		delete(result, "mongod")
+		result["modules"] = []interface{}{bson.M{"name": "mongod", "config": mongodMap}}
 	}
 
-	return nil
+	err = DecodeConfig(result, &c)
+	if err != nil {
+		return c, err
+	}
+	if len(c.Modules) == 0 {
+		return c, &ConfigError{Path: "modules", Message: "at least one module is required"}
+	}
+	if c.LogLevel < 1 || c.LogLevel > 5 {
+		return c, &ConfigError{Path: "logLevel", Message: "must be between 1 and 5"}
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return c, &ConfigError{Path: "tls", Message: "certFile and keyFile must be set together"}
+	}
+	return c, nil
 }
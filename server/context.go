@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// A Conn is a client connection of the proxy, as modules see it. Its ID and
+// address are fixed, and its appName and user are set as the client sends its
+// handshake and authenticates.
+type Conn struct {
+	// ID identifies the connection among those of the proxy. IDs start at 1.
+	ID int64
+
+	RemoteAddr net.Addr
+
+	mu      sync.Mutex
+	appName string
+	user    string
+}
+
+// NewConn returns a client connection with the given ID and remote address.
+func NewConn(id int64, remoteAddr net.Addr) *Conn {
+	return &Conn{ID: id, RemoteAddr: remoteAddr}
+}
+
+// AppName returns the application name the client gave in its handshake, or an
+// empty string if it gave none.
+func (c *Conn) AppName() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.appName
+}
+
+// SetAppName sets the application name of the client.
+func (c *Conn) SetAppName(appName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.appName = appName
+}
+
+// User returns the user the client authenticated as, as "db.user", or an empty
+// string if it hasn't authenticated with a module that knows who it is.
+func (c *Conn) User() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.user
+}
+
+// SetUser sets the user the client authenticated as, or clears it if user is
+// empty. Modules that authenticate clients call it.
+func (c *Conn) SetUser(user string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.user = user
+}
+
+// A Context is the context of a request in the pipeline. It is a context.Context
+// that is cancelled when the client connection the request came from is closed,
+// and it carries that connection.
+type Context struct {
+	context.Context
+	Conn *Conn
+}
+
+// NewContext returns the context of the requests of a client connection.
+func NewContext(ctx context.Context, conn *Conn) Context {
+	return Context{Context: ctx, Conn: conn}
+}
+
+// WithContext returns a copy of the context with its context.Context replaced,
+// such as to give a request a deadline.
+func (c Context) WithContext(ctx context.Context) Context {
+	return Context{Context: ctx, Conn: c.Conn}
+}
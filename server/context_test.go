@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/WyattNielsen/mongoproxy/messages"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// contextModule records the context of the requests it processes.
+type contextModule struct {
+	contexts []Context
+}
+
+func (c *contextModule) Name() string {
+	return "context"
+}
+
+func (c *contextModule) Configure(config bson.M) error {
+	return nil
+}
+
+func (c *contextModule) Process(ctx Context, req messages.Requester, res messages.Responder,
+	next PipelineFunc) {
+	c.contexts = append(c.contexts, ctx)
+	next(ctx, req, res)
+}
+
+func (c *contextModule) New() Module {
+	return &contextModule{}
+}
+
+func TestContext(t *testing.T) {
+	Convey("Carry the client connection of a request through the pipeline", t, func() {
+		addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 50000}
+		conn := NewConn(7, addr)
+		parent, cancel := context.WithCancel(context.Background())
+		ctx := NewContext(parent, conn)
+
+		Convey("to every module", func() {
+			first, second := &contextModule{}, &contextModule{}
+			pipeline := BuildPipeline(CreateChain().AddModule(first).AddModule(second))
+			pipeline(ctx, messages.Command{CommandName: "ping"}, &messages.ModuleResponse{})
+
+			So(len(first.contexts), ShouldEqual, 1)
+			So(len(second.contexts), ShouldEqual, 1)
+			So(second.contexts[0].Conn.ID, ShouldEqual, 7)
+			So(second.contexts[0].Conn.RemoteAddr, ShouldEqual, addr)
+		})
+
+		Convey("with what the client tells about itself", func() {
+			So(conn.AppName(), ShouldEqual, "")
+			So(conn.User(), ShouldEqual, "")
+			conn.SetAppName("reports")
+			conn.SetUser("admin.analyst")
+			So(ctx.Conn.AppName(), ShouldEqual, "reports")
+			So(ctx.Conn.User(), ShouldEqual, "admin.analyst")
+		})
+
+		Convey("that is cancelled with the connection", func() {
+			cancel()
+			So(ctx.Err(), ShouldEqual, context.Canceled)
+		})
+
+		Convey("with a deadline of its own", func() {
+			deadlineCtx, cancelDeadline := context.WithTimeout(ctx, time.Minute)
+			defer cancelDeadline()
+			withDeadline := ctx.WithContext(deadlineCtx)
+			_, ok := withDeadline.Deadline()
+			So(ok, ShouldBeTrue)
+			So(withDeadline.Conn, ShouldEqual, conn)
+			_, ok = ctx.Deadline()
+			So(ok, ShouldBeFalse)
+		})
+
+		Reset(cancel)
+	})
+}
@@ -3,7 +3,10 @@
 package server
 
 import (
+	"context"
+
 	"github.com/WyattNielsen/mongoproxy/messages"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 type Module interface {
@@ -11,16 +14,28 @@ type Module interface {
 	// Name returns the name to identify this module when registered.
 	Name() string
 
-	// Configure configures this module with the given configuration object. Returns
-	// an error if the configuration is invalid for the module.
-	Configure(config Config) error
+	// Configure configures this module with the given configuration object, which
+	// is the module's "config" block from the configuration file and may be nil.
+	// Returns an error if the configuration is invalid for the module.
+	Configure(config bson.M) error
 
 	// Process is the function executed when a message is called in the pipeline.
-	// It takes in a Requester from an upstream module (or proxy core), a
-	// Responder that it writes a response to, and a PipelineFunc that should
-	// be called to execute the next module in the pipeline.
-	Process(messages.Requester, messages.Responder, PipelineFunc)
+	// It takes in the Context of the request, with the client connection it came
+	// from, a Requester from an upstream module (or proxy core), a Responder that
+	// it writes a response to, and a PipelineFunc that should be called to
+	// execute the next module in the pipeline.
+	Process(Context, messages.Requester, messages.Responder, PipelineFunc)
 
 	// New creates a new instance of this module.
 	New() Module
 }
+
+// A Closer is a Module that holds resources to release when the proxy shuts
+// down, such as its connections to a backend. Modules that hold none don't need
+// to implement it.
+type Closer interface {
+	// Close releases the module's resources. It is called once, after the last
+	// request went through the pipeline, and gives up on releasing them cleanly
+	// once ctx is done.
+	Close(ctx context.Context) error
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// registry holds the prototype of every published module, keyed by the module's name.
+var registry = struct {
+	sync.RWMutex
+	modules map[string]Module
+}{modules: make(map[string]Module)}
+
+// Publish adds a module to the registry under its Name(), so that it can be
+// used in a pipeline by configuration. Modules call Publish from an init function.
+// Publishing two modules with the same name panics.
+func Publish(m Module) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	name := m.Name()
+	if _, ok := registry.modules[name]; ok {
+		panic(fmt.Sprintf("module %v is already published", name))
+	}
+	registry.modules[name] = m
+}
+
+// NewModule returns a new instance of the published module with the given name,
+// and an error if no module with that name was published.
+func NewModule(name string) (Module, error) {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	proto, ok := registry.modules[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown module %v", name)
+	}
+	return proto.New(), nil
+}
+
+// Modules returns the names of all published modules, sorted.
+func Modules() []string {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	names := make([]string, 0, len(registry.modules))
+	for name := range registry.modules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/WyattNielsen/mongoproxy/messages"
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// testModule records the configuration it was given.
+type testModule struct {
+	config bson.M
+}
+
+func (t *testModule) Name() string {
+	return "test"
+}
+
+func (t *testModule) Configure(config bson.M) error {
+	t.config = config
+	return nil
+}
+
+func (t *testModule) Process(ctx Context, req messages.Requester, res messages.Responder,
+	next PipelineFunc) {
+	next(ctx, req, res)
+}
+
+func (t *testModule) New() Module {
+	return &testModule{}
+}
+
+func init() {
+	Publish(&testModule{})
+}
+
+// closingModule records that it was closed, and fails to close if err is set.
+type closingModule struct {
+	testModule
+	closed bool
+	err    error
+}
+
+func (c *closingModule) Close(ctx context.Context) error {
+	c.closed = true
+	return c.err
+}
+
+func writeConfigFile(contents string) string {
+	dir, err := ioutil.TempDir("", "mongoproxy")
+	So(err, ShouldBeNil)
+	Reset(func() {
+		os.RemoveAll(dir)
+	})
+
+	filename := filepath.Join(dir, "config.json")
+	So(ioutil.WriteFile(filename, []byte(contents), 0600), ShouldBeNil)
+	return filename
+}
+
+func TestRegistry(t *testing.T) {
+	Convey("Create modules from the registry", t, func() {
+		So(Modules(), ShouldContain, "test")
+		So(func() { Publish(&testModule{}) }, ShouldPanic)
+
+		mod, err := NewModule("test")
+		So(err, ShouldBeNil)
+		So(mod, ShouldHaveSameTypeAs, &testModule{})
+
+		_, err = NewModule("missing")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestBuildChain(t *testing.T) {
+	Convey("Build a module chain from a configuration file", t, func() {
+		Convey("with a modules array", func() {
+			filename := writeConfigFile(`{"port": 9000, "modules": [
+				{"name": "test", "config": {"foo": "bar"}},
+				{"name": "test"}
+			]}`)
+
+			config, err := ParseConfigFromFile(filename)
+			So(err, ShouldBeNil)
+			So(config.Port, ShouldEqual, 9000)
+			So(config.LogLevel, ShouldEqual, 3)
+			So(config.TLS.Enabled(), ShouldEqual, false)
+			So(config.ShutdownTimeout, ShouldEqual, 20*time.Second)
+			So(len(config.Modules), ShouldEqual, 2)
+			So(config.Modules[0].Name, ShouldEqual, "test")
+			So(config.Modules[0].Config["foo"], ShouldEqual, "bar")
+			So(config.Modules[1].Config, ShouldBeNil)
+
+			chain, err := BuildChain(config.Modules)
+			So(err, ShouldBeNil)
+			So(len(chain.chain), ShouldEqual, 2)
+			So(chain.chain[0].(*testModule).config, ShouldResemble, bson.M{"foo": "bar"})
+			So(chain.chain[0], ShouldNotPointTo, chain.chain[1])
+		})
+
+		Convey("with only a mongod element", func() {
+			filename := writeConfigFile(`{"mongod": {"addresses": "localhost:27017", "port": "9000"}}`)
+
+			config, err := ParseConfigFromFile(filename)
+			So(err, ShouldBeNil)
+			So(config.Port, ShouldEqual, 9000)
+			So(len(config.Modules), ShouldEqual, 1)
+			So(config.Modules[0].Name, ShouldEqual, "mongod")
+			So(config.Modules[0].Config, ShouldResemble, bson.M{"addresses": "localhost:27017"})
+		})
+
+		Convey("with an unknown module", func() {
+			filename := writeConfigFile(`{"modules": [{"name": "missing"}]}`)
+
+			config, err := ParseConfigFromFile(filename)
+			So(err, ShouldBeNil)
+
+			chain, err := BuildChain(config.Modules)
+			So(err, ShouldNotBeNil)
+			So(chain, ShouldBeNil)
+		})
+
+		Convey("with invalid settings", func() {
+			filename := writeConfigFile(`{"logLevel": "loud", "tls": {"certFile": "cert.pem"},
+				"modules": [{"config": {}}]}`)
+
+			_, err := ParseConfigFromFile(filename)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "logLevel: expected an integer")
+			So(err.Error(), ShouldContainSubstring, "modules[0].name: is required")
+		})
+
+		Convey("without modules", func() {
+			filename := writeConfigFile(`{"port": 9000}`)
+
+			_, err := ParseConfigFromFile(filename)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestCloseChain(t *testing.T) {
+	Convey("Close the modules of a chain when the proxy shuts down", t, func() {
+		first := &closingModule{err: fmt.Errorf("backend unreachable")}
+		second := &closingModule{}
+		chain := CreateChain().AddModule(first).AddModule(&testModule{}).AddModule(second)
+
+		err := chain.Close(context.Background())
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "backend unreachable")
+		So(first.closed, ShouldBeTrue)
+		So(second.closed, ShouldBeTrue)
+	})
+}
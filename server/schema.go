@@ -0,0 +1,281 @@
+package server
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/WyattNielsen/mongoproxy/convert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// A ConfigError is a problem with a single value in a configuration document.
+// Path locates the value, e.g. "connection.auth.username" or "rules[2].origin".
+type ConfigError struct {
+	Path    string
+	Message string
+}
+
+func (e *ConfigError) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return e.Path + ": " + e.Message
+}
+
+// ConfigErrors are all the problems found in a configuration document.
+type ConfigErrors []*ConfigError
+
+func (e ConfigErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// DecodeConfig decodes a configuration document into the struct pointed to by out,
+// which acts as the schema for the document. Each exported field is read from the
+// key given in its config tag, e.g. `config:"addresses"`, and fields tagged
+// `config:"name,required"` must be present. Fields without a config tag are
+// skipped. Missing fields take the value in their default tag, if any, and keys
+// that aren't in the schema are rejected.
+//
+// Strings, bools, numbers, durations, string slices, nested structs, slices of
+// structs and bson.M are supported. Since older configurations were written
+// with strings only, bools and numbers can also be given as strings, and string
+// slices as comma separated strings. Durations are either numbers of seconds or
+// strings such as "1m30s".
+//
+// All problems with the document are returned together as ConfigErrors.
+func DecodeConfig(doc bson.M, out interface{}) error {
+	v := reflect.ValueOf(out)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("DecodeConfig needs a pointer to a struct, not %T", out)
+	}
+
+	d := &configDecoder{}
+	d.decodeStruct("", doc, v.Elem())
+	if len(d.errs) > 0 {
+		return d.errs
+	}
+	return nil
+}
+
+type configDecoder struct {
+	errs ConfigErrors
+}
+
+func (d *configDecoder) fail(path string, format string, args ...interface{}) {
+	d.errs = append(d.errs, &ConfigError{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func (d *configDecoder) decodeStruct(path string, doc bson.M, v reflect.Value) {
+	t := v.Type()
+	known := make(map[string]bool)
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag, ok := field.Tag.Lookup("config")
+		if !ok || field.PkgPath != "" {
+			continue
+		}
+		parts := strings.Split(tag, ",")
+		key := parts[0]
+		required := len(parts) > 1 && parts[1] == "required"
+		known[key] = true
+		fieldPath := joinPath(path, key)
+
+		raw, present := doc[key]
+		if !present || raw == nil {
+			if def, ok := field.Tag.Lookup("default"); ok {
+				d.decodeValue(fieldPath, def, v.Field(i))
+			} else if required {
+				d.fail(fieldPath, "is required")
+			} else if field.Type.Kind() == reflect.Struct {
+				// a missing object still gets the defaults of its fields
+				d.applyDefaults(fieldPath, v.Field(i))
+			}
+			continue
+		}
+		d.decodeValue(fieldPath, raw, v.Field(i))
+	}
+
+	for key := range doc {
+		if !known[key] {
+			d.fail(joinPath(path, key), "unknown field")
+		}
+	}
+}
+
+// applyDefaults sets the fields of a struct, and of its nested structs, that have
+// a default tag to their defaults.
+func (d *configDecoder) applyDefaults(path string, v reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag, ok := field.Tag.Lookup("config")
+		if !ok || field.PkgPath != "" {
+			continue
+		}
+		fieldPath := joinPath(path, strings.Split(tag, ",")[0])
+
+		if def, ok := field.Tag.Lookup("default"); ok {
+			d.decodeValue(fieldPath, def, v.Field(i))
+		} else if field.Type.Kind() == reflect.Struct {
+			d.applyDefaults(fieldPath, v.Field(i))
+		}
+	}
+}
+
+func (d *configDecoder) decodeValue(path string, raw interface{}, v reflect.Value) {
+	if v.Type() == durationType {
+		duration, ok := toDuration(raw)
+		if !ok {
+			d.fail(path, "expected a number of seconds or a duration, got %v", raw)
+			return
+		}
+		v.SetInt(int64(duration))
+		return
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		s, ok := raw.(string)
+		if !ok {
+			d.fail(path, "expected a string, got %v", raw)
+			return
+		}
+		v.SetString(s)
+	case reflect.Bool:
+		b, ok := toBool(raw)
+		if !ok {
+			d.fail(path, "expected a boolean, got %v", raw)
+			return
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		n, ok := toInt(raw)
+		if !ok {
+			d.fail(path, "expected an integer, got %v", raw)
+			return
+		}
+		if v.OverflowInt(n) {
+			d.fail(path, "%v is out of range", n)
+			return
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		f, ok := toFloat(raw)
+		if !ok {
+			d.fail(path, "expected a number, got %v", raw)
+			return
+		}
+		v.SetFloat(f)
+	case reflect.Struct:
+		doc := convert.ToBSONMap(raw)
+		if doc == nil {
+			d.fail(path, "expected an object")
+			return
+		}
+		d.decodeStruct(path, doc, v)
+	case reflect.Slice:
+		d.decodeSlice(path, raw, v)
+	case reflect.Map:
+		doc := convert.ToBSONMap(raw)
+		if doc == nil || v.Type() != reflect.TypeOf(bson.M{}) {
+			d.fail(path, "expected an object")
+			return
+		}
+		v.Set(reflect.ValueOf(doc))
+	default:
+		d.fail(path, "unsupported type %v", v.Type())
+	}
+}
+
+func (d *configDecoder) decodeSlice(path string, raw interface{}, v reflect.Value) {
+	if s, ok := raw.(string); ok && v.Type().Elem().Kind() == reflect.String {
+		items := make([]string, 0)
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+		return
+	}
+
+	if a, ok := raw.(bson.A); ok {
+		raw = []interface{}(a)
+	}
+	items, ok := raw.([]interface{})
+	if !ok {
+		d.fail(path, "expected an array")
+		return
+	}
+
+	slice := reflect.MakeSlice(v.Type(), len(items), len(items))
+	for i, item := range items {
+		d.decodeValue(fmt.Sprintf("%v[%v]", path, i), item, slice.Index(i))
+	}
+	v.Set(slice)
+}
+
+func toBool(raw interface{}) (bool, bool) {
+	switch b := raw.(type) {
+	case bool:
+		return b, true
+	case string:
+		parsed, err := strconv.ParseBool(b)
+		return parsed, err == nil
+	}
+	return false, false
+}
+
+func toInt(raw interface{}) (int64, bool) {
+	switch n := raw.(type) {
+	case string:
+		parsed, err := strconv.ParseInt(n, 10, 64)
+		return parsed, err == nil
+	case float64:
+		return int64(n), n == float64(int64(n))
+	case int, int32, int64:
+		return convert.ToInt64(n), true
+	}
+	return 0, false
+}
+
+func toFloat(raw interface{}) (float64, bool) {
+	switch n := raw.(type) {
+	case string:
+		parsed, err := strconv.ParseFloat(n, 64)
+		return parsed, err == nil
+	case float64, int, int32, int64:
+		return convert.ToFloat64(n), true
+	}
+	return 0, false
+}
+
+func toDuration(raw interface{}) (time.Duration, bool) {
+	if s, ok := raw.(string); ok {
+		if duration, err := time.ParseDuration(s); err == nil {
+			return duration, true
+		}
+	}
+	seconds, ok := toFloat(raw)
+	if !ok || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds * float64(time.Second)), true
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type testAuth struct {
+	Username string `config:"username,required"`
+	Password string `config:"password"`
+}
+
+type testSchema struct {
+	Addresses []string      `config:"addresses" default:"localhost"`
+	Timeout   time.Duration `config:"timeout" default:"20s"`
+	Retries   int32         `config:"retries" default:"3"`
+	Direct    bool          `config:"direct"`
+	Auth      testAuth      `config:"auth"`
+	Users     []testAuth    `config:"users"`
+	Extra     bson.M        `config:"extra"`
+	Ignored   string
+}
+
+func TestDecodeConfig(t *testing.T) {
+	Convey("Decode a configuration document", t, func() {
+		Convey("with all of its fields", func() {
+			doc := bson.M{
+				"addresses": []interface{}{"a:27017", "b:27017"},
+				"timeout":   float64(5),
+				"retries":   float64(1),
+				"direct":    true,
+				"auth":      map[string]interface{}{"username": "user", "password": "pass"},
+				"users":     []interface{}{bson.M{"username": "other"}},
+				"extra":     map[string]interface{}{"foo": "bar"},
+			}
+
+			var c testSchema
+			So(DecodeConfig(doc, &c), ShouldBeNil)
+			So(c.Addresses, ShouldResemble, []string{"a:27017", "b:27017"})
+			So(c.Timeout, ShouldEqual, 5*time.Second)
+			So(c.Retries, ShouldEqual, 1)
+			So(c.Direct, ShouldEqual, true)
+			So(c.Auth, ShouldResemble, testAuth{"user", "pass"})
+			So(c.Users, ShouldResemble, []testAuth{{"other", ""}})
+			So(c.Extra, ShouldResemble, bson.M{"foo": "bar"})
+		})
+
+		Convey("with defaults and strings for other types", func() {
+			doc := bson.M{
+				"addresses": "a:27017, b:27017",
+				"timeout":   "1m",
+				"direct":    "true",
+				"auth":      bson.M{"username": "user"},
+			}
+
+			var c testSchema
+			So(DecodeConfig(doc, &c), ShouldBeNil)
+			So(c.Addresses, ShouldResemble, []string{"a:27017", "b:27017"})
+			So(c.Timeout, ShouldEqual, time.Minute)
+			So(c.Retries, ShouldEqual, 3)
+			So(c.Direct, ShouldEqual, true)
+
+			c = testSchema{}
+			So(DecodeConfig(bson.M{}, &c), ShouldBeNil)
+			So(c.Addresses, ShouldResemble, []string{"localhost"})
+			So(c.Timeout, ShouldEqual, 20*time.Second)
+		})
+
+		Convey("with errors, which are all returned with their paths", func() {
+			doc := bson.M{
+				"timeout": "soon",
+				"retries": 1.5,
+				"auth":    bson.M{"password": "pass"},
+				"users":   []interface{}{bson.M{"username": 1}},
+				"Ignored": "foo",
+			}
+
+			var c testSchema
+			err := DecodeConfig(doc, &c)
+			So(err, ShouldNotBeNil)
+
+			errs, ok := err.(ConfigErrors)
+			So(ok, ShouldEqual, true)
+			paths := make([]string, len(errs))
+			for i, e := range errs {
+				paths[i] = e.Path
+			}
+			So(len(paths), ShouldEqual, 5)
+			So(paths, ShouldContain, "timeout")
+			So(paths, ShouldContain, "retries")
+			So(paths, ShouldContain, "auth.username")
+			So(paths, ShouldContain, "users[0].username")
+			So(paths, ShouldContain, "Ignored")
+		})
+
+		Convey("into something that isn't a struct", func() {
+			var s string
+			So(DecodeConfig(bson.M{}, &s), ShouldNotBeNil)
+		})
+	})
+}